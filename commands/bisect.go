@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// badRequestError is returned for a batch CleverTap rejected as a whole with a 400. Sending it again fails the
+// same way, so the batch is bisected instead of retried.
+type badRequestError struct {
+	response string
+}
+
+func (e *badRequestError) Error() string {
+	return "rejected with status 400: " + e.response
+}
+
+// maxBisectRequests is the most requests spent on bisecting one batch, what is still rejected after that is written
+// to the dead-letter file as it is
+const maxBisectRequests = 64
+
+// bisection is the request budget of the bisection of a batch
+type bisection struct {
+	requestsLeft int
+}
+
+// bisectBatch uploads the two halves of a batch rejected with a 400 as batches of their own. A half rejected too is
+// split again, down to single records, which are written to the dead-letter file with the response. Once the
+// request budget runs out the parts still rejected are written to the dead-letter file as they are. The responses of
+// the halves are merged into one.
+func bisectBatch(ctx context.Context, batch []ctRecordInfo, t *globals.Target, rejected *badRequestError,
+	b *bisection) (*CTResponse, error) {
+	if len(batch) == 1 {
+		r := batch[0]
+		if r.Source != "" {
+			logger.Printf("Record at line %v of %v rejected with status 400%v: %v", r.LineNum+1, r.Source,
+				targetLabel(t.Name), rejected.response)
+		} else {
+			logger.Printf("Record rejected with status 400%v: %v", targetLabel(t.Name), rejected.response)
+		}
+		return rejectBatch(batch, t, rejected), nil
+	}
+	if b.requestsLeft < 2 {
+		logger.Printf("Batch of %v records rejected with status 400%v, no more splitting after %v requests: %v",
+			len(batch), targetLabel(t.Name), maxBisectRequests, rejected.response)
+		return rejectBatch(batch, t, rejected), nil
+	}
+	logger.Printf("Batch of %v records rejected with status 400%v, splitting it in halves", len(batch),
+		targetLabel(t.Name))
+	Summary.Lock()
+	Summary.batchesSplit++
+	Summary.Unlock()
+	merged := &CTResponse{Status: "success"}
+	var firstErr error
+	var rejectedParts [][]ctRecordInfo
+	var rejections []*badRequestError
+	half := len(batch) / 2
+	for _, part := range [][]ctRecordInfo{batch[:half], batch[half:]} {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		b.requestsLeft--
+		resp, err := uploadBatch(ctx, part, t, b)
+		if badRequest, ok := err.(*badRequestError); ok {
+			rejectedParts = append(rejectedParts, part)
+			rejections = append(rejections, badRequest)
+			continue
+		}
+		mergeResponse(merged, part, resp)
+		if err != nil && firstErr == nil {
+			//the half was given up on and is in the dead-letter file, the other half can still go through
+			firstErr = err
+		}
+	}
+	for i, part := range rejectedParts {
+		resp, err := bisectBatch(ctx, part, t, rejections[i], b)
+		mergeResponse(merged, part, resp)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return merged, firstErr
+}
+
+// mergeResponse adds the response to a part of a bisected batch to merged
+func mergeResponse(merged *CTResponse, part []ctRecordInfo, resp *CTResponse) {
+	if resp == nil {
+		return
+	}
+	if resp.Status == "fail" {
+		for _, r := range part {
+			merged.Unprocessed = append(merged.Unprocessed, map[string]interface{}{
+				"status": "fail",
+				"error":  resp.Error,
+				"record": r.Record,
+			})
+		}
+		return
+	}
+	merged.Processed += resp.Processed
+	merged.Unprocessed = append(merged.Unprocessed, resp.Unprocessed...)
+}
+
+// rejectBatch writes the records of a batch rejected with a 400 to the dead-letter file and returns them as
+// unprocessed
+func rejectBatch(batch []ctRecordInfo, t *globals.Target, rejected *badRequestError) *CTResponse {
+	Summary.Lock()
+	Summary.ctUnprocessed += int64(len(batch))
+	Summary.badRequestRecords += int64(len(batch))
+	Summary.Unlock()
+	countForTarget(t.Name, func(c *targetCounts) { c.Unprocessed += int64(len(batch)) })
+	reportUploaded(batch)
+	resp := &CTResponse{Status: "success"}
+	for _, r := range batch {
+		writeToDeadLetter(r, rejected.response, http.StatusBadRequest)
+		resp.Unprocessed = append(resp.Unprocessed, map[string]interface{}{
+			"status": "fail",
+			"code":   http.StatusBadRequest,
+			"error":  rejected.response,
+			"record": r.Record,
+		})
+	}
+	checkpoint.markBatchDone(batch)
+	return resp
+}
+
+func logBisectSummary() {
+	Summary.Lock()
+	defer Summary.Unlock()
+	if Summary.batchesSplit > 0 || Summary.badRequestRecords > 0 {
+		logger.Printf("Batches split after a 400: %v , records rejected with a 400: %v", Summary.batchesSplit,
+			Summary.badRequestRecords)
+	}
+}
@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// rejectingServer answers upload requests with a 400 when reject returns true for one of the records
+func rejectingServer(requests *int64, reject func(record map[string]interface{}) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		var payload struct {
+			D []map[string]interface{} `json:"d"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, record := range payload.D {
+			if reject(record) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"status":"fail","error":"Malformed request","code":400}`)
+				return
+			}
+		}
+		fmt.Fprintf(w, `{"status":"success","processed":%v,"unprocessed":[]}`, len(payload.D))
+	}))
+}
+
+// testBatch returns a batch of n profiles, the ones at the indexes in bad have an identity starting with bad-
+func testBatch(n int, bad ...int) []ctRecordInfo {
+	batch := make([]ctRecordInfo, n)
+	for i := range batch {
+		identity := fmt.Sprintf("user-%v", i)
+		for _, b := range bad {
+			if i == b {
+				identity = "bad-" + identity
+			}
+		}
+		batch[i] = ctRecordInfo{Record: map[string]interface{}{"identity": identity, "type": "profile"}}
+	}
+	return batch
+}
+
+func TestBisectIsolatesRejectedRecord(t *testing.T) {
+	var requests int64
+	server := rejectingServer(&requests, func(record map[string]interface{}) bool {
+		return strings.HasPrefix(record["identity"].(string), "bad-")
+	})
+	defer server.Close()
+
+	resp, err := sendBatchToCTAPI(context.Background(), testBatch(64, 37), &globals.Target{APIEndpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Processed != 63 || len(resp.Unprocessed) != 1 {
+		t.Errorf("processed %v, unprocessed %v, want 63 and 1", resp.Processed, len(resp.Unprocessed))
+	}
+	//the batch, then both halves at each of the 6 levels down to the record
+	if requests != 13 {
+		t.Errorf("sent %v requests, want 13", requests)
+	}
+}
+
+func TestBisectSplitsBothHalvesWhenBothAreRejected(t *testing.T) {
+	var requests int64
+	server := rejectingServer(&requests, func(record map[string]interface{}) bool {
+		return strings.HasPrefix(record["identity"].(string), "bad-")
+	})
+	defer server.Close()
+
+	resp, err := sendBatchToCTAPI(context.Background(), testBatch(1000, 100, 900),
+		&globals.Target{APIEndpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Processed != 998 || len(resp.Unprocessed) != 2 {
+		t.Fatalf("processed %v, unprocessed %v, want 998 and 2", resp.Processed, len(resp.Unprocessed))
+	}
+	for i, want := range []string{"bad-user-100", "bad-user-900"} {
+		record := resp.Unprocessed[i].(map[string]interface{})["record"].(map[string]interface{})
+		if record["identity"] != want {
+			t.Errorf("unprocessed record %v is %v, want %v", i, record["identity"], want)
+		}
+	}
+	if requests > maxBisectRequests+1 {
+		t.Errorf("sent %v requests, want at most %v", requests, maxBisectRequests+1)
+	}
+}
+
+func TestBisectStopsWhenTheBudgetRunsOut(t *testing.T) {
+	var requests int64
+	server := rejectingServer(&requests, func(record map[string]interface{}) bool { return true })
+	defer server.Close()
+
+	resp, err := sendBatchToCTAPI(context.Background(), testBatch(1000), &globals.Target{APIEndpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Processed != 0 || len(resp.Unprocessed) != 1000 {
+		t.Errorf("processed %v, unprocessed %v, want 0 and 1000", resp.Processed, len(resp.Unprocessed))
+	}
+	//the batch and the requests of the budget
+	if requests != maxBisectRequests+1 {
+		t.Errorf("sent %v requests, want %v", requests, maxBisectRequests+1)
+	}
+}
@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+//{
+//"files": {
+//"/data/profiles.csv": 120345
+//}
+//}
+
+// checkpointSaveInterval is the most often lines skipped outside of batches save the checkpoint
+const checkpointSaveInterval = time.Second
+
+type checkpointState struct {
+	Files map[string]int `json:"files"`
+}
+
+// checkpointTracker records, per input file, the highest line number up to which every line has either been
+// acknowledged by CleverTap or skipped. Batches complete out of order across the apiConcurrency workers, so
+// lines acknowledged beyond the first gap are held in pending until the gap closes. When uploading to several
+// targets, a line is only acknowledged once every target has acknowledged it. In a dry run nothing is uploaded,
+// so the checkpoint is only read.
+type checkpointTracker struct {
+	sync.Mutex
+	path     string
+	state    checkpointState
+	lastLine map[string]int
+	pending  map[string]map[int]bool
+	targets  int
+	acks     map[string]map[int]int
+	readOnly bool
+	// dirty is set when lines were marked done since the last save
+	dirty   bool
+	savedAt time.Time
+}
+
+// checkpoint is nil unless a checkpoint file path was passed
+var checkpoint *checkpointTracker
+
+func initCheckpoint() error {
+	c := &checkpointTracker{
+		path:     *globals.CheckpointFilePath,
+		state:    checkpointState{Files: make(map[string]int)},
+		lastLine: make(map[string]int),
+		pending:  make(map[string]map[int]bool),
+		targets:  len(globals.Targets),
+		acks:     make(map[string]map[int]int),
+		readOnly: *globals.DryRun,
+	}
+	if c.readOnly {
+		logger.Println("Dry run, the checkpoint file is not updated")
+	}
+	if *globals.Resume {
+		b, err := ioutil.ReadFile(c.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &c.state); err != nil {
+				return err
+			}
+			if c.state.Files == nil {
+				c.state.Files = make(map[string]int)
+			}
+			for file, lineNum := range c.state.Files {
+				c.lastLine[file] = lineNum
+			}
+		} else {
+			logger.Printf("Checkpoint file %v not found. Starting from the beginning", c.path)
+		}
+	}
+	checkpoint = c
+	return nil
+}
+
+// resumeLine returns the last line of file covered by the checkpoint, or -1 if nothing should be skipped
+func (c *checkpointTracker) resumeLine(file string) int {
+	if c == nil || !*globals.Resume {
+		return -1
+	}
+	c.Lock()
+	defer c.Unlock()
+	lineNum, ok := c.lastLine[file]
+	if !ok {
+		return -1
+	}
+	return lineNum
+}
+
+// markDone marks a line of file as finished for all targets, because it was skipped. Skipped lines save the
+// checkpoint at most once every checkpointSaveInterval, the next batch or flush saves the rest.
+func (c *checkpointTracker) markDone(file string, lineNum int) {
+	if c == nil || c.readOnly || file == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.advance(file, lineNum) {
+		c.dirty = true
+		if time.Since(c.savedAt) >= checkpointSaveInterval {
+			c.save()
+		}
+	}
+}
+
+// flush saves the lines marked done since the last save, at the end of a run
+func (c *checkpointTracker) flush() {
+	if c == nil || c.readOnly {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.dirty {
+		c.save()
+	}
+}
+
+// markBatchDone marks every line of a batch acknowledged by one target as finished and saves the checkpoint once
+func (c *checkpointTracker) markBatchDone(batch []ctRecordInfo) {
+	if c == nil || c.readOnly {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	advanced := false
+	for _, r := range batch {
+		if r.Source == "" || !c.acknowledged(r.Source, r.LineNum) {
+			continue
+		}
+		if c.advance(r.Source, r.LineNum) {
+			advanced = true
+		}
+	}
+	if advanced || c.dirty {
+		c.save()
+	}
+}
+
+// acknowledged counts an acknowledgement of a line and returns whether all targets have acknowledged it
+func (c *checkpointTracker) acknowledged(file string, lineNum int) bool {
+	if c.targets < 2 {
+		return true
+	}
+	a, ok := c.acks[file]
+	if !ok {
+		a = make(map[int]int)
+		c.acks[file] = a
+	}
+	a[lineNum]++
+	if a[lineNum] < c.targets {
+		return false
+	}
+	delete(a, lineNum)
+	return true
+}
+
+func (c *checkpointTracker) advance(file string, lineNum int) bool {
+	last, ok := c.lastLine[file]
+	if !ok {
+		last = -1
+	}
+	if lineNum <= last {
+		return false
+	}
+	p, ok := c.pending[file]
+	if !ok {
+		p = make(map[int]bool)
+		c.pending[file] = p
+	}
+	p[lineNum] = true
+	advanced := false
+	for p[last+1] {
+		delete(p, last+1)
+		last++
+		advanced = true
+	}
+	if advanced {
+		c.lastLine[file] = last
+	}
+	return advanced
+}
+
+func (c *checkpointTracker) save() {
+	c.dirty = false
+	c.savedAt = time.Now()
+	for file, lineNum := range c.lastLine {
+		c.state.Files[file] = lineNum
+	}
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		logger.Println("Error encoding checkpoint", err)
+		return
+	}
+	//write to a temp file and rename so that a crash never leaves a truncated checkpoint behind
+	tmpPath := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		logger.Println("Error writing checkpoint file", err)
+		return
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		logger.Println("Error writing checkpoint file", err)
+	}
+}
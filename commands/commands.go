@@ -1,12 +1,13 @@
 package commands
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"os"
@@ -16,9 +17,12 @@ import (
 	"github.com/ankit-arora/clevertap-data-upload/globals"
 )
 
+// logger is globals.Logger, which the commands log through
+var logger = globals.Logger
+
 // Command ...
 type Command interface {
-	Execute()
+	Execute() error
 }
 
 type apiUploadRecordInfo interface {
@@ -26,27 +30,46 @@ type apiUploadRecordInfo interface {
 	print()
 }
 
-func processAPIRecordForUpload(done chan interface{}, inputRecordStream <-chan apiUploadRecordInfo) <-chan interface{} {
-	convertedRecordStream := make(chan interface{})
+// recordOrigin is implemented by source records that are read from a file, it returns the file and the 0 based
+// line number
+type recordOrigin interface {
+	origin() (string, int)
+}
+
+// ctRecordInfo is a record converted to the CleverTap upload API format along with the file and line it was
+// read from. Source is empty for records that do not come from a file. Target is the name of the account the record
+// is uploaded to, empty unless uploading to several targets.
+type ctRecordInfo struct {
+	Record  interface{}
+	Source  string
+	LineNum int
+	Target  string
+	// Transformed is set once the -transform rules were applied to Record, replayed records of a run with
+	// -transform have it already
+	Transformed bool
+}
+
+func processAPIRecordForUpload(ctx context.Context, inputRecordStream <-chan apiUploadRecordInfo) <-chan ctRecordInfo {
+	convertedRecordStream := make(chan ctRecordInfo)
 	go func() {
 		defer close(convertedRecordStream)
 		for mpRecordInfo := range inputRecordStream {
+			source, lineNum := "", 0
+			if o, ok := mpRecordInfo.(recordOrigin); ok {
+				source, lineNum = o.origin()
+			}
+			countRead(source)
 			ctRecords, err := mpRecordInfo.convertToCTAPIFormat()
 			if err != nil {
-				log.Println("Error converting API Records to Clevertap", err)
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, fmt.Errorf("error converting API Records to Clevertap: %v", err))
+				return
 			}
+			countConverted(int64(len(ctRecords)))
 			for _, ctRecord := range ctRecords {
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
-				case convertedRecordStream <- ctRecord:
+				case convertedRecordStream <- ctRecordInfo{Record: ctRecord, Source: source, LineNum: lineNum}:
 				}
 			}
 		}
@@ -54,26 +77,27 @@ func processAPIRecordForUpload(done chan interface{}, inputRecordStream <-chan a
 	return convertedRecordStream
 }
 
-func processSDKRecordForUpload(done chan interface{}, inputRecordStream <-chan sdkUploadRecordInfo) <-chan []map[string]interface{} {
+func processSDKRecordForUpload(ctx context.Context, inputRecordStream <-chan sdkUploadRecordInfo) <-chan []map[string]interface{} {
 	convertedRecordStream := make(chan []map[string]interface{})
 	go func() {
 		defer close(convertedRecordStream)
 		for mpRecordInfo := range inputRecordStream {
+			countRead("")
 			ctRecords, err := mpRecordInfo.convertToCTSDKFormat()
 			if err != nil {
-				log.Println("Error converting SDK Records to Clevertap", err)
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, fmt.Errorf("error converting SDK Records to Clevertap: %v", err))
+				return
 			}
 
 			if ctRecords != nil {
+				if !transformSDKRequest(ctRecords) {
+					logger.Println("Skipping SDK request left without a device id by -transform")
+					countSkipped("", skipMissingDeviceID)
+					continue
+				}
+				countConverted(1)
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
 				case convertedRecordStream <- ctRecords:
 				}
@@ -88,34 +112,27 @@ type sdkUploadRecordInfo interface {
 	print()
 }
 
+// commandsBySubcommand maps each subcommand to the command that runs it
+var commandsBySubcommand = map[string]func() Command{
+	"upload csv":               func() Command { return &uploadEventsProfilesFromCSVCommand{} },
+	"upload json":              func() Command { return &uploadEventsProfilesFromCSVCommand{} },
+	"import mixpanel-events":   func() Command { return &uploadEventsFromMixpanel{} },
+	"import mixpanel-profiles": func() Command { return &uploadProfilesFromMixpanel{} },
+	"import mparticle":         func() Command { return &uploadEventsFromMParticle{} },
+	"leanplum export":          func() Command { return &uploadRecordsFromLeanplum{} },
+	"leanplum load":            func() Command { return &uploadRecordsFromLeanplum{} },
+	"replay":                   func() Command { return &replayDeadLetterCommand{} },
+	"run":                      func() Command { return &runSourceCommand{} },
+	"mock-server":              func() Command { return &mockServerCommand{} },
+}
+
 // Get ...
 func Get() Command {
-	if *globals.ImportService == "leanplumToS3" || *globals.ImportService == "leanplumS3ToCT" ||
-		*globals.ImportService == "leanplumToS3Throttled" {
-		return &uploadRecordsFromLeanplum{}
-	}
-
-	if (*globals.JSONFilePath != "" || *globals.CSVFilePath != "") && (*globals.Type == "profile" || *globals.Type == "event") {
-		return &uploadEventsProfilesFromCSVCommand{}
-	}
-
-	if *globals.MixpanelSecret != "" && *globals.Type == "profile" {
-		return &uploadProfilesFromMixpanel{}
-	}
-
-	if *globals.MixpanelSecret != "" && *globals.Type == "event" {
-		return &uploadEventsFromMixpanel{}
+	newCommand, ok := commandsBySubcommand[globals.Subcommand]
+	if !ok {
+		return nil
 	}
-
-	if globals.MPEventsFilePaths != nil && len(globals.MPEventsFilePaths) > 0 && *globals.Type == "event" {
-		return &uploadEventsFromMixpanel{}
-	}
-
-	if *globals.ImportService == "mparticle" {
-		return &uploadEventsFromMParticle{}
-	}
-
-	return nil
+	return newCommand()
 }
 
 //{
@@ -138,6 +155,10 @@ var Summary = struct {
 	ctProcessed           int64
 	ctUnprocessed         int64
 	mpParseErrorResponses []string
+	retries               int64
+	batchesGivenUp        int64
+	batchesSplit          int64
+	badRequestRecords     int64
 }{
 	ctProcessed:           0,
 	ctUnprocessed:         0,
@@ -162,51 +183,52 @@ func createHTTPClient() *http.Client {
 
 var ctHTTPClient = createHTTPClient()
 
-func sendDataToCTAPI(payload map[string]interface{}, endpoint string) (string, error) {
+func sendDataToCTAPI(ctx context.Context, payload map[string]interface{}, t *globals.Target) (string, error) {
 
 	if *globals.DryRun {
 		json.NewEncoder(os.Stdout).Encode(payload)
 		return "", nil
 	}
 
+	records, _ := payload["d"].([]interface{})
+	b, err := encodeRequestBody(payload)
+	if err != nil {
+		logger.Println(err)
+		return "", err
+	}
+	endpoint := ctAPIEndpoint(t)
+	limiter := limiterFor(t.Name)
+	retries := newRetrier(ctx, "CleverTap API upload"+targetLabel(t.Name))
 	for {
-		b := &bytes.Buffer{}
-		json.NewEncoder(b).Encode(payload)
-
-		req, err := http.NewRequest("POST", endpoint, b)
+		if err := limiter.wait(ctx, len(records)); err != nil {
+			return "", err
+		}
+		req, err := b.newRequest(ctx, endpoint)
 		if err != nil {
-			log.Println(err)
+			logger.Println(err)
 			return "", err
 		}
 
 		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("X-CleverTap-Account-Id", *globals.AccountID)
-		req.Header.Add("X-CleverTap-Passcode", *globals.AccountPasscode)
+		req.Header.Add("X-CleverTap-Account-Id", t.ID)
+		req.Header.Add("X-CleverTap-Passcode", t.Passcode)
 
 		resp, err := ctHTTPClient.Do(req)
-		retry := false
+		limiter.noteThrottling(resp)
 		var body []byte
 		if err == nil {
 			body, _ = ioutil.ReadAll(resp.Body)
 		}
 
-		if err == nil && resp.StatusCode == http.StatusBadRequest && *globals.Type == "profile" {
-			//{ "status" : "fail" , "error" : "Malformed request" , "code" : 400}
-			respFromCT := &CTResponse{}
-			ctRespError := json.Unmarshal(body, respFromCT)
-			if ctRespError == nil && respFromCT.Error == "Malformed request" {
-				retry = true
-			}
-		}
-
-		if err == nil && resp.StatusCode < 500 && !retry {
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
 			responseText := string(body)
-			log.Printf("API response body: %v , status code: %v", responseText, resp.StatusCode)
-			//{ "status" : "success" , "ctProcessed" : 2 , "ctUnprocessed" : [ ]}
+			logger.Printf("API response body%v: %v , status code: %v", targetLabel(t.Name), responseText, resp.StatusCode)
+			//{ "status" : "fail" , "error" : "Malformed request" , "code" : 400}
 			if resp.StatusCode == http.StatusBadRequest {
-				fmt.Println("status 400 for:")
-				json.NewEncoder(os.Stdout).Encode(payload)
+				resp.Body.Close()
+				return responseText, &badRequestError{response: strings.TrimSpace(responseText)}
 			}
+			//{ "status" : "success" , "ctProcessed" : 2 , "ctUnprocessed" : [ ]}
 			if resp.StatusCode == http.StatusOK {
 				respFromCT := &CTResponse{}
 				ctRespError := json.Unmarshal(body, respFromCT)
@@ -217,6 +239,10 @@ func sendDataToCTAPI(payload map[string]interface{}, endpoint string) (string, e
 					Summary.ctProcessed += int64(processed)
 					Summary.ctUnprocessed += int64(unprocessed)
 					Summary.Unlock()
+					countForTarget(t.Name, func(c *targetCounts) {
+						c.Processed += int64(processed)
+						c.Unprocessed += int64(unprocessed)
+					})
 				}
 			}
 			resp.Body.Close()
@@ -227,62 +253,94 @@ func sendDataToCTAPI(payload map[string]interface{}, endpoint string) (string, e
 			if resp != nil {
 				ioutil.ReadAll(resp.Body)
 			}
-			log.Println("Error", err)
-			log.Println("retrying after 5 seconds")
+			logger.Println("Error", err)
 		} else {
 			//body, _ := ioutil.ReadAll(resp.Body)
-			log.Println("response body: ", string(body))
-			log.Println("response body: ", "retrying for payload after 5 seconds: ")
+			logger.Println("response body: ", string(body))
+			logger.Println("response body: ", "retrying for payload: ")
 			json.NewEncoder(os.Stdout).Encode(payload)
 		}
 		if resp != nil {
 			resp.Body.Close()
 		}
-		time.Sleep(5 * time.Second)
+		if err := retries.backoff(resp); err != nil {
+			logger.Println(err)
+			return "", err
+		}
 	}
 }
 
-func batchAndSendToCTAPI(done <-chan interface{}, recordStream <-chan interface{}, wg *sync.WaitGroup) {
+func ctAPIEndpoint(t *globals.Target) string {
+	if t.APIEndpoint != "" {
+		return t.APIEndpoint
+	}
+	//the region was checked against the registry when the options were validated
+	hosts, _ := globals.HostsForRegion(t.Region)
+	return globals.RegionURL(hosts.API, uploadPath)
+}
+
+func ctSDKEndpoint(t *globals.Target) string {
+	if t.SDKEndpoint != "" {
+		return t.SDKEndpoint
+	}
+	hosts, _ := globals.HostsForRegion(t.Region)
+	return globals.RegionURL(hosts.SDK, sdkUploadPath)
+}
+
+// applyBatchSettings overrides the importer defaults for batch size and concurrency with the command line options
+func applyBatchSettings() {
+	if *globals.BatchSize > 0 {
+		ctBatchSize = *globals.BatchSize
+	}
+	if *globals.APIConcurrency > 0 {
+		apiConcurrency = *globals.APIConcurrency
+	}
+	if *globals.SDKConcurrency > 0 {
+		sdkConcurrency = *globals.SDKConcurrency
+	}
+	setRateLimits(*globals.MaxRecordsPerSecond, *globals.MaxRequestsPerSecond)
+}
+
+// batchAndSendToCTAPI uploads the records of recordStream to every target, each with apiConcurrency workers of its
+// own
+func batchAndSendToCTAPI(ctx context.Context, recordStream <-chan ctRecordInfo, wg *sync.WaitGroup) {
+	applyBatchSettings()
+	recordStream = validateRecords(ctx, transformRecords(ctx, recordStream))
+	targets := globals.Targets
+	if len(targets) > 1 {
+		for _, t := range targets {
+			logger.Printf("Uploading to target %v, account %v, region %v", t.Name, t.ID, t.Region)
+		}
+	}
+	for i, stream := range fanOutRecords(ctx, recordStream, targets) {
+		batchAndSendToTarget(ctx, stream, &targets[i], wg)
+	}
+}
+
+func batchAndSendToTarget(ctx context.Context, recordStream <-chan ctRecordInfo, t *globals.Target, wg *sync.WaitGroup) {
 	for i := 0; i < apiConcurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			region := ""
-			if *globals.Region == "in" {
-				region = "in1."
-			}
-			if *globals.Region == "sk" {
-				region = "sk1."
-			}
-			if *globals.Region == "sg" {
-				region = "sg1."
-			}
-			if *globals.Region == "us" {
-				region = "us1."
-			}
-			var dataSlice []interface{}
+			var dataSlice []ctRecordInfo
 			for e := range recordStream {
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
 				default:
 					dataSlice = append(dataSlice, e)
 					if len(dataSlice) == ctBatchSize {
-						p := make(map[string]interface{})
-						p["d"] = dataSlice
-						sendDataToCTAPI(p, "https://"+region+uploadEndpoint)
+						sendBatchToCTAPI(ctx, dataSlice, t)
 						dataSlice = nil
 					}
 				}
 			}
 			if len(dataSlice) > 0 {
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
 				default:
-					p := make(map[string]interface{})
-					p["d"] = dataSlice
-					sendDataToCTAPI(p, "https://"+region+uploadEndpoint)
+					sendBatchToCTAPI(ctx, dataSlice, t)
 					dataSlice = nil
 				}
 			}
@@ -290,31 +348,96 @@ func batchAndSendToCTAPI(done <-chan interface{}, recordStream <-chan interface{
 	}
 }
 
-func sendDataToCTSDK(payload []map[string]interface{}, endpoint string) (string, error) {
+// sendBatchToCTAPI uploads a batch and returns the CleverTap response, which is nil for dry runs. Rejected
+// records and batches that are given up on are written to the dead-letter file.
+func sendBatchToCTAPI(ctx context.Context, batch []ctRecordInfo, t *globals.Target) (*CTResponse, error) {
+	return uploadBatch(ctx, batch, t, nil)
+}
+
+// uploadBatch uploads a batch, or a part of a batch being bisected with the budget of b. A batch rejected with a
+// 400 is bisected, while a part of one is returned as a *badRequestError for bisectBatch to handle.
+func uploadBatch(ctx context.Context, batch []ctRecordInfo, t *globals.Target, b *bisection) (*CTResponse, error) {
+	records := make([]interface{}, len(batch))
+	for i, r := range batch {
+		records[i] = r.Record
+	}
+	p := make(map[string]interface{})
+	p["d"] = records
+	atomic.AddInt64(&progress.batchesInFlight, 1)
+	responseText, err := sendDataToCTAPI(ctx, p, t)
+	atomic.AddInt64(&progress.batchesInFlight, -1)
+	atomic.AddInt64(&progress.batchesSent, 1)
+	if err != nil && ctx.Err() != nil {
+		//stopped, the batch was neither uploaded nor given up on
+		return nil, err
+	}
+	if badRequest, ok := err.(*badRequestError); ok {
+		if b != nil {
+			return nil, badRequest
+		}
+		return bisectBatch(ctx, batch, t, badRequest, &bisection{requestsLeft: maxBisectRequests})
+	}
+	reportUploaded(batch)
+	if err != nil {
+		logger.Printf("Giving up on batch of %v records%v: %v", len(batch), targetLabel(t.Name), err)
+		Summary.Lock()
+		Summary.batchesGivenUp++
+		Summary.Unlock()
+		countForTarget(t.Name, func(c *targetCounts) { c.BatchesGivenUp++ })
+		for _, r := range batch {
+			writeToDeadLetter(r, err.Error(), 0)
+		}
+		if *globals.DeadLetterFilePath != "" {
+			//the records are safe in the dead-letter file, so the checkpoint can move past them
+			checkpoint.markBatchDone(batch)
+		}
+		return nil, err
+	}
+	var respFromCT *CTResponse
+	if responseText != "" {
+		respFromCT = &CTResponse{}
+		if json.Unmarshal([]byte(responseText), respFromCT) == nil {
+			processUnprocessedRecords(batch, respFromCT)
+		}
+	}
+	checkpoint.markBatchDone(batch)
+	return respFromCT, nil
+}
+
+func sendDataToCTSDK(ctx context.Context, payload []map[string]interface{}, t *globals.Target, osName string) (string, error) {
 
 	if *globals.DryRun {
 		json.NewEncoder(os.Stdout).Encode(payload)
 		return "", nil
 	}
 
+	b, err := encodeRequestBody(payload)
+	if err != nil {
+		logger.Println(err)
+		return "", err
+	}
+	endpoint := ctSDKEndpoint(t) + "?os=" + osName
+	limiter := limiterFor(t.Name)
+	retries := newRetrier(ctx, "CleverTap SDK upload"+targetLabel(t.Name))
 	for {
-		b := &bytes.Buffer{}
-		json.NewEncoder(b).Encode(payload)
-
-		req, err := http.NewRequest("POST", endpoint, b)
+		if err := limiter.wait(ctx, len(payload)); err != nil {
+			return "", err
+		}
+		req, err := b.newRequest(ctx, endpoint)
 		if err != nil {
-			log.Println(err)
+			logger.Println(err)
 			return "", err
 		}
 
 		resp, err := ctHTTPClient.Do(req)
+		limiter.noteThrottling(resp)
 
 		var body []byte
 		if err == nil {
 			body, _ = ioutil.ReadAll(resp.Body)
 		}
 
-		if err == nil && resp.StatusCode < 500 {
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
 			responseText := string(body)
 			//log.Printf("SDK response body: %v , status code: %v", responseText, resp.StatusCode)
 			resp.Body.Close()
@@ -325,36 +448,60 @@ func sendDataToCTSDK(payload []map[string]interface{}, endpoint string) (string,
 			if resp != nil {
 				ioutil.ReadAll(resp.Body)
 			}
-			log.Println("Error", err)
-			log.Println("retrying after 5 seconds")
+			logger.Println("Error", err)
 		} else {
-			//status code >= 500
-			log.Println("response body: ", string(body))
-			log.Println("response body: ", "retrying for payload after 5 seconds: ")
+			//status code >= 500 or 429
+			logger.Println("response body: ", string(body))
+			logger.Println("response body: ", "retrying for payload: ")
 			json.NewEncoder(os.Stdout).Encode(payload)
 		}
 		if resp != nil {
 			resp.Body.Close()
 		}
-		time.Sleep(5 * time.Second)
+		if err := retries.backoff(resp); err != nil {
+			logger.Println(err)
+			return "", err
+		}
 	}
 }
 
-func sendToCTSDK(endpoint string, done <-chan interface{}, recordStream <-chan []map[string]interface{}, wg *sync.WaitGroup) {
+// sendToCTSDK sends the requests of recordStream to the SDK endpoint for osName of every target, each with
+// sdkConcurrency workers of its own
+func sendToCTSDK(ctx context.Context, osName string, recordStream <-chan []map[string]interface{}, wg *sync.WaitGroup) {
+	applyBatchSettings()
+	targets := globals.Targets
+	for i, stream := range fanOutSDKRequests(ctx, recordStream, targets) {
+		sendToTargetSDK(ctx, osName, stream, &targets[i], wg)
+	}
+}
+
+func sendToTargetSDK(ctx context.Context, osName string, recordStream <-chan []map[string]interface{}, t *globals.Target,
+	wg *sync.WaitGroup) {
 	for i := 0; i < sdkConcurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			//region := ""
-			//if *globals.Region == "in" {
-			//	region = "in."
-			//}
 			for e := range recordStream {
+				if *globals.ValidateOnly {
+					//only the upload API records are validated, SDK requests are not sent
+					continue
+				}
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
 				default:
-					sendDataToCTSDK(e, endpoint)
+					atomic.AddInt64(&progress.sdkInFlight, 1)
+					_, err := sendDataToCTSDK(ctx, e, t, osName)
+					atomic.AddInt64(&progress.sdkInFlight, -1)
+					atomic.AddInt64(&progress.sdkSent, 1)
+					countForTarget(t.Name, func(c *targetCounts) { c.SDKRequests++ })
+					if err != nil && ctx.Err() == nil {
+						logger.Printf("Giving up on SDK batch of %v records%v: %v", len(e), targetLabel(t.Name), err)
+						Summary.Lock()
+						Summary.batchesGivenUp++
+						Summary.Unlock()
+						countForTarget(t.Name, func(c *targetCounts) { c.BatchesGivenUp++ })
+					}
 				}
 			}
 		}()
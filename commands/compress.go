@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// requestBody is the payload of a CleverTap request, encoded once and gzipped with -gzip, so that retries send the
+// same bytes again
+type requestBody struct {
+	data    []byte
+	size    int
+	gzipped bool
+}
+
+func encodeRequestBody(payload interface{}) (*requestBody, error) {
+	b := &bytes.Buffer{}
+	if err := json.NewEncoder(b).Encode(payload); err != nil {
+		return nil, err
+	}
+	if !*globals.Gzip {
+		return &requestBody{data: b.Bytes(), size: b.Len()}, nil
+	}
+	z := &bytes.Buffer{}
+	w := gzip.NewWriter(z)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &requestBody{data: z.Bytes(), size: b.Len(), gzipped: true}, nil
+}
+
+// newRequest returns a POST request with the body, and counts the bytes about to be sent
+func (b *requestBody) newRequest(ctx context.Context, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b.data))
+	if err != nil {
+		return nil, err
+	}
+	if b.gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	atomic.AddInt64(&progress.bodyBytes, int64(b.size))
+	atomic.AddInt64(&progress.bodyBytesSent, int64(len(b.data)))
+	return req.WithContext(ctx), nil
+}
+
+func logBytesSentSummary() {
+	s := takeProgressSnapshot()
+	if s.bodyBytesSent == 0 {
+		return
+	}
+	if s.bodyBytesSent == s.bodyBytes {
+		logger.Printf("Bytes sent: %v", s.bodyBytesSent)
+		return
+	}
+	logger.Printf("Bytes sent: %v , before compression: %v (%.1f%%)", s.bodyBytesSent, s.bodyBytes,
+		100*float64(s.bodyBytesSent)/float64(s.bodyBytes))
+}
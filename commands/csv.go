@@ -2,19 +2,36 @@ package commands
 
 import (
 	"bytes"
-	"log"
-	"os"
+	"context"
+	"fmt"
+	"io"
 
 	"bufio"
 
-	"strings"
-
 	"github.com/ankit-arora/clevertap-data-upload/globals"
 )
 
+// csvLineInfo is a record of the csv file Source. Header is set for the first record of the file. LineNum and
+// EndLine are the 0 based physical lines it starts and ends on, Line is its text for log messages. Err is set for a
+// record that cannot be read and is skipped.
 type csvLineInfo struct {
+	Source  string
+	Header  bool
 	LineNum int
+	EndLine int
+	Fields  []string
 	Line    string
+	Err     error
+	// fileHeader is the header of Source, set once it has been processed
+	fileHeader *csvHeader
+}
+
+// lines describes the physical lines of the record for log messages
+func (l csvLineInfo) lines() string {
+	if l.EndLine > l.LineNum {
+		return fmt.Sprintf("line numbers: %v-%v", l.LineNum+1, l.EndLine+1)
+	}
+	return fmt.Sprintf("line number: %v", l.LineNum+1)
 }
 
 // ScanCRLF ...
@@ -40,47 +57,80 @@ func ScanCRLF(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-func csvLineGenerator(done chan interface{}) <-chan csvLineInfo {
+// csvLineGenerator streams the records of the csv files, one file after the other. The first record of each file
+// is its header and is always sent, the records covered by the checkpoint are not. Blank lines and the continuation
+// lines of records spanning several lines are marked done right away, so that the checkpoint only waits for the
+// line each record starts on.
+func csvLineGenerator(ctx context.Context) <-chan csvLineInfo {
 	rowStream := make(chan csvLineInfo)
 	go func() {
 		defer close(rowStream)
-		//read csv file
-		file, err := os.Open(*globals.CSVFilePath)
-		if err != nil {
-			log.Fatal(err)
-			select {
-			case <-done:
-				return
-			default:
-				done <- struct{}{}
-				return
-			}
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Split(ScanCRLF)
-		i := 0
-		for scanner.Scan() {
-			s := scanner.Text()
-			s = strings.Trim(s, " \n \r")
-			info := csvLineInfo{i, s}
-			select {
-			case <-done:
-				return
-			case rowStream <- info:
-			}
-			i++
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-			select {
-			case <-done:
-				return
-			default:
-				done <- struct{}{}
+		trackInputFiles(globals.CSVFiles)
+		for filePath := range inputPaths(ctx, globals.CSVFiles) {
+			if !readCSVFile(ctx, filePath, rowStream) {
 				return
 			}
 		}
 	}()
 	return rowStream
 }
+
+// readCSVFile sends the records of a csv file on rowStream. It returns false if the pipeline stops.
+func readCSVFile(ctx context.Context, filePath string, rowStream chan<- csvLineInfo) bool {
+	if severalInputs() {
+		logger.Printf("Reading csv file: %v", filePath)
+	}
+	file, err := openInput(ctx, filePath)
+	if err != nil {
+		fail(ctx, err)
+		return false
+	}
+	defer file.Close()
+	resumeFrom := checkpoint.resumeLine(filePath)
+	if resumeFrom > 0 {
+		logger.Printf("Resuming %v after line number: %v", filePath, resumeFrom+1)
+	}
+	input, err := decompressSingleFileInput(file, filePath)
+	if err != nil {
+		fail(ctx, err)
+		return false
+	}
+	reader := &csvReader{
+		r:             bufio.NewReader(decodeInput(input, *globals.CSVEncoding)),
+		comma:         csvRuneOption(*globals.CSVDelimiter),
+		quote:         csvRuneOption(*globals.CSVQuote),
+		comment:       csvRuneOption(*globals.CSVComment),
+		lazyQuotes:    *globals.CSVLazyQuotes,
+		maxRecordSize: *globals.CSVMaxRecordSize,
+	}
+	header := true
+	for {
+		rec, err := reader.read()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			fail(ctx, err)
+			return false
+		}
+		for l := rec.startLine + 1; l <= rec.endLine; l++ {
+			checkpoint.markDone(filePath, l)
+		}
+		if rec.fields == nil && rec.err == nil {
+			checkpoint.markDone(filePath, rec.startLine)
+			continue
+		}
+		if !header && rec.startLine <= resumeFrom {
+			//already uploaded, header is still needed for the keys
+			continue
+		}
+		info := csvLineInfo{Source: filePath, Header: header, LineNum: rec.startLine, EndLine: rec.endLine,
+			Fields: rec.fields, Line: rec.raw, Err: rec.err}
+		header = false
+		select {
+		case <-ctx.Done():
+			return false
+		case rowStream <- info:
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// csvReader reads RFC 4180 records from a stream. Quoted fields may hold delimiters, doubled quotes and line
+// breaks, so a record can span several physical lines. Lines end with \n, \r\n or \r.
+type csvReader struct {
+	r     *bufio.Reader
+	comma rune
+	// quote is 0 when fields are never quoted
+	quote rune
+	// comment starts a line that is skipped like a blank line, 0 for none
+	comment rune
+	// lazyQuotes allows quotes in unquoted fields and quotes in quoted fields that are not doubled
+	lazyQuotes bool
+	// maxRecordSize is the largest record in bytes, larger records are read to their end and reported as errors
+	maxRecordSize int
+	// line is the 0 based physical line of the next rune
+	line int
+}
+
+// csvRecord is a record of a csv file along with the physical lines it was read from. Fields is nil for a blank
+// or comment line. Err is set for a record that is malformed or too large, which should be skipped.
+type csvRecord struct {
+	fields    []string
+	raw       string
+	startLine int
+	endLine   int
+	err       error
+}
+
+const (
+	csvFieldStart = iota
+	csvUnquoted
+	csvQuoted
+	csvQuoteInQuoted
+)
+
+// readRune returns the next rune, with \r\n and \r returned as \n
+func (c *csvReader) readRune() (rune, int, error) {
+	r, size, err := c.r.ReadRune()
+	if err != nil || r != '\r' {
+		return r, size, err
+	}
+	next, nextSize, err := c.r.ReadRune()
+	if err == nil && next != '\n' {
+		c.r.UnreadRune()
+	} else if err == nil {
+		size += nextSize
+	}
+	return '\n', size, nil
+}
+
+// read returns the next record, or io.EOF once the stream is exhausted
+func (c *csvReader) read() (*csvRecord, error) {
+	rec := &csvRecord{startLine: c.line}
+	var field, raw strings.Builder
+	state := csvFieldStart
+	size := 0
+	tooLarge := false
+	var last rune
+	endField := func() {
+		if !tooLarge {
+			rec.fields = append(rec.fields, field.String())
+		}
+		field.Reset()
+	}
+	setErr := func(format string, args ...interface{}) {
+		if rec.err == nil {
+			rec.err = fmt.Errorf(format, args...)
+		}
+	}
+	for {
+		r, n, err := c.readRune()
+		if err == io.EOF {
+			if size == 0 {
+				return nil, io.EOF
+			}
+			if state == csvQuoted && !c.lazyQuotes {
+				setErr("quoted field starting at line %v is not closed", rec.startLine+1)
+			}
+			if last == '\n' {
+				//the line break ending the file does not start another line
+				c.line--
+			}
+			endField()
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += n
+		last = r
+		if c.comment != 0 && r == c.comment && size == n {
+			//comment line
+			for r != '\n' {
+				if r, _, err = c.readRune(); err != nil {
+					break
+				}
+			}
+			rec.endLine = c.line
+			c.line++
+			return rec, nil
+		}
+		if size > c.maxRecordSize && !tooLarge {
+			//keep reading to the end of the record without holding on to it
+			tooLarge = true
+			rec.fields = nil
+			setErr("record is larger than %v bytes", c.maxRecordSize)
+		}
+		if !tooLarge {
+			raw.WriteRune(r)
+		}
+		if r == '\n' && state != csvQuoted {
+			if state == csvFieldStart && len(rec.fields) == 0 && field.Len() == 0 && size == n {
+				//blank line
+				rec.endLine = c.line
+				c.line++
+				return rec, nil
+			}
+			endField()
+			break
+		}
+		if r == '\n' {
+			c.line++
+		}
+		if tooLarge {
+			//only the quoting matters to find the end of the record
+			field.Reset()
+		}
+		switch state {
+		case csvFieldStart:
+			if c.quote != 0 && r == c.quote {
+				state = csvQuoted
+				continue
+			}
+			state = csvUnquoted
+			fallthrough
+		case csvUnquoted:
+			if r == c.comma {
+				endField()
+				state = csvFieldStart
+				continue
+			}
+			if c.quote != 0 && r == c.quote && !c.lazyQuotes {
+				setErr("bare %c in unquoted field at line %v", c.quote, c.line+1)
+			}
+			field.WriteRune(r)
+		case csvQuoted:
+			if r == c.quote {
+				state = csvQuoteInQuoted
+				continue
+			}
+			field.WriteRune(r)
+		case csvQuoteInQuoted:
+			if r == c.quote {
+				field.WriteRune(r)
+				state = csvQuoted
+				continue
+			}
+			if r == c.comma {
+				endField()
+				state = csvFieldStart
+				continue
+			}
+			if !c.lazyQuotes {
+				setErr("extraneous %c in quoted field at line %v", c.quote, c.line+1)
+			}
+			field.WriteRune(c.quote)
+			field.WriteRune(r)
+			state = csvQuoted
+		}
+	}
+	rec.endLine = c.line
+	c.line++
+	rec.raw = strings.TrimRight(raw.String(), "\n")
+	if tooLarge {
+		rec.raw = substr(rec.raw, 0, 100) + "..."
+	}
+	return rec, nil
+}
+
+// csvRuneOption returns the single character of a csv option, 0 for an empty one
+func csvRuneOption(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return 0
+	}
+	return r
+}
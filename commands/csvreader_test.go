@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+type wantCSVRecord struct {
+	fields     []string
+	start, end int
+	err        bool
+}
+
+// readTestCSV reads all records of input the way readCSVFile does, with the byte order mark handled by decodeInput.
+// options, if not nil, changes the defaults of the reader.
+func readTestCSV(t *testing.T, input string, options func(c *csvReader)) []wantCSVRecord {
+	reader := &csvReader{
+		r:             bufio.NewReader(decodeInput(strings.NewReader(input), "utf-8")),
+		comma:         ',',
+		quote:         '"',
+		maxRecordSize: 1 << 20,
+	}
+	if options != nil {
+		options(reader)
+	}
+	var records []wantCSVRecord
+	for {
+		rec, err := reader.read()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, wantCSVRecord{fields: rec.fields, start: rec.startLine, end: rec.endLine,
+			err: rec.err != nil})
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		input  string
+		reader func(c *csvReader)
+		want   []wantCSVRecord
+	}{
+		{
+			name:  "plain",
+			input: "identity,name\n1,Ann\n",
+			want:  []wantCSVRecord{{fields: []string{"identity", "name"}}, {fields: []string{"1", "Ann"}, start: 1, end: 1}},
+		},
+		{
+			name:  "quoted newlines",
+			input: "identity,address\n1,\"12 Main St\nApt 4\n\"\n2,x\n",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "address"}},
+				{fields: []string{"1", "12 Main St\nApt 4\n"}, start: 1, end: 3},
+				{fields: []string{"2", "x"}, start: 4, end: 4},
+			},
+		},
+		{
+			name:  "doubled quotes",
+			input: "identity,quote\n1,\"she said \"\"hi\"\", twice\"\n",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "quote"}},
+				{fields: []string{"1", `she said "hi", twice`}, start: 1, end: 1},
+			},
+		},
+		{
+			name:  "CRLF",
+			input: "identity,name\r\n1,\"Ann\r\nLee\"\r\n2,Bob\r\n",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", "Ann\nLee"}, start: 1, end: 2},
+				{fields: []string{"2", "Bob"}, start: 3, end: 3},
+			},
+		},
+		{
+			name:  "CR",
+			input: "identity,name\r1,Ann\r",
+			want:  []wantCSVRecord{{fields: []string{"identity", "name"}}, {fields: []string{"1", "Ann"}, start: 1, end: 1}},
+		},
+		{
+			name:  "trailing field without newline",
+			input: "identity,name\n1,Ann",
+			want:  []wantCSVRecord{{fields: []string{"identity", "name"}}, {fields: []string{"1", "Ann"}, start: 1, end: 1}},
+		},
+		{
+			name:  "empty trailing field without newline",
+			input: "identity,name\n1,",
+			want:  []wantCSVRecord{{fields: []string{"identity", "name"}}, {fields: []string{"1", ""}, start: 1, end: 1}},
+		},
+		{
+			name:  "quoted trailing field without newline",
+			input: "identity,name\n1,\"Ann\nLee\"",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", "Ann\nLee"}, start: 1, end: 2},
+			},
+		},
+		{
+			name:  "byte order mark",
+			input: "\xef\xbb\xbf\"identity\",name\n1,Ann\n",
+			want:  []wantCSVRecord{{fields: []string{"identity", "name"}}, {fields: []string{"1", "Ann"}, start: 1, end: 1}},
+		},
+		{
+			name:   "blank and comment lines",
+			input:  "identity,name\n\n# note\n1,Ann\n",
+			reader: func(c *csvReader) { c.comment = '#' },
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{start: 1, end: 1},
+				{start: 2, end: 2},
+				{fields: []string{"1", "Ann"}, start: 3, end: 3},
+			},
+		},
+		{
+			name:  "unclosed quote",
+			input: "identity,name\n1,\"Ann\n2,Bob\n",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", "Ann\n2,Bob\n"}, start: 1, end: 2, err: true},
+			},
+		},
+		{
+			name:  "bare quote",
+			input: "identity,name\n1,An\"n\n",
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", "An\"n"}, start: 1, end: 1, err: true},
+			},
+		},
+		{
+			name:   "bare quote with lazy quotes",
+			input:  "identity,name\n1,An\"n\n",
+			reader: func(c *csvReader) { c.lazyQuotes = true },
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", "An\"n"}, start: 1, end: 1},
+			},
+		},
+		{
+			name:   "record too large",
+			input:  "identity,name\n1,\"" + strings.Repeat("x\n", 20) + "\"\n2,Bob\n",
+			reader: func(c *csvReader) { c.maxRecordSize = 16 },
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{start: 1, end: 21, err: true},
+				{fields: []string{"2", "Bob"}, start: 22, end: 22},
+			},
+		},
+		{
+			name:   "semicolons without quoting",
+			input:  "identity;name\n1;\"Ann\"\n",
+			reader: func(c *csvReader) { c.comma, c.quote = ';', 0 },
+			want: []wantCSVRecord{
+				{fields: []string{"identity", "name"}},
+				{fields: []string{"1", `"Ann"`}, start: 1, end: 1},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := readTestCSV(t, test.input, test.reader)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestCSVContinuationLinesCheckpoint checks that the continuation lines of a record are marked done while it is read,
+// so that the checkpoint moves past a record spanning several lines once the line it starts on is acknowledged
+func TestCSVContinuationLinesCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//lines: 0 header, 1-3 first record, 4 blank, 5 second record, 6-7 third record
+	csvPath := writeTestFile(t, dir, "in.csv", "identity,address\n1,\"a\nb\nc\"\n\n2,d\n3,\"e\nf\"\n")
+	if err := globals.Configure("upload csv", map[string]string{"id": "TEST-ACCOUNT", "p": "passcode",
+		"csv": csvPath, "checkpoint": filepath.Join(dir, "checkpoint.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := initCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { checkpoint = nil }()
+
+	rowStream := make(chan csvLineInfo)
+	go func() {
+		defer close(rowStream)
+		readCSVFile(context.Background(), csvPath, rowStream)
+	}()
+	var starts []int
+	for info := range rowStream {
+		starts = append(starts, info.LineNum)
+	}
+	if want := []int{0, 1, 5, 6}; !reflect.DeepEqual(starts, want) {
+		t.Fatalf("records start on lines %v, want %v", starts, want)
+	}
+	lastLine := func() int {
+		checkpoint.Lock()
+		defer checkpoint.Unlock()
+		if last, ok := checkpoint.lastLine[csvPath]; ok {
+			return last
+		}
+		return -1
+	}
+	for _, step := range []struct {
+		ack  int
+		want int
+	}{
+		//nothing before the header is done, the continuation and blank lines wait in pending
+		{ack: 5, want: -1},
+		{ack: 0, want: 0},
+		//the first record brings in its continuation lines, the blank line and the second record
+		{ack: 1, want: 5},
+		{ack: 6, want: 7},
+	} {
+		checkpoint.markDone(csvPath, step.ack)
+		if got := lastLine(); got != step.want {
+			t.Fatalf("after line %v is done the checkpoint is at line %v, want %v", step.ack, got, step.want)
+		}
+	}
+}
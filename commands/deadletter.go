@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+//{"error":"Event name is mandatory","code":512,"target":"staging","source":"/data/events.csv","lineNum":42,"record":{...},
+//"transformed":true}
+
+type deadLetterEntry struct {
+	Error   string      `json:"error"`
+	Code    int         `json:"code,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Source  string      `json:"source,omitempty"`
+	LineNum int         `json:"lineNum,omitempty"`
+	Record  interface{} `json:"record"`
+	// Transformed is set when the -transform rules were applied to Record, replay then sends it as it is
+	Transformed bool `json:"transformed,omitempty"`
+}
+
+// deadLetter appends records rejected by CleverTap to the dead-letter file. The file is opened lazily, on the
+// first rejected record, and entries are written unbuffered so that nothing is lost if the process dies.
+var deadLetter = struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	count   int64
+}{}
+
+// writeToDeadLetter is called for every record CleverTap rejects, so it also counts the rejection for the report
+func writeToDeadLetter(r ctRecordInfo, errMsg string, code int) {
+	reportRejected(r, errMsg)
+	if *globals.DeadLetterFilePath == "" {
+		return
+	}
+	entry := deadLetterEntry{
+		Error:       errMsg,
+		Code:        code,
+		Target:      r.Target,
+		Source:      r.Source,
+		Transformed: r.Transformed,
+		Record:      r.Record,
+	}
+	if r.Source != "" {
+		entry.LineNum = r.LineNum + 1
+	}
+	deadLetter.Lock()
+	defer deadLetter.Unlock()
+	if deadLetter.file == nil {
+		file, err := os.OpenFile(*globals.DeadLetterFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			logger.Println("Error opening dead-letter file", err)
+			return
+		}
+		logger.Printf("Writing records rejected by CleverTap to: %v", *globals.DeadLetterFilePath)
+		deadLetter.file = file
+		deadLetter.encoder = json.NewEncoder(file)
+	}
+	if err := deadLetter.encoder.Encode(entry); err != nil {
+		logger.Println("Error writing to dead-letter file", err)
+		return
+	}
+	deadLetter.count++
+}
+
+func logDeadLetterSummary() {
+	logValidationSummary()
+	logBisectSummary()
+	logBytesSentSummary()
+	logTargetSummary()
+	logFileSummary()
+	deadLetter.Lock()
+	defer deadLetter.Unlock()
+	if deadLetter.count > 0 {
+		logger.Printf("Rejected records: %v , written to: %v", deadLetter.count, *globals.DeadLetterFilePath)
+	}
+}
+
+// processUnprocessedRecords writes the records of batch that CleverTap did not process to the dead-letter file.
+// A failed response rejects the whole batch, otherwise each unprocessed entry is matched back to its batch record.
+func processUnprocessedRecords(batch []ctRecordInfo, respFromCT *CTResponse) {
+	if respFromCT.Status == "fail" {
+		for _, r := range batch {
+			writeToDeadLetter(r, respFromCT.Error, 0)
+		}
+		return
+	}
+	if len(respFromCT.Unprocessed) == 0 {
+		return
+	}
+	var index map[string]int
+	for _, u := range respFromCT.Unprocessed {
+		//{"status":"fail","code":509,"error":"Phone number not in E.164 format","record":{...}}
+		entry, ok := u.(map[string]interface{})
+		if !ok {
+			writeToDeadLetter(ctRecordInfo{Record: u, Target: batch[0].Target, Transformed: batch[0].Transformed}, "", 0)
+			continue
+		}
+		errMsg, _ := entry["error"].(string)
+		code := 0
+		if c, ok := entry["code"].(float64); ok {
+			code = int(c)
+		}
+		record, ok := entry["record"]
+		if !ok {
+			record = entry
+		}
+		if i, ok := entry["index"].(float64); ok && int(i) >= 0 && int(i) < len(batch) {
+			writeToDeadLetter(batch[int(i)], errMsg, code)
+			continue
+		}
+		if index == nil {
+			index = make(map[string]int)
+			for i, r := range batch {
+				index[canonicalJSON(r.Record)] = i
+			}
+		}
+		if i, ok := index[canonicalJSON(record)]; ok {
+			writeToDeadLetter(batch[i], errMsg, code)
+		} else {
+			writeToDeadLetter(ctRecordInfo{Record: record, Target: batch[0].Target, Transformed: batch[0].Transformed},
+				errMsg, code)
+		}
+	}
+}
+
+// canonicalJSON encodes v the way CleverTap echoes it back, so that int64 and float64 values compare equal
+func canonicalJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return string(b)
+	}
+	b, _ = json.Marshal(decoded)
+	return string(b)
+}
+
+type replayDeadLetterCommand struct {
+}
+
+func (r *replayDeadLetterCommand) Execute() error {
+	logger.Println("started")
+	p := startPipeline()
+	defer p.stop()
+	var wg sync.WaitGroup
+	stopProgress := startProgress()
+	batchAndSendToCTAPI(p.ctx, deadLetterRecordsGenerator(p.intake), &wg)
+	wg.Wait()
+	stopProgress()
+	logger.Println("done")
+	logger.Println("---------------------Summary---------------------")
+	logger.Printf("Records Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
+	return p.Err()
+}
+
+func deadLetterRecordsGenerator(ctx context.Context) <-chan ctRecordInfo {
+	recordStream := make(chan ctRecordInfo)
+	go func() {
+		defer close(recordStream)
+		file, err := os.Open(*globals.ReplayFilePath)
+		if err != nil {
+			fail(ctx, err)
+			return
+		}
+		defer file.Close()
+		input, err := decompressInput(trackInputFile(file), *globals.ReplayFilePath)
+		if err != nil {
+			fail(ctx, err)
+			return
+		}
+		scanner := bufio.NewScanner(input)
+		buf := make([]byte, 0, 64*1024)
+		scanner.Buffer(buf, 20*1024*1024)
+		scanner.Split(ScanCRLF)
+		i := 0
+		for scanner.Scan() {
+			i++
+			s := strings.Trim(scanner.Text(), " \n \r")
+			if s == "" {
+				continue
+			}
+			countRead(*globals.ReplayFilePath)
+			entry := &deadLetterEntry{}
+			if err := json.Unmarshal([]byte(s), entry); err != nil || entry.Record == nil {
+				logger.Printf("Error in processing dead-letter entry. Skipping line number: %v : %v", i, s)
+				countSkipped(*globals.ReplayFilePath, skipDeadLetterBadEntry)
+				continue
+			}
+			countConverted(1)
+			//keep the original source and line so that records rejected again still point at the input data
+			r := ctRecordInfo{Record: entry.Record, Source: entry.Source, LineNum: entry.LineNum - 1,
+				Transformed: entry.Transformed}
+			select {
+			case <-ctx.Done():
+				return
+			case recordStream <- r:
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fail(ctx, err)
+		}
+	}()
+	return recordStream
+}
@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zipMagic   = []byte("PK\x03\x04")
+)
+
+// compressedExtensions are the file extensions of the compressed formats, a file with one of them that does not
+// start with the magic bytes of its format is reported as corrupt
+var compressedExtensions = map[string]string{".gz": "gzip", ".gzip": "gzip", ".bz2": "bzip2", ".zip": "zip"}
+
+// decompressInput returns a reader of the decompressed content of r when it is gzip, bzip2 or zip compressed, and
+// r as it is otherwise. The format is detected from the magic bytes, name is the file or object name used for its
+// extension and in messages. The content is streamed, nothing is written to disk.
+func decompressInput(r io.Reader, name string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		logger.Printf("Reading %v as gzip", name)
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		logger.Printf("Reading %v as bzip2", name)
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, zipMagic):
+		logger.Printf("Reading %v as zip", name)
+		return &zipStreamReader{r: br, name: name}, nil
+	}
+	ext := path.Ext(name)
+	if globals.IsURL(name) {
+		ext = path.Ext(strings.SplitN(name, "?", 2)[0])
+	}
+	if format, ok := compressedExtensions[strings.ToLower(ext)]; ok && len(magic) > 0 {
+		return nil, fmt.Errorf("%v is not %v compressed", name, format)
+	}
+	return br, nil
+}
+
+const (
+	zipLocalHeaderSignature     = 0x04034b50
+	zipCentralHeaderSignature   = 0x02014b50
+	zipEndOfDirectorySignature  = 0x06054b50
+	zipDataDescriptorSignature  = 0x08074b50
+	zipLocalHeaderLen           = 30
+	zipFlagDataDescriptor       = 0x8
+	zipMethodStore              = 0
+	zipMethodDeflate            = 8
+	zipDataDescriptorLen        = 12
+	zipDataDescriptorWithSigLen = 16
+	// ZIP64 data descriptors have 8 byte sizes
+	zip64DataDescriptorLen        = 20
+	zip64DataDescriptorWithSigLen = 24
+	zip64ExtraID                  = 0x0001
+	zip64SizeMarker               = 0xffffffff
+)
+
+// decompressSingleFileInput is decompressInput for inputs whose files cannot be read one after the other as if
+// they were one, such as CSV files that each start with a header line. Reading a zip archive that holds more than
+// one file fails once the second file is reached, before any of it is read.
+func decompressSingleFileInput(r io.Reader, name string) (io.Reader, error) {
+	input, err := decompressInput(r, name)
+	if z, ok := input.(*zipStreamReader); ok {
+		z.singleFile = true
+	}
+	return input, err
+}
+
+// zipStreamReader reads the files of a zip archive one after the other, as if they were one file, from the local
+// file headers in front of each of them. Unlike archive/zip it does not need the central directory at the end of
+// the archive, so it works on streams such as S3 objects. Directories are skipped.
+type zipStreamReader struct {
+	r    *bufio.Reader
+	name string
+	// entry is the content of the current file, nil between files
+	entry   io.Reader
+	crc     hash.Hash32
+	wantCRC uint32
+	// descriptor is set when the sizes and CRC follow the content of the current file
+	descriptor bool
+	// zip64 is set when the current file has ZIP64 sizes, which makes its data descriptor longer
+	zip64 bool
+	// singleFile is set when the archive must hold one file only, files counts those read so far
+	singleFile bool
+	files      int
+	done       bool
+}
+
+func (z *zipStreamReader) Read(p []byte) (int, error) {
+	for {
+		if z.done {
+			return 0, io.EOF
+		}
+		if z.entry == nil {
+			if err := z.nextEntry(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := z.entry.Read(p)
+		z.crc.Write(p[:n])
+		if err == io.EOF {
+			if err := z.endEntry(); err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// nextEntry reads the local header of the next file, or sets done at the central directory
+func (z *zipStreamReader) nextEntry() error {
+	var header [zipLocalHeaderLen]byte
+	if _, err := io.ReadFull(z.r, header[:4]); err != nil {
+		if err == io.EOF {
+			//an archive cut short of its central directory still has whole files
+			z.done = true
+			return nil
+		}
+		return fmt.Errorf("zip archive %v: %v", z.name, err)
+	}
+	switch binary.LittleEndian.Uint32(header[:4]) {
+	case zipLocalHeaderSignature:
+	case zipCentralHeaderSignature, zipEndOfDirectorySignature:
+		z.done = true
+		return nil
+	default:
+		return fmt.Errorf("zip archive %v is corrupt", z.name)
+	}
+	if _, err := io.ReadFull(z.r, header[4:]); err != nil {
+		return fmt.Errorf("zip archive %v: %v", z.name, err)
+	}
+	flags := binary.LittleEndian.Uint16(header[6:8])
+	method := binary.LittleEndian.Uint16(header[8:10])
+	z.wantCRC = binary.LittleEndian.Uint32(header[14:18])
+	compressedSize := int64(binary.LittleEndian.Uint32(header[18:22]))
+	uncompressedSize := int64(binary.LittleEndian.Uint32(header[22:26]))
+	nameLen := int(binary.LittleEndian.Uint16(header[26:28]))
+	extraLen := int(binary.LittleEndian.Uint16(header[28:30]))
+	entryName := make([]byte, nameLen)
+	if _, err := io.ReadFull(z.r, entryName); err != nil {
+		return fmt.Errorf("zip archive %v: %v", z.name, err)
+	}
+	extra := make([]byte, extraLen)
+	if _, err := io.ReadFull(z.r, extra); err != nil {
+		return fmt.Errorf("zip archive %v: %v", z.name, err)
+	}
+	isDir := strings.HasSuffix(string(entryName), "/")
+	if !isDir {
+		z.files++
+		if z.singleFile && z.files > 1 {
+			return fmt.Errorf("zip archive %v holds more than one file, %s is not read. Upload the files of the "+
+				"archive one by one", z.name, entryName)
+		}
+	}
+	z.descriptor = flags&zipFlagDataDescriptor != 0
+	z.zip64 = false
+	if zip64Extra, ok := zipExtraField(extra, zip64ExtraID); ok {
+		z.zip64 = true
+		//the ZIP64 field holds the sizes that do not fit in the header, uncompressed first
+		if uncompressedSize == zip64SizeMarker {
+			if len(zip64Extra) < 8 {
+				return fmt.Errorf("zip archive %v: %s has a corrupt ZIP64 field", z.name, entryName)
+			}
+			zip64Extra = zip64Extra[8:]
+		}
+		if compressedSize == zip64SizeMarker {
+			if len(zip64Extra) < 8 {
+				return fmt.Errorf("zip archive %v: %s has a corrupt ZIP64 field", z.name, entryName)
+			}
+			compressedSize = int64(binary.LittleEndian.Uint64(zip64Extra[:8]))
+		}
+	}
+	if compressedSize == zip64SizeMarker && !z.zip64 && !z.descriptor {
+		return fmt.Errorf("zip archive %v: %s has no ZIP64 field for its size", z.name, entryName)
+	}
+	z.crc = crc32.NewIEEE()
+	var content io.Reader = z.r
+	if !z.descriptor {
+		content = io.LimitReader(z.r, compressedSize)
+	}
+	switch method {
+	case zipMethodStore:
+		if z.descriptor {
+			return fmt.Errorf("zip archive %v: %s is stored without its size, which cannot be streamed", z.name,
+				entryName)
+		}
+		z.entry = content
+	case zipMethodDeflate:
+		//flate reads no further than the end of the compressed data from a bufio.Reader
+		if z.descriptor {
+			z.entry = flate.NewReader(z.r)
+		} else {
+			z.entry = flate.NewReader(bufio.NewReader(content))
+		}
+	default:
+		return fmt.Errorf("zip archive %v: %s uses unsupported compression method %v", z.name, entryName, method)
+	}
+	if isDir {
+		logger.Printf("Skipping directory %s in zip archive %v", entryName, z.name)
+	} else {
+		logger.Printf("Reading %s from zip archive %v", entryName, z.name)
+	}
+	return nil
+}
+
+// zipExtraField returns the data of the extra field with the given id
+func zipExtraField(extra []byte, id uint16) ([]byte, bool) {
+	for len(extra) >= 4 {
+		fieldID := binary.LittleEndian.Uint16(extra[:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			return nil, false
+		}
+		if fieldID == id {
+			return extra[4 : 4+size], true
+		}
+		extra = extra[4+size:]
+	}
+	return nil, false
+}
+
+// endEntry checks the CRC of the file just read, after reading its data descriptor if it has one
+func (z *zipStreamReader) endEntry() error {
+	z.entry = nil
+	if z.descriptor {
+		descriptorLen, withSigLen := zipDataDescriptorLen, zipDataDescriptorWithSigLen
+		if z.zip64 {
+			descriptorLen, withSigLen = zip64DataDescriptorLen, zip64DataDescriptorWithSigLen
+		}
+		descriptor, err := z.r.Peek(withSigLen)
+		if err != nil && len(descriptor) < descriptorLen {
+			return fmt.Errorf("zip archive %v: data descriptor is missing", z.name)
+		}
+		if binary.LittleEndian.Uint32(descriptor[:4]) == zipDataDescriptorSignature {
+			descriptor = descriptor[4:]
+			descriptorLen = withSigLen
+		}
+		z.wantCRC = binary.LittleEndian.Uint32(descriptor[:4])
+		z.r.Discard(descriptorLen)
+	}
+	if z.crc.Sum32() != z.wantCRC {
+		return fmt.Errorf("zip archive %v: checksum mismatch", z.name)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// zip64Entry writes a local file header with a ZIP64 extra field, the content, deflated when descriptor is set, and
+// a 24 byte ZIP64 data descriptor after it when descriptor is set
+func zip64Entry(b *bytes.Buffer, name string, content []byte, descriptor bool) {
+	data := content
+	method := uint16(zipMethodStore)
+	flags := uint16(0)
+	if descriptor {
+		var deflated bytes.Buffer
+		w, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+		w.Write(content)
+		w.Close()
+		data = deflated.Bytes()
+		method = zipMethodDeflate
+		flags = zipFlagDataDescriptor
+	}
+	crc := crc32.ChecksumIEEE(content)
+	le := binary.LittleEndian
+	binary.Write(b, le, uint32(zipLocalHeaderSignature))
+	binary.Write(b, le, uint16(45))
+	binary.Write(b, le, flags)
+	binary.Write(b, le, method)
+	binary.Write(b, le, uint32(0))
+	if descriptor {
+		binary.Write(b, le, uint32(0))
+	} else {
+		binary.Write(b, le, crc)
+	}
+	binary.Write(b, le, uint32(zip64SizeMarker))
+	binary.Write(b, le, uint32(zip64SizeMarker))
+	binary.Write(b, le, uint16(len(name)))
+	binary.Write(b, le, uint16(20))
+	b.WriteString(name)
+	binary.Write(b, le, uint16(zip64ExtraID))
+	binary.Write(b, le, uint16(16))
+	if descriptor {
+		binary.Write(b, le, uint64(0))
+		binary.Write(b, le, uint64(0))
+	} else {
+		binary.Write(b, le, uint64(len(content)))
+		binary.Write(b, le, uint64(len(data)))
+	}
+	b.Write(data)
+	if descriptor {
+		binary.Write(b, le, uint32(zipDataDescriptorSignature))
+		binary.Write(b, le, crc)
+		binary.Write(b, le, uint64(len(data)))
+		binary.Write(b, le, uint64(len(content)))
+	}
+}
+
+func TestZipStreamReader(t *testing.T) {
+	first, second := testLines(100), testLines(2000)
+	want := string(first) + string(second)
+
+	var plain bytes.Buffer
+	w := zip.NewWriter(&plain)
+	for _, content := range [][]byte{first, second} {
+		f, err := w.Create("in.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(content)
+	}
+	w.Close()
+
+	var zip64 bytes.Buffer
+	zip64Entry(&zip64, "first.csv", first, false)
+	zip64Entry(&zip64, "second.csv", second, true)
+
+	var mixed bytes.Buffer
+	zip64Entry(&mixed, "first.csv", first, true)
+	zip64Entry(&mixed, "second.csv", second, false)
+
+	for _, test := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"data descriptors", plain.Bytes()},
+		{"zip64", zip64.Bytes()},
+		{"zip64 descriptor then zip64 size", mixed.Bytes()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := decompressInput(bytes.NewReader(test.archive), "in.zip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("read %v bytes, want %v", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestZipStreamReaderRejectsCorruptZip64(t *testing.T) {
+	var b bytes.Buffer
+	zip64Entry(&b, "in.csv", testLines(10), false)
+	archive := b.Bytes()
+	//shrink the ZIP64 field to hold only the uncompressed size
+	binary.LittleEndian.PutUint16(archive[zipLocalHeaderLen+len("in.csv")+2:], 8)
+	r, err := decompressInput(bytes.NewReader(archive), "in.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "corrupt ZIP64 field") {
+		t.Fatalf("got error %v, want a corrupt ZIP64 field", err)
+	}
+}
+
+func TestCSVUploadRejectsZipWithSeveralFiles(t *testing.T) {
+	var uploaded []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			D []map[string]interface{} `json:"d"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, record := range payload.D {
+			uploaded = append(uploaded, record["identity"].(string))
+		}
+		mu.Unlock()
+		writeMockResponse(w, http.StatusOK, &CTResponse{Status: "success", Processed: len(payload.D)})
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, name := range []string{"first.csv", "second.csv"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//no newline after the last line, which would run into the header of the next file
+		f.Write(bytes.TrimSuffix(testLines(5), []byte("\n")))
+	}
+	w.Close()
+	zipPath := writeTestFile(t, dir, "in.zip", b.String())
+
+	_, err = testUpload(t, server, "upload csv", map[string]string{"csv": zipPath}, nil)
+	if err == nil || !strings.Contains(err.Error(), "holds more than one file, second.csv is not read") {
+		t.Errorf("got error %v, want the second file of the archive rejected", err)
+	}
+	for _, identity := range uploaded {
+		if !strings.HasPrefix(identity, "user-") {
+			t.Errorf("uploaded a record with identity %q", identity)
+		}
+	}
+}
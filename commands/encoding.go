@@ -0,0 +1,161 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// decodeInput returns a reader of r as UTF-8, for an input in encoding. A byte order mark is removed, and for utf-8
+// and utf-16 a UTF-16 byte order mark picks the UTF-16 byte order.
+func decodeInput(r io.Reader, encoding string) io.Reader {
+	br := bufio.NewReader(r)
+	bom, _ := br.Peek(3)
+	switch strings.ToLower(encoding) {
+	case "iso-8859-1", "latin1":
+		return &singleByteReader{r: br, table: &latin1Table}
+	case "windows-1252", "cp1252":
+		return &singleByteReader{r: br, table: &windows1252Table}
+	case "utf-16le":
+		if bytes.HasPrefix(bom, utf16LEBOM) {
+			br.Discard(2)
+		}
+		return &utf16Reader{r: br}
+	case "utf-16be":
+		if bytes.HasPrefix(bom, utf16BEBOM) {
+			br.Discard(2)
+		}
+		return &utf16Reader{r: br, bigEndian: true}
+	}
+	//utf-8 or utf-16
+	switch {
+	case bytes.HasPrefix(bom, utf8BOM):
+		br.Discard(3)
+	case bytes.HasPrefix(bom, utf16LEBOM):
+		br.Discard(2)
+		return &utf16Reader{r: br}
+	case bytes.HasPrefix(bom, utf16BEBOM):
+		br.Discard(2)
+		return &utf16Reader{r: br, bigEndian: true}
+	case strings.ToLower(encoding) == "utf-16":
+		//no byte order mark, Windows tools write little endian
+		return &utf16Reader{r: br}
+	}
+	return br
+}
+
+// utf16Reader decodes UTF-16 to UTF-8. Unpaired surrogates become U+FFFD.
+type utf16Reader struct {
+	r         *bufio.Reader
+	bigEndian bool
+	buf       []byte
+	// pending is a unit read after a high surrogate that did not pair with it
+	pending    uint16
+	hasPending bool
+}
+
+func (u *utf16Reader) readUnit() (uint16, error) {
+	if u.hasPending {
+		u.hasPending = false
+		return u.pending, nil
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(u.r, b[:]); err != nil {
+		return 0, err
+	}
+	if u.bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1]), nil
+	}
+	return uint16(b[1])<<8 | uint16(b[0]), nil
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	var err error
+	for len(u.buf) < len(p) && err == nil {
+		var unit uint16
+		unit, err = u.readUnit()
+		if err != nil {
+			break
+		}
+		r := rune(unit)
+		if utf16.IsSurrogate(r) {
+			next, nextErr := u.readUnit()
+			if nextErr == nil {
+				if decoded := utf16.DecodeRune(r, rune(next)); decoded != utf8.RuneError {
+					r = decoded
+				} else {
+					u.pending, u.hasPending = next, true
+					r = utf8.RuneError
+				}
+			} else {
+				r = utf8.RuneError
+			}
+		}
+		var encoded [utf8.UTFMax]byte
+		n := utf8.EncodeRune(encoded[:], r)
+		u.buf = append(u.buf, encoded[:n]...)
+	}
+	if err == io.ErrUnexpectedEOF {
+		//odd number of bytes, the last one cannot be decoded
+		u.buf = append(u.buf, string(utf8.RuneError)...)
+		err = io.EOF
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// singleByteReader decodes a single byte encoding to UTF-8
+type singleByteReader struct {
+	r     *bufio.Reader
+	table *[256]rune
+	buf   []byte
+}
+
+func (s *singleByteReader) Read(p []byte) (int, error) {
+	var err error
+	for len(s.buf) < len(p) {
+		var b byte
+		b, err = s.r.ReadByte()
+		if err != nil {
+			break
+		}
+		var encoded [utf8.UTFMax]byte
+		n := utf8.EncodeRune(encoded[:], s.table[b])
+		s.buf = append(s.buf, encoded[:n]...)
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+var latin1Table, windows1252Table [256]rune
+
+func init() {
+	for i := range latin1Table {
+		latin1Table[i] = rune(i)
+		windows1252Table[i] = rune(i)
+	}
+	//0x80 to 0x9F, the bytes 0x81, 0x8D, 0x8F, 0x90 and 0x9D are unassigned and kept as they are
+	high := []rune{0x20AC, 0x81, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, 0x02C6, 0x2030, 0x0160, 0x2039,
+		0x0152, 0x8D, 0x017D, 0x8F, 0x90, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0x02DC, 0x2122,
+		0x0161, 0x203A, 0x0153, 0x9D, 0x017E, 0x0178}
+	for i, r := range high {
+		windows1252Table[0x80+i] = r
+	}
+}
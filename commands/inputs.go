@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// inputReader is an open input whose reads are counted for the progress line
+type inputReader struct {
+	io.Reader
+	io.Closer
+}
+
+// openInput opens an input of -csv, -json or -mixpanelEventsFile for reading: a file, standard input for -, an
+// http(s) URL or an S3 object listed by inputPaths, which are downloaded as they are read
+func openInput(ctx context.Context, path string) (io.ReadCloser, error) {
+	if path == globals.StdinPath {
+		return inputReader{Reader: &countingReader{r: os.Stdin}, Closer: os.Stdin}, nil
+	}
+	if globals.IsS3URL(path) {
+		return openS3Object(ctx, path)
+	}
+	if globals.IsURL(path) {
+		u, err := openURL(ctx, path, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if u.size > 0 {
+			atomic.AddInt64(&progress.bytesTotal, u.size)
+		}
+		return u, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return inputReader{Reader: &countingReader{r: file}, Closer: file}, nil
+}
+
+// urlReader streams the body of an http(s) URL. Requests that fail are retried with the retry policy, and a
+// download that breaks off is resumed where it stopped with a Range request.
+type urlReader struct {
+	ctx context.Context
+	// name is the input the URL is read for, in log lines
+	name string
+	url  string
+	// sign, if set, signs each request before it is sent
+	sign    func(req *http.Request) error
+	body    io.ReadCloser
+	retries *retrier
+	// size is the Content-Length of the first response, 0 if unknown
+	size int64
+	// offset is the number of bytes read so far, failedAt the offset of the last time the download broke off
+	offset   int64
+	failedAt int64
+}
+
+func openURL(ctx context.Context, name, url string, sign func(req *http.Request) error) (*urlReader, error) {
+	u := &urlReader{ctx: ctx, name: name, url: url, sign: sign, retries: newRetrier(ctx, "download of "+name)}
+	resp, err := u.get()
+	if err != nil {
+		return nil, err
+	}
+	u.size = resp.ContentLength
+	return u, nil
+}
+
+// get requests the URL from the current offset until it succeeds or the retry budget is spent
+func (u *urlReader) get() (*http.Response, error) {
+	for {
+		req, err := http.NewRequest(http.MethodGet, u.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if u.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", u.offset))
+		}
+		if u.sign != nil {
+			if err := u.sign(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(u.ctx))
+		if err == nil && resp.StatusCode < 300 {
+			if u.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
+				return nil, fmt.Errorf("download of %v broke off after %v bytes and the server cannot resume it",
+					u.name, u.offset)
+			}
+			u.body = resp.Body
+			return resp, nil
+		}
+		if err != nil {
+			if u.ctx.Err() != nil {
+				return nil, u.ctx.Err()
+			}
+			logger.Printf("Error while downloading %v: %v", u.name, err)
+		} else {
+			resp.Body.Close()
+			logger.Printf("Error while downloading %v: %v", u.name, resp.Status)
+			if !isRetryableStatus(resp.StatusCode) {
+				return nil, fmt.Errorf("download of %v: %v", u.name, resp.Status)
+			}
+		}
+		if err := u.retries.backoff(resp); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *urlReader) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	u.offset += int64(n)
+	atomic.AddInt64(&progress.bytesRead, int64(n))
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	u.body.Close()
+	if u.ctx.Err() != nil {
+		//intake is done, the download is not resumed
+		return n, u.ctx.Err()
+	}
+	logger.Printf("Download of %v broke off after %v bytes: %v", u.name, u.offset, err)
+	if u.offset > u.failedAt {
+		//the download made progress, only consecutive failures count towards giving up
+		u.retries.reset()
+	}
+	u.failedAt = u.offset
+	if err := u.retries.backoff(nil); err != nil {
+		return n, err
+	}
+	if _, err := u.get(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (u *urlReader) Close() error {
+	return u.body.Close()
+}
@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// breakingFileServer serves content, breaking the connection off after breakAfter bytes of each of the first
+// breaks responses. Range requests are answered with 206 and the rest of the content.
+type breakingFileServer struct {
+	sync.Mutex
+	content    []byte
+	breakAfter int
+	breaks     int
+	ranges     []string
+}
+
+func (s *breakingFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		s.ranges = append(s.ranges, rangeHeader)
+	}
+	breaking := s.breaks > 0
+	if breaking {
+		s.breaks--
+	}
+	s.Unlock()
+	body := s.content
+	status := http.StatusOK
+	if rangeHeader != "" {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if err != nil || offset > len(body) {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(body)-1, len(body)))
+		body = body[offset:]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if breaking && s.breakAfter < len(body) {
+		w.Write(body[:s.breakAfter])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(body)
+}
+
+// setFastRetries makes retries quick for a test, it returns a func that restores the options
+func setFastRetries() func() {
+	baseDelay, maxDelay, maxAttempts := *globals.RetryBaseDelay, *globals.RetryMaxDelay, *globals.RetryMaxAttempts
+	*globals.RetryBaseDelay, *globals.RetryMaxDelay, *globals.RetryMaxAttempts = time.Millisecond, time.Millisecond, 5
+	return func() {
+		*globals.RetryBaseDelay, *globals.RetryMaxDelay, *globals.RetryMaxAttempts = baseDelay, maxDelay, maxAttempts
+	}
+}
+
+func testLines(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString("identity,name\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "user-%d,name %d\n", i, i)
+	}
+	return b.Bytes()
+}
+
+func TestURLInputResumesBrokenDownloads(t *testing.T) {
+	defer setFastRetries()()
+	files := &breakingFileServer{content: testLines(5000), breakAfter: 20000, breaks: 3}
+	server := httptest.NewServer(files)
+	defer server.Close()
+
+	input, err := openInput(context.Background(), server.URL+"/in.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	got, err := ioutil.ReadAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, files.content) {
+		t.Fatalf("read %v bytes, want the %v bytes served", len(got), len(files.content))
+	}
+	want := []string{"bytes=20000-", "bytes=40000-", "bytes=60000-"}
+	if strings.Join(files.ranges, " ") != strings.Join(want, " ") {
+		t.Errorf("range requests %v, want %v", files.ranges, want)
+	}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(got)), "\n") {
+		if seen[line] {
+			t.Fatalf("line %q read twice", line)
+		}
+		seen[line] = true
+	}
+}
+
+func TestURLInputFailsWithoutRangeSupport(t *testing.T) {
+	defer setFastRetries()()
+	content := testLines(1000)
+	broken := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//ignores Range and sends the whole content again
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if !broken {
+			broken = true
+			w.Write(content[:100])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	input, err := openInput(context.Background(), server.URL+"/in.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	if _, err := ioutil.ReadAll(input); err == nil || !strings.Contains(err.Error(), "cannot resume") {
+		t.Fatalf("got error %v, want a download that cannot be resumed", err)
+	}
+}
+
+func TestURLInputStopsWithoutRetryWhenCancelled(t *testing.T) {
+	defer setFastRetries()()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("identity,name\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	input, err := openInput(ctx, server.URL+"/in.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	Summary.Lock()
+	retries := Summary.retries
+	Summary.Unlock()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = ioutil.ReadAll(input)
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	Summary.Lock()
+	defer Summary.Unlock()
+	if Summary.retries != retries {
+		t.Errorf("download was retried %v times after it was cancelled", Summary.retries-retries)
+	}
+}
+
+func TestResumeRejectsInputsThatCannotBeReadAgain(t *testing.T) {
+	for _, input := range []string{"-", "https://example.com/export.csv", "/data/in.csv\nhttp://example.com/b.csv"} {
+		err := globals.Configure("upload csv", map[string]string{"id": "TEST-ACCOUNT", "p": "passcode",
+			"csv": input, "checkpoint": "/tmp/in.checkpoint", "resume": "true"})
+		if err == nil {
+			t.Errorf("resuming %q was accepted", input)
+		}
+	}
+	if err := globals.Configure("upload csv", map[string]string{"id": "TEST-ACCOUNT", "p": "passcode", "csv": "-",
+		"checkpoint": "/tmp/in.checkpoint"}); err != nil {
+		t.Errorf("checkpoint for standard input without resuming: %v", err)
+	}
+}
+
+func TestS3ListingIsRetried(t *testing.T) {
+	content := testLines(5)
+	var listings int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == uploadPath:
+			mockUploadHandler(w, r)
+		case r.URL.Path == "/exports" && r.URL.Query().Get("list-type") == "2":
+			//the first listings are throttled
+			if atomic.AddInt64(&listings, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+				return
+			}
+			fmt.Fprintf(w, `<ListBucketResult><Name>exports</Name><Prefix>day/</Prefix><KeyCount>1</KeyCount>`+
+				`<IsTruncated>false</IsTruncated><Contents><Key>day/in.csv</Key><Size>%v</Size></Contents>`+
+				`</ListBucketResult>`, len(content))
+		case r.URL.Path == "/exports/day/in.csv":
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var restoreRetries func()
+	r, err := testUpload(t, server, "upload csv", map[string]string{"csv": "s3://exports/day/",
+		"s3Endpoint": server.URL, "awsAccessKeyID": "key", "awsSecretAccessKey": "secret"},
+		func() { restoreRetries = setFastRetries() })
+	restoreRetries()
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if listings != 3 {
+		t.Errorf("listed %v times, want 3", listings)
+	}
+	if c := r.Files["s3://exports/day/in.csv"]; c == nil || c.Processed != 5 {
+		t.Errorf("file counts %+v, want 5 records processed", c)
+	}
+}
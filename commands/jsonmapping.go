@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// lookupPath returns the value at a path of -jsonMapping in a document decoded with UseNumber, and false if a
+// field or array element of the path is missing
+func lookupPath(doc interface{}, path string) (interface{}, bool) {
+	value := doc
+	for _, field := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[field]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// jsonString returns a json value the way it would be written in a csv file: strings as they are, numbers and
+// booleans as json has them, objects and arrays as json text and null as empty
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func jsonStrings(values []interface{}) []string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = jsonString(v)
+	}
+	return s
+}
+
+// jsonValue returns a json value for a record, with numbers as int64 or float64
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = jsonValue(item)
+		}
+		return values
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[key] = jsonValue(item)
+		}
+		return values
+	}
+	return value
+}
+
+// mapJSONRecord picks the fields of a record out of a json document with -jsonMapping and converts them the way the
+// columns of a csv row are, with -schema. It returns the reason the document is skipped, or an empty reason for a
+// valid record.
+func mapJSONRecord(doc interface{}, line string) (interface{}, string) {
+	spec := globals.JSONMapping
+	recType := *globals.Type
+	if spec.Type != "" {
+		value, _ := lookupPath(doc, spec.Type)
+		if t := jsonString(value); t != "" {
+			if t != "profile" && t != "event" {
+				logger.Printf("Record type %v should be profile or event", t)
+				return nil, skipBadRecordType
+			}
+			recType = t
+		}
+	}
+	evtName := ""
+	if recType == "event" {
+		evtName = *globals.EvtName
+		if spec.EvtName != "" {
+			value, _ := lookupPath(doc, spec.EvtName)
+			if name := jsonString(value); name != "" {
+				evtName = name
+			}
+		}
+		if evtName == "" {
+			logger.Println("Event name is missing.")
+			return nil, skipMissingEventName
+		}
+	}
+
+	header := &csvHeader{}
+	var vals []string
+	var raw []interface{}
+	add := func(key string, value interface{}) {
+		header.keys = append(header.keys, key)
+		vals = append(vals, jsonString(value))
+		raw = append(raw, jsonValue(value))
+	}
+	//only the identities a document has are mapped, a record needs one of them
+	for _, identity := range []struct{ key, path string }{{"identity", spec.Identity}, {"objectId", spec.ObjectID},
+		{"FBID", spec.FBID}, {"GPID", spec.GPID}} {
+		if identity.path == "" {
+			continue
+		}
+		if value, _ := lookupPath(doc, identity.path); jsonString(value) != "" {
+			add(identity.key, value)
+		}
+	}
+	if len(header.keys) == 0 {
+		logger.Println("Identity field is missing.")
+		return nil, skipMissingIdentity
+	}
+	if spec.TS != "" {
+		value, _ := lookupPath(doc, spec.TS)
+		add("ts", value)
+		header.tsExists = true
+	}
+
+	properties := make(map[string]interface{})
+	for _, path := range spec.PropertiesFrom {
+		value, _ := lookupPath(doc, path)
+		fields, _ := value.(map[string]interface{})
+		for name, v := range fields {
+			if isIdentity(name) || name == "ts" || name == "evtName" || name == "type" {
+				continue
+			}
+			properties[name] = v
+		}
+	}
+	for name, path := range spec.Properties {
+		if value, ok := lookupPath(doc, path); ok {
+			properties[name] = value
+		}
+	}
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name, properties[name])
+	}
+	return convertRow(header, vals, raw, recType, evtName, line)
+}
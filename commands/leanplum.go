@@ -2,10 +2,12 @@ package commands
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -79,8 +81,8 @@ type leanplumRecordInfo struct {
 	PriorEvents           int64                  `json:"priorEvents,omitempty"`
 	SystemName            string                 `json:"systemName,omitempty"`
 	SystemVersion         string                 `json:"systemVersion,omitempty"`
-	PriorStates           int64                  `json:"priorStates, omitempty"`
-	Time                  float64                `json:"time, omitempty"`
+	PriorStates           int64                  `json:"priorStates,omitempty"`
+	Time                  float64                `json:"time,omitempty"`
 	DeviceId              string                 `json:"deviceId,omitempty"`
 	FirstRun              float64                `json:"firstRun,omitempty"`
 	SourcePublisherId     string                 `json:"sourcePublisherId,omitempty"`
@@ -170,7 +172,7 @@ func (l *leanplumRecordInfo) getObjectID() string {
 			}
 		} else {
 			if ok && systemName != "" {
-				log.Printf("Unknown system name: %v", systemName)
+				logger.Printf("Unknown system name: %v", systemName)
 			}
 			adID, ok = l.UserAttributes["IDFA"]
 			if ok && (systemName == "iOS" || systemName == "iPhone OS") {
@@ -180,7 +182,7 @@ func (l *leanplumRecordInfo) getObjectID() string {
 				}
 			} else {
 				if ok && systemName != "" {
-					log.Printf("Unknown system name: %v", systemName)
+					logger.Printf("Unknown system name: %v", systemName)
 				}
 			}
 		}
@@ -302,8 +304,8 @@ var (
 	leanplumExportEP   = "https://www.leanplum.com/api"
 )
 
-func (u *uploadRecordsFromLeanplum) Execute() {
-	log.Println("started")
+// initLeanplumSettings sets the S3 and Leanplum settings shared by the export and the load from the options
+func initLeanplumSettings() {
 	startDate = *globals.StartDate
 	endDate = *globals.EndDate
 	s3AccessId = *globals.AWSAccessKeyID
@@ -322,22 +324,32 @@ func (u *uploadRecordsFromLeanplum) Execute() {
 	if *globals.LeanplumAPIEndpoint != "" {
 		leanplumExportEP = *globals.LeanplumAPIEndpoint
 	}
-	done := make(chan interface{})
+}
+
+func (u *uploadRecordsFromLeanplum) Execute() error {
+	logger.Println("started")
+	initLeanplumSettings()
+	p := startPipeline()
+	defer p.stop()
 	if *globals.ImportService == "leanplumToS3" || *globals.ImportService == "leanplumToS3Throttled" {
+		//no records flow through the upload pipeline, the report only covers the requests and their retries
+		progress.start = time.Now()
 		lpAppID = *globals.LeanplumAppID
 		lpClientKey = *globals.LeanplumClientKey
-		log.Printf("Fetching data from Leanplum for start date: %v and end date: %v\n", startDate, endDate)
-		log.Printf("Uploading it to S3 bucket: %v with S3 object prefix: %v\n", s3BucketName, s3ObjectPrefix)
-		log.Printf("Generated file names will be in: %v", generatedFilesFile)
+		logger.Printf("Fetching data from Leanplum for start date: %v and end date: %v\n", startDate, endDate)
+		logger.Printf("Uploading it to S3 bucket: %v with S3 object prefix: %v\n", s3BucketName, s3ObjectPrefix)
+		logger.Printf("Generated file names will be in: %v", generatedFilesFile)
 		if *globals.ImportService == "leanplumToS3" {
-			leanplumRecordsToS3Generator(done)
+			leanplumRecordsToS3Generator(p.intake)
 		} else {
-			leanplumRecordsToS3GeneratorThrottled(done)
+			leanplumRecordsToS3GeneratorThrottled(p.intake)
 		}
-		log.Printf("Fetched data from Leanplum for start date: %v and end date: %v\n", startDate, endDate)
-		log.Printf("Uploaded it to S3 bucket: %v with S3 object prefix: %v\n", s3BucketName, s3ObjectPrefix)
-		log.Printf("Generated file names in: %v", generatedFilesFile)
-		log.Println("done")
+		logger.Printf("Fetched data from Leanplum for start date: %v and end date: %v\n", startDate, endDate)
+		logger.Printf("Uploaded it to S3 bucket: %v with S3 object prefix: %v\n", s3BucketName, s3ObjectPrefix)
+		logger.Printf("Generated file names in: %v", generatedFilesFile)
+		logger.Println("done")
+		logRetrySummary()
+		writeReport()
 	} else {
 		if *globals.ImportService == "leanplumS3ToCT" {
 			//batch size of 400 for leanplum data
@@ -345,38 +357,71 @@ func (u *uploadRecordsFromLeanplum) Execute() {
 			var wg sync.WaitGroup
 			apiConcurrency = 9
 			sdkConcurrency = 500
-			apiUploadRecordStream, iosSDKRecordStream, androidSDKRecordStream := leanplumRecordsFromS3Generator(done)
-			batchAndSendToCTAPI(done, processAPIRecordForUpload(done, apiUploadRecordStream), &wg)
-			sendToCTSDK("https://wzrkt.com/a1?os=iOS", done, processSDKRecordForUpload(done, iosSDKRecordStream), &wg)
-			sendToCTSDK("https://wzrkt.com/a1?os=android", done, processSDKRecordForUpload(done, androidSDKRecordStream), &wg)
+			stopProgress := startProgress()
+			apiUploadRecordStream, iosSDKRecordStream, androidSDKRecordStream := leanplumRecordsFromS3Generator(p.intake)
+			batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, apiUploadRecordStream), &wg)
+			sendToCTSDK(p.ctx, "iOS", processSDKRecordForUpload(p.ctx, iosSDKRecordStream), &wg)
+			sendToCTSDK(p.ctx, "android", processSDKRecordForUpload(p.ctx, androidSDKRecordStream), &wg)
 			wg.Wait()
-			log.Println("done")
-			log.Printf("Data Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+			stopProgress()
+			logger.Println("done")
+			logger.Printf("Data Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+			logDeadLetterSummary()
+			logRetrySummary()
+			writeReport()
 		}
 	}
+	return p.Err()
 }
 
-func getJobID(startDate, endDate string) string {
-	client := &http.Client{Timeout: time.Minute * 1}
+func getJobID(ctx context.Context, startDate, endDate string) (string, error) {
 	endpoint := leanplumExportEP + "?appId=" + lpAppID + "&clientKey=" + lpClientKey +
 		"&apiVersion=1.0.6&action=exportData&startDate=" + startDate + "&endDate=" + endDate +
 		"&s3BucketName=" + s3BucketName + "&s3AccessId=" + s3AccessId + "&s3AccessKey=" +
 		s3SecretKey + "&s3ObjectPrefix=" + s3ObjectPrefix
 
-	req, err := http.NewRequest("POST", endpoint, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal(err)
-	}
-	//fmt.Printf("Job status code: %v\n", resp.StatusCode)
-	d := json.NewDecoder(resp.Body)
-	j := &jobResponse{}
-	err = d.Decode(j)
+	j, err := postToLeanplum(ctx, endpoint, "Leanplum export request")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	jobID := j.Res[0].JobID
-	return jobID
+	return jobID, nil
+}
+
+func postToLeanplum(ctx context.Context, endpoint, what string) (*jobResponse, error) {
+	client := &http.Client{Timeout: time.Minute * 1}
+	retries := newRetrier(ctx, what)
+	for {
+		req, err := http.NewRequest("POST", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			//fmt.Printf("Job status code: %v\n", resp.StatusCode)
+			d := json.NewDecoder(resp.Body)
+			j := &jobResponse{}
+			err = d.Decode(j)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			if len(j.Res) == 0 {
+				return nil, lpCredError
+			}
+			return j, nil
+		}
+		if err != nil {
+			logger.Println("Error while calling Leanplum: ", err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			logger.Println("response body: ", string(body))
+			resp.Body.Close()
+		}
+		if err := retries.backoff(resp); err != nil {
+			return nil, err
+		}
+	}
 }
 
 type s3Line struct {
@@ -401,10 +446,10 @@ func getLinesFromS3File(scanner *bufio.Scanner) <-chan s3Line {
 func putLinesFromS3InStream(s3LineChannel <-chan s3Line,
 	leanplumAPIUploadRecordStream chan<- apiUploadRecordInfo,
 	leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream chan<- sdkUploadRecordInfo,
-	done chan interface{}, processedLineCount *int) (error, bool) {
+	ctx context.Context, processedLineCount *int) (error, bool) {
 	var scanErr error = nil
 	i := 0
-	log.Printf("Processed Count for file: %v", *processedLineCount)
+	logger.Printf("Processed Count for file: %v", *processedLineCount)
 	for {
 		t := time.NewTimer(30 * time.Second)
 		select {
@@ -426,20 +471,20 @@ func putLinesFromS3InStream(s3LineChannel <-chan s3Line,
 				if jsonParseError == nil {
 					//json parsed correctly ignore line otherwise
 					select {
-					case <-done:
+					case <-ctx.Done():
 						return nil, false
 					case leanplumAPIUploadRecordStream <- info:
 					}
 					if info.SystemName == "iOS" || info.SystemName == "iPhone OS" {
 						select {
-						case <-done:
+						case <-ctx.Done():
 							return nil, false
 						case leanplumSDKIOSRecordStream <- info:
 						}
 					}
 					if info.SystemName == "Android OS" {
 						select {
-						case <-done:
+						case <-ctx.Done():
 							return nil, false
 						case leanplumSDKAndroidRecordStream <- info:
 						}
@@ -459,7 +504,7 @@ func putLinesFromS3InStream(s3LineChannel <-chan s3Line,
 }
 
 func processFile(contentKey string, leanplumAPIUploadRecordStream chan<- apiUploadRecordInfo,
-	leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream chan<- sdkUploadRecordInfo, done chan interface{}) bool {
+	leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream chan<- sdkUploadRecordInfo, ctx context.Context) bool {
 
 	creds := credentials.NewStaticCredentials(s3AccessId, s3SecretKey, "")
 
@@ -467,27 +512,30 @@ func processFile(contentKey string, leanplumAPIUploadRecordStream chan<- apiUplo
 
 	processedLineCount := 0
 
+	retries := newRetrier(ctx, "Leanplum S3 download of "+contentKey)
 	for {
 		req, body, err := buildRequest("s3", s3RegionName, s3BucketName,
 			contentKey, "")
-		for err != nil {
-			log.Printf("Error while building S3 request for %v: %v\n ", contentKey, err)
-			log.Println("Retrying after 5 seconds")
-			time.Sleep(5 * time.Second)
-			req, body, err = buildRequest("s3", s3RegionName, s3BucketName,
-				contentKey, "")
+		if err != nil {
+			fail(ctx, fmt.Errorf("error while building S3 request for %v: %v", contentKey, err))
+			return false
 		}
 		signer.Sign(req, body, "s3", s3RegionName, time.Now())
 		client := &http.Client{Timeout: time.Minute * 240}
-		resp, err := client.Do(req)
+		resp, err := client.Do(req.WithContext(ctx))
+		var input io.Reader
 		if err == nil && resp.StatusCode < 300 {
-			scanner := bufio.NewScanner(resp.Body)
+			input, err = decompressInput(resp.Body, contentKey)
+		}
+		if err == nil && resp.StatusCode < 300 {
+			scanner := bufio.NewScanner(input)
 			buf := make([]byte, 0, 64*1024)
 			scanner.Buffer(buf, 20*1024*1024)
 			scanner.Split(ScanCRLF)
 			s3LineChannel := getLinesFromS3File(scanner)
+			countBefore := processedLineCount
 			scanErr, shouldContinue := putLinesFromS3InStream(s3LineChannel,
-				leanplumAPIUploadRecordStream, leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream, done,
+				leanplumAPIUploadRecordStream, leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream, ctx,
 				&processedLineCount)
 
 			if !shouldContinue {
@@ -495,12 +543,18 @@ func processFile(contentKey string, leanplumAPIUploadRecordStream chan<- apiUplo
 			}
 
 			if scanErr != nil {
-				log.Printf("Error while getting data from S3 for %v: %v : %v\n ", contentKey, scanErr, processedLineCount)
-				log.Println("Retrying after 5 seconds")
+				logger.Printf("Error while getting data from S3 for %v: %v : %v\n ", contentKey, scanErr, processedLineCount)
 				if resp != nil {
 					resp.Body.Close()
 				}
-				time.Sleep(5 * time.Second)
+				if processedLineCount > countBefore {
+					//the download made progress, only consecutive failures count towards giving up
+					retries.reset()
+				}
+				if err := retries.backoff(nil); err != nil {
+					fail(ctx, err)
+					return false
+				}
 				continue
 			}
 
@@ -508,23 +562,24 @@ func processFile(contentKey string, leanplumAPIUploadRecordStream chan<- apiUplo
 			break
 		}
 		if err != nil {
-			log.Println("Error while fetching events data from S3 ", err)
-			log.Printf("retrying after 5 seconds for contentKey: %v", contentKey)
+			logger.Println("Error while fetching events data from S3 ", err)
 		} else {
 			body, _ := ioutil.ReadAll(resp.Body)
-			log.Println("response body: ", string(body))
-			log.Printf("retrying after 5 seconds for contentKey: %v", contentKey)
+			logger.Println("response body: ", string(body))
 		}
 		if resp != nil {
 			resp.Body.Close()
 		}
-		time.Sleep(5 * time.Second)
+		if err := retries.backoff(resp); err != nil {
+			fail(ctx, err)
+			return false
+		}
 	}
 	return true
 }
 
 //getting data from S3
-func leanplumRecordsFromS3Generator(done chan interface{}) (<-chan apiUploadRecordInfo, <-chan sdkUploadRecordInfo, <-chan sdkUploadRecordInfo) {
+func leanplumRecordsFromS3Generator(ctx context.Context) (<-chan apiUploadRecordInfo, <-chan sdkUploadRecordInfo, <-chan sdkUploadRecordInfo) {
 	leanplumAPIUploadRecordStream := make(chan apiUploadRecordInfo)
 	leanplumSDKIOSRecordStream := make(chan sdkUploadRecordInfo)
 	leanplumSDKAndroidRecordStream := make(chan sdkUploadRecordInfo)
@@ -537,7 +592,7 @@ func leanplumRecordsFromS3Generator(done chan interface{}) (<-chan apiUploadReco
 
 		file, err := os.Open(generatedFilesFile)
 		if err != nil {
-			log.Fatal("Error reading file: ", err)
+			fail(ctx, fmt.Errorf("error reading file: %v", err))
 			return
 		}
 		defer file.Close()
@@ -548,15 +603,15 @@ func leanplumRecordsFromS3Generator(done chan interface{}) (<-chan apiUploadReco
 		for scanner.Scan() {
 			contentKey := scanner.Text()
 			contentKey = strings.Trim(contentKey, " \n \r")
-			log.Println("Processing data from: " + contentKey)
+			logger.Println("Processing data from: " + contentKey)
 			success := processFile(contentKey, leanplumAPIUploadRecordStream, leanplumSDKIOSRecordStream,
-				leanplumSDKAndroidRecordStream, done)
+				leanplumSDKAndroidRecordStream, ctx)
 			if !success {
 				return
 			}
 		}
 		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+			fail(ctx, err)
 		}
 	}()
 	return leanplumAPIUploadRecordStream, leanplumSDKIOSRecordStream, leanplumSDKAndroidRecordStream
@@ -564,28 +619,23 @@ func leanplumRecordsFromS3Generator(done chan interface{}) (<-chan apiUploadReco
 
 var lpCredError = errors.New("Error: Please check your LeanPlum or S3 credentials")
 
-func pushDataForStartEndDate(startDate, endDate string) ([]s3CopyEntryInfo, error) {
+func pushDataForStartEndDate(ctx context.Context, startDate, endDate string) ([]s3CopyEntryInfo, error) {
 	var files []s3CopyEntryInfo
-	jobID := getJobID(startDate, endDate)
+	jobID, err := getJobID(ctx, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
 	if jobID == "" {
 		return nil, lpCredError
 	}
-	log.Printf("job id: %v", jobID)
+	logger.Printf("job id: %v", jobID)
 	//http://www.leanplum.com/api?appId=appID&clientKey=clientKey&apiVersion=1.0.6&action=getExportResults&jobId=jobID
 	for {
-		client := &http.Client{Timeout: time.Minute * 1}
 		endpoint := leanplumExportEP + "?appId=" + lpAppID + "&clientKey=" + lpClientKey + "&apiVersion=1.0.6&action=getExportResults&jobId=" + jobID
 		//log.Printf("Fetching profiles data from Leanplum for page: %v", page)
-		req, err := http.NewRequest("POST", endpoint, nil)
-		resp, err := client.Do(req)
+		j, err := postToLeanplum(ctx, endpoint, "Leanplum export results request")
 		if err != nil {
-			log.Fatal(err)
-		}
-		d := json.NewDecoder(resp.Body)
-		j := &jobResponse{}
-		err = d.Decode(j)
-		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		state := j.Res[0].State
 		if state == "FINISHED" {
@@ -595,14 +645,18 @@ func pushDataForStartEndDate(startDate, endDate string) ([]s3CopyEntryInfo, erro
 		if state == "FAILED" {
 			return nil, lpCredError
 		}
-		log.Printf("Waiting 2 minutes for files to be ready for jobID: %v , state: %v", jobID, state)
-		time.Sleep(2 * time.Minute)
+		logger.Printf("Waiting 2 minutes for files to be ready for jobID: %v , state: %v", jobID, state)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Minute):
+		}
 	}
 	return files, nil
 }
 
 //saving to S3 Throttled
-func leanplumRecordsToS3GeneratorThrottled(done chan interface{}) <-chan apiUploadRecordInfo {
+func leanplumRecordsToS3GeneratorThrottled(ctx context.Context) <-chan apiUploadRecordInfo {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	leanplumRecordStream := make(chan apiUploadRecordInfo)
@@ -615,14 +669,17 @@ func leanplumRecordsToS3GeneratorThrottled(done chan interface{}) <-chan apiUplo
 			//delete file since it exists
 			err = os.Remove(generatedFilesFile)
 			if err != nil {
-				log.Fatal(err)
+				fail(ctx, err)
+				return
 			}
 		}
 		file, err := os.OpenFile(generatedFilesFile,
 			os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
-			log.Fatal(err)
+			fail(ctx, err)
+			return
 		}
+		defer file.Close()
 
 		//add five days
 		sDate := startDate
@@ -638,12 +695,13 @@ func leanplumRecordsToS3GeneratorThrottled(done chan interface{}) <-chan apiUplo
 				eDate = endDate
 			}
 
-			log.Printf("Getting data for dates %v to %v", sDate, eDate)
+			logger.Printf("Getting data for dates %v to %v", sDate, eDate)
 
-			files, err := pushDataForStartEndDate(sDate, eDate)
+			files, err := pushDataForStartEndDate(ctx, sDate, eDate)
 
 			if err != nil {
-				log.Fatal(err)
+				fail(ctx, err)
+				return
 			}
 
 			if files != nil {
@@ -671,7 +729,7 @@ func leanplumRecordsToS3GeneratorThrottled(done chan interface{}) <-chan apiUplo
 }
 
 //saving to S3
-func leanplumRecordsToS3Generator(done chan interface{}) <-chan apiUploadRecordInfo {
+func leanplumRecordsToS3Generator(ctx context.Context) <-chan apiUploadRecordInfo {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	leanplumRecordStream := make(chan apiUploadRecordInfo)
@@ -684,18 +742,22 @@ func leanplumRecordsToS3Generator(done chan interface{}) <-chan apiUploadRecordI
 			//delete file since it exists
 			err = os.Remove(generatedFilesFile)
 			if err != nil {
-				log.Fatal(err)
+				fail(ctx, err)
+				return
 			}
 		}
 		file, err := os.OpenFile(generatedFilesFile,
 			os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
-			log.Fatal(err)
+			fail(ctx, err)
+			return
 		}
+		defer file.Close()
 
-		files, err := pushDataForStartEndDate(startDate, endDate)
+		files, err := pushDataForStartEndDate(ctx, startDate, endDate)
 		if err != nil {
-			log.Fatal(err)
+			fail(ctx, err)
+			return
 		}
 		if files != nil {
 			for i := 0; i < len(files); i++ {
@@ -0,0 +1,413 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/ctupload"
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// commandSource runs the record generators of a subcommand as a ctupload.Source
+type commandSource struct {
+	open func(ctx context.Context) (*ctupload.Streams, error)
+}
+
+// Open runs the generators in a pipeline of their own, so that a fatal error in one of them stops the source and
+// is returned by Streams.Err instead of ending the process. Progress is reported while the source is open. The
+// pipeline is stopped and the checkpoint saved when Run returns.
+func (s *commandSource) Open(ctx context.Context) (*ctupload.Streams, error) {
+	p := newPipeline(ctx)
+	streams, err := s.open(p.ctx)
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	stopProgress := startProgress()
+	streams.Err = p.Err
+	streams.Close = func() {
+		stopProgress()
+		p.stop()
+		checkpoint.flush()
+	}
+	return streams, nil
+}
+
+// hostOptions are the options of the run subcommand that the source options do not set. Configuring the subcommand
+// of a source resets them, they are set back right after so that they hold for the whole run.
+var hostOptions globals.SavedOptions
+
+// registerCommandSource registers a source that configures the options of subcommand before opening
+func registerCommandSource(name, subcommand string, open func(ctx context.Context) (*ctupload.Streams, error)) {
+	ctupload.RegisterSource(name, func(cfg ctupload.Config) (ctupload.Source, error) {
+		startLibraryRun(cfg)
+		if err := globals.Configure(subcommand, cfg.Options); err != nil {
+			return nil, err
+		}
+		hostOptions.Restore()
+		return &commandSource{open: open}, nil
+	})
+}
+
+type sdkRecord struct {
+	sdkUploadRecordInfo
+}
+
+// ConvertToCTSDKFormat converts the record and applies the -transform rules to the request
+func (r sdkRecord) ConvertToCTSDKFormat() ([]map[string]interface{}, error) {
+	request, err := r.convertToCTSDKFormat()
+	if err != nil || request == nil {
+		return request, err
+	}
+	if !transformSDKRequest(request) {
+		logger.Println("Skipping SDK request left without a device id by -transform")
+		countSkipped("", skipMissingDeviceID)
+		return nil, nil
+	}
+	return request, nil
+}
+
+func sdkRecords(ctx context.Context, recordStream <-chan sdkUploadRecordInfo) <-chan ctupload.SDKRecord {
+	out := make(chan ctupload.SDKRecord)
+	go func() {
+		defer close(out)
+		for r := range recordStream {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- sdkRecord{r}:
+			}
+		}
+	}()
+	return out
+}
+
+// convertedRecords hands the converted records of a command to ctupload, after applying the -transform rules once
+// for all targets and checking them with -validate, as the subcommand would before batching
+func convertedRecords(ctx context.Context, recordStream <-chan ctRecordInfo) <-chan ctupload.APIRecord {
+	out := make(chan ctupload.APIRecord)
+	recordStream = validateRecords(ctx, transformRecords(ctx, recordStream))
+	go func() {
+		defer close(out)
+		for r := range recordStream {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- ctupload.Record{Data: r.Record, Source: r.Source, LineNum: r.LineNum, Transformed: r.Transformed}:
+			}
+		}
+	}()
+	return out
+}
+
+func init() {
+	registerCommandSource("csv", "upload csv", func(ctx context.Context) (*ctupload.Streams, error) {
+		if *globals.CheckpointFilePath != "" {
+			if err := initCheckpoint(); err != nil {
+				return nil, fmt.Errorf("error reading checkpoint file: %v", err)
+			}
+		}
+		return &ctupload.Streams{API: convertedRecords(ctx, processCSVLineForUpload(ctx, csvLineGenerator(ctx)))}, nil
+	})
+	registerCommandSource("json", "upload json", func(ctx context.Context) (*ctupload.Streams, error) {
+		if *globals.CheckpointFilePath != "" {
+			if err := initCheckpoint(); err != nil {
+				return nil, fmt.Errorf("error reading checkpoint file: %v", err)
+			}
+		}
+		return &ctupload.Streams{API: convertedRecords(ctx, jsonLineGenerator(ctx))}, nil
+	})
+	registerCommandSource("mixpanel-events", "import mixpanel-events", func(ctx context.Context) (*ctupload.Streams, error) {
+		if len(globals.MPEventsFilePaths) > 0 {
+			return &ctupload.Streams{API: convertedRecords(ctx, processAPIRecordForUpload(ctx,
+				mixpanelEventRecordsFromFilesGenerator(ctx)))}, nil
+		}
+		return &ctupload.Streams{API: convertedRecords(ctx, processAPIRecordForUpload(ctx,
+			mixpanelEventRecordsGenerator(ctx)))}, nil
+	})
+	registerCommandSource("mixpanel-profiles", "import mixpanel-profiles", func(ctx context.Context) (*ctupload.Streams, error) {
+		return &ctupload.Streams{API: convertedRecords(ctx, processAPIRecordForUpload(ctx,
+			mixpanelProfileRecordsGenerator(ctx)))}, nil
+	})
+	registerCommandSource("mparticle", "import mparticle", func(ctx context.Context) (*ctupload.Streams, error) {
+		if *globals.StartDate != "" {
+			return &ctupload.Streams{API: convertedRecords(ctx, processAPIRecordForUpload(ctx,
+				mparticleEventRecordsGenerator(ctx, mparticleStartEndDateS3ObjectsGenerator(ctx))))}, nil
+		}
+		return &ctupload.Streams{API: convertedRecords(ctx, processAPIRecordForUpload(ctx,
+			mparticleEventRecordsGenerator(ctx, mparticleAllS3ObjectsGenerator(ctx))))}, nil
+	})
+	registerCommandSource("replay", "replay", func(ctx context.Context) (*ctupload.Streams, error) {
+		return &ctupload.Streams{API: convertedRecords(ctx, deadLetterRecordsGenerator(ctx))}, nil
+	})
+	registerCommandSource("leanplum-load", "leanplum load", func(ctx context.Context) (*ctupload.Streams, error) {
+		initLeanplumSettings()
+		apiUploadRecordStream, iosSDKRecordStream, androidSDKRecordStream := leanplumRecordsFromS3Generator(ctx)
+		return &ctupload.Streams{
+			API: convertedRecords(ctx, processAPIRecordForUpload(ctx, apiUploadRecordStream)),
+			SDK: map[string]<-chan ctupload.SDKRecord{
+				"iOS":     sdkRecords(ctx, iosSDKRecordStream),
+				"android": sdkRecords(ctx, androidSDKRecordStream),
+			},
+		}, nil
+	})
+	ctupload.RegisterSink("clevertap", func(cfg ctupload.Config) (ctupload.Sink, error) {
+		startLibraryRun(cfg)
+		setRateLimits(cfg.RecordsPerSecond, cfg.RequestsPerSecond)
+		return &clevertapSink{}, nil
+	})
+}
+
+// startLibraryRun logs to the logger of cfg, or nowhere when it has none, and resets the counts of the summary and
+// the report, so that each ctupload.Run reports its own upload only. It is called by the clevertap sink and the
+// command sources, whichever are created for the run.
+func startLibraryRun(cfg ctupload.Config) {
+	if cfg.Logger == nil {
+		logger.SetOutput(ioutil.Discard)
+	} else {
+		logger.SetOutput(cfg.Logger.Writer())
+		logger.SetPrefix(cfg.Logger.Prefix())
+		logger.SetFlags(cfg.Logger.Flags())
+	}
+	resetRunState()
+}
+
+// resetRunState clears what the previous upload of the process counted and closes its dead-letter file
+func resetRunState() {
+	Summary.Lock()
+	Summary.ctProcessed, Summary.ctUnprocessed, Summary.retries = 0, 0, 0
+	Summary.batchesGivenUp, Summary.batchesSplit, Summary.badRequestRecords = 0, 0, 0
+	Summary.mpParseErrorResponses = make([]string, 0)
+	Summary.Unlock()
+	report.Lock()
+	report.byType = make(map[string]*reportCounts)
+	report.byEvent = make(map[string]*reportCounts)
+	report.files = make(map[string]*reportCounts)
+	report.skipped = make(map[string]int64)
+	report.errors = make(map[string]int64)
+	report.requestsRetried, report.maxAttempts = 0, 0
+	report.Unlock()
+	validation.Lock()
+	validation.checked, validation.invalid, validation.fixed = 0, 0, 0
+	validation.issues = make(map[string]*validationCounts)
+	validation.Unlock()
+	targetSummary.Lock()
+	targetSummary.counts = make(map[string]*targetCounts)
+	targetSummary.Unlock()
+	for _, counter := range []*int64{&progress.read, &progress.converted, &progress.skipped,
+		&progress.batchesInFlight, &progress.batchesSent, &progress.sdkInFlight, &progress.sdkSent,
+		&progress.bytesRead, &progress.bytesTotal, &progress.bodyBytes, &progress.bodyBytesSent} {
+		atomic.StoreInt64(counter, 0)
+	}
+	deadLetter.Lock()
+	if deadLetter.file != nil {
+		deadLetter.file.Close()
+	}
+	deadLetter.file, deadLetter.encoder, deadLetter.count = nil, nil, 0
+	deadLetter.Unlock()
+	checkpoint = nil
+}
+
+// clevertapSink uploads to the CleverTap upload API and SDK endpoint of every target configured by the options of
+// the source. With several targets ctupload.Run uploads to each of them through UploadAPITo, with batches of its
+// own.
+type clevertapSink struct {
+}
+
+// Targets returns the names of the targets when there are several
+func (s *clevertapSink) Targets() []string {
+	if len(globals.Targets) < 2 {
+		return nil
+	}
+	names := make([]string, len(globals.Targets))
+	for i, t := range globals.Targets {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// FanOut queues the records for each target with fanOutRecords, as the upload subcommands do
+func (s *clevertapSink) FanOut(ctx context.Context, records <-chan ctupload.Record) []<-chan ctupload.Record {
+	recordStream := make(chan ctRecordInfo)
+	go func() {
+		defer close(recordStream)
+		for r := range records {
+			select {
+			case <-ctx.Done():
+				return
+			case recordStream <- ctRecordInfo{Record: r.Data, Source: r.Source, LineNum: r.LineNum,
+				Transformed: r.Transformed}:
+			}
+		}
+	}()
+	streams := fanOutRecords(ctx, recordStream, globals.Targets)
+	queues := make([]<-chan ctupload.Record, len(streams))
+	for i, stream := range streams {
+		queue := make(chan ctupload.Record)
+		queues[i] = queue
+		go func(stream <-chan ctRecordInfo) {
+			defer close(queue)
+			for r := range stream {
+				select {
+				case <-ctx.Done():
+					return
+				case queue <- ctupload.Record{Data: r.Record, Source: r.Source, LineNum: r.LineNum,
+					Transformed: r.Transformed}:
+				}
+			}
+		}(stream)
+	}
+	return queues
+}
+
+// UploadAPITo uploads the batch to the target named target
+func (s *clevertapSink) UploadAPITo(ctx context.Context, target string, batch []ctupload.Record) (ctupload.BatchResult,
+	error) {
+	for i := range globals.Targets {
+		if globals.Targets[i].Name == target {
+			return uploadAPIToTarget(ctx, batch, &globals.Targets[i])
+		}
+	}
+	return ctupload.BatchResult{Unprocessed: len(batch)}, fmt.Errorf("unknown target %v", target)
+}
+
+// UploadAPI uploads the batch to all targets at once. The result sums up the answers of the targets, the error is
+// the first one.
+func (s *clevertapSink) UploadAPI(ctx context.Context, batch []ctupload.Record) (ctupload.BatchResult, error) {
+	targets := globals.Targets
+	results := make([]ctupload.BatchResult, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = uploadAPIToTarget(ctx, batch, &targets[i])
+		}(i)
+	}
+	wg.Wait()
+	var result ctupload.BatchResult
+	var err error
+	for i := range targets {
+		result.Processed += results[i].Processed
+		result.Unprocessed += results[i].Unprocessed
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	return result, err
+}
+
+func uploadAPIToTarget(ctx context.Context, batch []ctupload.Record, t *globals.Target) (ctupload.BatchResult, error) {
+	records := make([]ctRecordInfo, len(batch))
+	for i, r := range batch {
+		records[i] = ctRecordInfo{Record: r.Data, Source: r.Source, LineNum: r.LineNum, Target: t.Name,
+			Transformed: r.Transformed}
+	}
+	resp, err := sendBatchToCTAPI(ctx, records, t)
+	if err != nil {
+		return ctupload.BatchResult{Unprocessed: len(batch)}, err
+	}
+	if resp == nil {
+		return ctupload.BatchResult{}, nil
+	}
+	if resp.Status == "fail" {
+		return ctupload.BatchResult{Unprocessed: len(batch)}, nil
+	}
+	return ctupload.BatchResult{Processed: resp.Processed, Unprocessed: len(resp.Unprocessed)}, nil
+}
+
+// UploadSDK sends the request to all targets, one after the other. With -validateOnly nothing is sent.
+func (s *clevertapSink) UploadSDK(ctx context.Context, osName string, request []map[string]interface{}) error {
+	if *globals.ValidateOnly {
+		return nil
+	}
+	var firstErr error
+	for i := range globals.Targets {
+		t := &globals.Targets[i]
+		if len(globals.Targets) > 1 {
+			request = sdkRequestForTarget(request, t)
+		}
+		if _, err := sendDataToCTSDK(ctx, request, t, osName); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// runSourceCommand runs a registered source through ctupload.Run
+type runSourceCommand struct {
+}
+
+func (r *runSourceCommand) Execute() error {
+	logger.Println("started")
+	known := false
+	for _, name := range ctupload.Sources() {
+		known = known || name == *globals.RunSource
+	}
+	if !known {
+		return fmt.Errorf("unknown source %v. Available sources: %v", *globals.RunSource, ctupload.Sources())
+	}
+	cfg := ctupload.Config{
+		Source:         *globals.RunSource,
+		Options:        make(map[string]string),
+		BatchSize:      *globals.BatchSize,
+		Concurrency:    *globals.APIConcurrency,
+		SDKConcurrency: *globals.SDKConcurrency,
+		//the limits are applied by the clevertap sink
+		RecordsPerSecond:  *globals.MaxRecordsPerSecond,
+		RequestsPerSecond: *globals.MaxRequestsPerSecond,
+		Logger:            logger,
+	}
+	p := startPipeline()
+	defer p.stop()
+	cfg.Intake = p.intake
+	for _, o := range globals.RunOptions {
+		kv := strings.SplitN(o, "=", 2)
+		if v, ok := cfg.Options[kv[0]]; ok {
+			//repeated options take one value per line
+			cfg.Options[kv[0]] = v + "\n" + kv[1]
+			continue
+		}
+		cfg.Options[kv[0]] = kv[1]
+	}
+	//the source options replace the ones of the run subcommand
+	for name, set := range map[string]bool{"gzip": *globals.Gzip, "validate": *globals.Validate,
+		"validateOnly": *globals.ValidateOnly, "autoFix": *globals.AutoFix} {
+		if _, ok := cfg.Options[name]; !ok && set {
+			cfg.Options[name] = "true"
+		}
+	}
+	hostOptions = globals.SaveOptions()
+	for name := range hostOptions {
+		if _, ok := cfg.Options[name]; ok || name == "source" || name == "o" {
+			delete(hostOptions, name)
+		}
+	}
+	result, err := ctupload.Run(p.ctx, cfg)
+	hostOptions = nil
+	if err != nil && result == nil {
+		return err
+	}
+	logger.Println("done")
+	logger.Println("---------------------Summary---------------------")
+	logger.Printf("Records read: %v , converted: %v , Processed: %v , Unprocessed: %v , SDK requests: %v",
+		result.RecordsRead, result.Records, result.Processed, result.Unprocessed, result.SDKRequests)
+	logger.Printf("Failed batches: %v , took %v", result.BatchesFailed,
+		result.End.Sub(result.Start).Round(time.Millisecond))
+	for _, e := range result.Errors {
+		logger.Println(e)
+	}
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
+	if err != nil {
+		return err
+	}
+	return p.Err()
+}
@@ -0,0 +1,180 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/ctupload"
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+func TestRunValidatesSourceRecords(t *testing.T) {
+	var mu sync.Mutex
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			D []map[string]interface{} `json:"d"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, record := range payload.D {
+			uploaded = append(uploaded, record["identity"].(string))
+		}
+		mu.Unlock()
+		writeMockResponse(w, http.StatusOK, &CTResponse{Status: "success", Processed: len(payload.D)})
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replayPath := writeTestFile(t, dir, "rejected.jsonl",
+		`{"error":"e","record":{"identity":"1","type":"profile","profileData":{"Name":"Ann"}}}
+{"error":"e","record":{"identity":"2","type":"account","profileData":{"Name":"Bob"}}}
+{"error":"e","record":{"identity":"3","type":"profile","profileData":{"Name":"Cy"}}}
+`)
+	//the run subcommand passes the account to the source as options
+	source := "replay=" + replayPath + "\nid=TEST-ACCOUNT\np=passcode\napiEndpoint=" + server.URL + uploadPath
+
+	r, err := testUpload(t, server, "run", map[string]string{"source": "replay", "o": source, "validate": "true"}, nil)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	sort.Strings(uploaded)
+	if want := []string{"1", "3"}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded %v, want %v", uploaded, want)
+	}
+	if r.Skipped[skipInvalidRecord] != 1 {
+		t.Errorf("skipped %v, want 1 record that failed validation", r.Skipped)
+	}
+
+	uploaded = nil
+	_, err = testUpload(t, server, "run", map[string]string{"source": "replay", "o": source, "validateOnly": "true"},
+		nil)
+	if err == nil || !strings.Contains(err.Error(), "1 records failed validation") {
+		t.Errorf("got error %v, want 1 record failing validation", err)
+	}
+	if len(uploaded) != 0 {
+		t.Errorf("uploaded %v with -validateOnly", uploaded)
+	}
+}
+
+func TestRunKeepsItsOwnOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(mockUploadHandler))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := writeTestFile(t, dir, "in.csv", string(testLines(10)))
+	source := "csv=" + csvPath + "\nid=TEST-ACCOUNT\np=passcode\napiEndpoint=" + server.URL + uploadPath
+
+	//the options of the run subcommand are reset by configuring the csv source, and set back for the run
+	r, err := testUpload(t, server, "run", map[string]string{"source": "csv", "o": source, "progressInterval": "1h",
+		"maxRecordsPerSecond": "5000"}, nil)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if *globals.ProgressInterval != time.Hour || *globals.MaxRecordsPerSecond != 5000 {
+		t.Errorf("progress interval %v and records per second %v, want 1h and 5000", *globals.ProgressInterval,
+			*globals.MaxRecordsPerSecond)
+	}
+	if c := r.Files[csvPath]; c == nil || c.Processed != 10 {
+		t.Errorf("file counts %+v, want 10 records processed", c)
+	}
+}
+
+func TestLibraryRunsLogAndCountOnTheirOwn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(mockUploadHandler))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var stdLog bytes.Buffer
+	log.SetOutput(&stdLog)
+	defer log.SetOutput(os.Stderr)
+	defer func() {
+		logger.SetOutput(os.Stderr)
+		logger.SetFlags(log.LstdFlags)
+	}()
+
+	for i, lines := range []int{30, 10} {
+		csvPath := writeTestFile(t, dir, fmt.Sprintf("in-%v.csv", i), string(testLines(lines)))
+		var runLog bytes.Buffer
+		result, err := ctupload.Run(context.Background(), ctupload.Config{Source: "csv",
+			Options: map[string]string{"csv": csvPath, "t": "profile", "id": "TEST-ACCOUNT", "p": "passcode",
+				"apiEndpoint": server.URL + uploadPath},
+			Logger: log.New(&runLog, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Processed != int64(lines) {
+			t.Fatalf("run %v processed %v records, want %v", i, result.Processed, lines)
+		}
+		if !strings.Contains(runLog.String(), "API response body") {
+			t.Errorf("run %v logged %q, want the responses", i, runLog.String())
+		}
+		Summary.Lock()
+		processed := Summary.ctProcessed
+		Summary.Unlock()
+		report.Lock()
+		files := len(report.files)
+		c := report.files[csvPath]
+		report.Unlock()
+		if processed != int64(lines) || files != 1 || c == nil || c.Read != int64(lines) {
+			t.Errorf("run %v counted %v processed and files %v, want only its own %v records", i, processed, files,
+				lines)
+		}
+	}
+	if stdLog.Len() != 0 {
+		t.Errorf("the runs logged %q to the standard logger", stdLog.String())
+	}
+}
+
+func TestLibraryRunUploadsToEachTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(mockUploadHandler))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := writeTestFile(t, dir, "in.csv", string(testLines(25)))
+	endpoint := server.URL + uploadPath
+
+	result, err := ctupload.Run(context.Background(), ctupload.Config{Source: "csv", BatchSize: 10,
+		Options: map[string]string{"csv": csvPath, "t": "profile",
+			"target": "name=a,id=ACCOUNT-A,p=passcode,apiEndpoint=" + endpoint + "\n" +
+				"name=b,id=ACCOUNT-B,p=passcode,apiEndpoint=" + endpoint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if c := result.Targets[name]; c == nil || c.Processed != 25 || c.BatchesFailed != 0 {
+			t.Errorf("target %v: %+v, want 25 records processed", name, c)
+		}
+	}
+	if result.Processed != 50 {
+		t.Errorf("processed %v records, want 50", result.Processed)
+	}
+}
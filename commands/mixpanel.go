@@ -1,10 +1,10 @@
 package commands
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 
 	"encoding/json"
@@ -21,8 +21,6 @@ import (
 
 	"reflect"
 
-	"os"
-
 	"github.com/ankit-arora/clevertap-data-upload/globals"
 )
 
@@ -49,16 +47,23 @@ var propertiesMap = map[string]string{
 type uploadProfilesFromMixpanel struct {
 }
 
-func (u *uploadProfilesFromMixpanel) Execute() {
-	log.Println("started")
+func (u *uploadProfilesFromMixpanel) Execute() error {
+	logger.Println("started")
 	//ct batch size of 100 for MP
 	ctBatchSize = 100
 	var wg sync.WaitGroup
-	done := make(chan interface{})
-	batchAndSendToCTAPI(done, processAPIRecordForUpload(done, mixpanelProfileRecordsGenerator(done)), &wg)
+	p := startPipeline()
+	defer p.stop()
+	stopProgress := startProgress()
+	batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, mixpanelProfileRecordsGenerator(p.intake)), &wg)
 	wg.Wait()
-	log.Println("done")
-	log.Printf("Profiles Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	stopProgress()
+	logger.Println("done")
+	logger.Printf("Profiles Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
+	return p.Err()
 }
 
 //{"page": 0,
@@ -139,18 +144,19 @@ func (p *mixpanelProfileRecordInfo) convertToCTAPIFormat() ([]interface{}, error
 			record["profileData"] = propertyData
 			records = append(records, record)
 		} else {
-			log.Printf("Identity not found for record. Skipping: %v", r)
+			logger.Printf("Identity not found for record. Skipping: %v", r)
+			countSkipped("", skipMissingIdentity)
 		}
 	}
 	return records, nil
 }
 
 func (p *mixpanelProfileRecordInfo) print() {
-	log.Printf("First Result: %v", p.Results[0])
-	log.Printf("Results size: %v", len(p.Results))
+	logger.Printf("First Result: %v", p.Results[0])
+	logger.Printf("Results size: %v", len(p.Results))
 }
 
-func mixpanelProfileRecordsGenerator(done chan interface{}) <-chan apiUploadRecordInfo {
+func mixpanelProfileRecordsGenerator(ctx context.Context) <-chan apiUploadRecordInfo {
 	mixpanelRecordStream := make(chan apiUploadRecordInfo)
 	go func() {
 		defer close(mixpanelRecordStream)
@@ -159,42 +165,41 @@ func mixpanelProfileRecordsGenerator(done chan interface{}) <-chan apiUploadReco
 		page := "0"
 		pageSize := 0
 		encodedSecret := base64.StdEncoding.EncodeToString([]byte(*globals.MixpanelSecret))
+		retries := newRetrier(ctx, "Mixpanel profiles export")
 		for {
 			endpoint := mixpanelProfilesExportEP
 			if sessionID != "" {
 				endpoint += "?session_id=" + sessionID + "&page=" + page
 			}
-			log.Printf("Fetching profiles data from Mixpanel for page: %v", page)
+			logger.Printf("Fetching profiles data from Mixpanel for page: %v", page)
 			req, err := http.NewRequest("GET", endpoint, nil)
 			if err != nil {
-				log.Fatal(err)
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, err)
+				return
 			}
 			req.Header.Add("Authorization", "Basic "+encodedSecret)
-			resp, err := client.Do(req)
-			if err == nil && resp.StatusCode <= 500 {
+			resp, err := client.Do(req.WithContext(ctx))
+			if err == nil && resp.StatusCode <= 500 && resp.StatusCode != http.StatusTooManyRequests {
 				info := &mixpanelProfileRecordInfo{}
 				err = json.NewDecoder(resp.Body).Decode(info)
 				if err != nil {
-					log.Println("Error parsing profiles json response from Mixpanel", err)
-					log.Printf("retrying for session_id : %v and page : %v after 20 seconds", sessionID, page)
+					logger.Println("Error parsing profiles json response from Mixpanel", err)
+					logger.Printf("retrying for session_id : %v and page : %v", sessionID, page)
 					ioutil.ReadAll(resp.Body)
 					resp.Body.Close()
-					time.Sleep(20 * time.Second)
+					if err := retries.backoff(resp); err != nil {
+						fail(ctx, err)
+						return
+					}
 					continue
 				}
 
 				ioutil.ReadAll(resp.Body)
 				resp.Body.Close()
+				retries.reset()
 
 				select {
-				case <-done:
+				case <-ctx.Done():
 					return
 				case mixpanelRecordStream <- info:
 				}
@@ -202,8 +207,8 @@ func mixpanelProfileRecordsGenerator(done chan interface{}) <-chan apiUploadReco
 				if sessionID == "" {
 					pageSize = info.PageSize
 					sessionID = info.SessionID
-					log.Printf("Mixpanel request page size: %v", pageSize)
-					log.Printf("Mixpanel request session id: %v", sessionID)
+					logger.Printf("Mixpanel request page size: %v", pageSize)
+					logger.Printf("Mixpanel request session id: %v", sessionID)
 				}
 				if len(info.Results) < pageSize {
 					//got less number of results from pageSize. End of response
@@ -214,17 +219,19 @@ func mixpanelProfileRecordsGenerator(done chan interface{}) <-chan apiUploadReco
 				continue
 			}
 			if err != nil {
-				log.Println("Error while fetching data from Mixpanel: ", err)
-				log.Println("retrying after 20 seconds")
+				logger.Println("Error while fetching data from Mixpanel: ", err)
 			} else {
 				body, _ := ioutil.ReadAll(resp.Body)
-				log.Println("response body: ", string(body))
-				log.Printf("retrying for session_id : %v and page : %v after 20 seconds", sessionID, page)
+				logger.Println("response body: ", string(body))
+				logger.Printf("retrying for session_id : %v and page : %v", sessionID, page)
 			}
 			if resp != nil {
 				resp.Body.Close()
 			}
-			time.Sleep(20 * time.Second)
+			if err := retries.backoff(resp); err != nil {
+				fail(ctx, err)
+				return
+			}
 		}
 	}()
 	return mixpanelRecordStream
@@ -233,50 +240,66 @@ func mixpanelProfileRecordsGenerator(done chan interface{}) <-chan apiUploadReco
 type uploadEventsFromMixpanel struct {
 }
 
-func (u *uploadEventsFromMixpanel) Execute() {
-	log.Println("started")
+func (u *uploadEventsFromMixpanel) Execute() error {
+	logger.Println("started")
 	//ct batch size of 100 for MP
 	ctBatchSize = 100
 	var wg sync.WaitGroup
-	done := make(chan interface{})
+	p := startPipeline()
+	defer p.stop()
+	stopProgress := startProgress()
 	if globals.MPEventsFilePaths != nil && len(globals.MPEventsFilePaths) > 0 {
-		batchAndSendToCTAPI(done, processAPIRecordForUpload(done, mixpanelEventRecordsFromFilesGenerator(done)), &wg)
+		batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, mixpanelEventRecordsFromFilesGenerator(p.intake)), &wg)
 	} else {
-		batchAndSendToCTAPI(done, processAPIRecordForUpload(done, mixpanelEventRecordsGenerator(done)), &wg)
+		batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, mixpanelEventRecordsGenerator(p.intake)), &wg)
 	}
 	wg.Wait()
-	log.Println("done")
-	log.Println("---------------------Summary---------------------")
-	log.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	stopProgress()
+	logger.Println("done")
+	logger.Println("---------------------Summary---------------------")
+	logger.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
 	if len(Summary.mpParseErrorResponses) > 0 {
-		log.Println("Mixpanel Events Parse Error Responses:")
+		logger.Println("Mixpanel Events Parse Error Responses:")
 		for _, parseErrorResponse := range Summary.mpParseErrorResponses {
-			log.Println(parseErrorResponse)
+			logger.Println(parseErrorResponse)
 		}
 	}
-
+	return p.Err()
 }
 
 type mixpanelEventRecordInfo struct {
 	Event      string                 `json:"event,omitempty"`
 	Properties map[string]interface{} `json:"properties,omitempty"`
+	//file and line for records read from Mixpanel events files
+	source  string
+	lineNum int
+}
+
+func (e *mixpanelEventRecordInfo) origin() (string, int) {
+	return e.source, e.lineNum
 }
 
 func (e *mixpanelEventRecordInfo) convertToCTAPIFormat() ([]interface{}, error) {
 	records := make([]interface{}, 0)
 	eventName := e.Event
 	if eventName == "" {
-		log.Printf("Event name missing for record: %v . Skipping", e)
+		logger.Printf("Event name missing for record: %v . Skipping", e)
+		countSkipped(e.source, skipMissingEventName)
 		return records, nil
 	}
 	identity, ok := e.Properties["distinct_id"]
 	if !ok {
-		log.Printf("Identity missing for record: %v . Skipping", e)
+		logger.Printf("Identity missing for record: %v . Skipping", e)
+		countSkipped(e.source, skipMissingIdentity)
 		return records, nil
 	}
 	ts, ok := e.Properties["time"]
 	if !ok {
-		log.Printf("Time stamp missing for record: %v . Skipping", e)
+		logger.Printf("Time stamp missing for record: %v . Skipping", e)
+		countSkipped(e.source, skipMissingTimestamp)
 		return records, nil
 	}
 	isEventRestricted := false
@@ -357,7 +380,7 @@ func (e *mixpanelEventRecordInfo) print() {
 	//fmt.Printf("\nresponse: %v", e.response)
 }
 
-func mixpanelEventRecordsGenerator(done chan interface{}) <-chan apiUploadRecordInfo {
+func mixpanelEventRecordsGenerator(ctx context.Context) <-chan apiUploadRecordInfo {
 	mixpanelRecordStream := make(chan apiUploadRecordInfo)
 	go func() {
 		defer close(mixpanelRecordStream)
@@ -367,24 +390,19 @@ func mixpanelEventRecordsGenerator(done chan interface{}) <-chan apiUploadRecord
 		if endDate == "" {
 			endDate = time.Now().Local().Format("2006-01-02")
 		}
-		log.Printf("Fetching events with start date: %v and end date: %v ", eventsDate, endDate)
+		logger.Printf("Fetching events with start date: %v and end date: %v ", eventsDate, endDate)
 		encodedSecret := base64.StdEncoding.EncodeToString([]byte(*globals.MixpanelSecret))
+		retries := newRetrier(ctx, "Mixpanel events export")
 		for {
-			log.Printf("Fetching events data from Mixpanel for date: %v", eventsDate)
+			logger.Printf("Fetching events data from Mixpanel for date: %v", eventsDate)
 			endpoint := fmt.Sprintf(mixpanelEventsExportEP+"?from_date=%v&to_date=%v", eventsDate, eventsDate)
 			req, err := http.NewRequest("GET", endpoint, nil)
 			if err != nil {
-				log.Fatal(err)
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, err)
+				return
 			}
 			req.Header.Add("Authorization", "Basic "+encodedSecret)
-			resp, err := client.Do(req)
+			resp, err := client.Do(req.WithContext(ctx))
 			if err == nil && resp.StatusCode < 300 {
 				scanner := bufio.NewScanner(resp.Body)
 				scanner.Split(ScanCRLF)
@@ -394,8 +412,10 @@ func mixpanelEventRecordsGenerator(done chan interface{}) <-chan apiUploadRecord
 					info := &mixpanelEventRecordInfo{}
 					err = json.Unmarshal([]byte(s), info)
 					if err != nil {
-						log.Printf("Error parsing event record %v. Skipping", s)
+						logger.Printf("Error parsing event record %v. Skipping", s)
 						Summary.mpParseErrorResponses = append(Summary.mpParseErrorResponses, s)
+						countRead("")
+						countSkipped("", skipJSONParseError)
 					} else {
 						if ts, ok := info.Properties["time"]; ok {
 							if *globals.StartTs > 0 && ts.(float64) < *globals.StartTs {
@@ -404,24 +424,19 @@ func mixpanelEventRecordsGenerator(done chan interface{}) <-chan apiUploadRecord
 							}
 						}
 						select {
-						case <-done:
+						case <-ctx.Done():
 							return
 						case mixpanelRecordStream <- info:
 						}
 					}
 				}
 				if err := scanner.Err(); err != nil {
-					log.Fatal(err)
-					select {
-					case <-done:
-						return
-					default:
-						done <- struct{}{}
-						return
-					}
+					fail(ctx, err)
+					return
 				}
 
 				resp.Body.Close()
+				retries.reset()
 
 				if eventsDate == endDate {
 					//reached end date
@@ -434,49 +449,57 @@ func mixpanelEventRecordsGenerator(done chan interface{}) <-chan apiUploadRecord
 				continue
 			}
 			if err != nil {
-				log.Println("Error while fetching events data from Mixpanel: ", err)
-				log.Printf("retrying after 20 seconds for date: %v", eventsDate)
+				logger.Println("Error while fetching events data from Mixpanel: ", err)
+				logger.Printf("retrying for date: %v", eventsDate)
 			} else {
 				body, _ := ioutil.ReadAll(resp.Body)
-				log.Println("response body: ", string(body))
-				log.Printf("retrying after 20 seconds for date: %v", eventsDate)
+				logger.Println("response body: ", string(body))
+				logger.Printf("retrying for date: %v", eventsDate)
 			}
 			if resp != nil {
 				resp.Body.Close()
 			}
-			time.Sleep(20 * time.Second)
+			if err := retries.backoff(resp); err != nil {
+				fail(ctx, err)
+				return
+			}
 		}
 	}()
 	return mixpanelRecordStream
 }
 
-func mixpanelEventRecordsFromFilesGenerator(done chan interface{}) <-chan apiUploadRecordInfo {
+func mixpanelEventRecordsFromFilesGenerator(ctx context.Context) <-chan apiUploadRecordInfo {
 	mixpanelRecordStream := make(chan apiUploadRecordInfo)
 	go func() {
 		defer close(mixpanelRecordStream)
+		trackInputFiles(globals.MPEventsFilePaths)
 		for _, mpEventsFilePath := range globals.MPEventsFilePaths {
-			log.Printf("Fetching events data from Mixpanel events file: %v", mpEventsFilePath)
-			file, err := os.Open(mpEventsFilePath)
+			logger.Printf("Fetching events data from Mixpanel events file: %v", mpEventsFilePath)
+			file, err := openInput(ctx, mpEventsFilePath)
 			if err != nil {
-				log.Fatal(err)
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, err)
+				return
+			}
+			input, err := decompressInput(file, mpEventsFilePath)
+			if err != nil {
+				fail(ctx, err)
+				file.Close()
+				return
 			}
-			scanner := bufio.NewScanner(file)
+			scanner := bufio.NewScanner(input)
 			scanner.Split(ScanCRLF)
+			lineNum := -1
 			for scanner.Scan() {
+				lineNum++
 				s := scanner.Text()
 				s = strings.Trim(s, " \n \r")
-				info := &mixpanelEventRecordInfo{}
+				info := &mixpanelEventRecordInfo{source: mpEventsFilePath, lineNum: lineNum}
 				err = json.Unmarshal([]byte(s), info)
 				if err != nil {
-					log.Printf("Error parsing event record %v. Skipping", s)
+					logger.Printf("Error parsing event record %v. Skipping", s)
 					Summary.mpParseErrorResponses = append(Summary.mpParseErrorResponses, s)
+					countRead(mpEventsFilePath)
+					countSkipped(mpEventsFilePath, skipJSONParseError)
 				} else {
 					if ts, ok := info.Properties["time"]; ok {
 						if *globals.StartTs > 0 && ts.(float64) < *globals.StartTs {
@@ -485,7 +508,7 @@ func mixpanelEventRecordsFromFilesGenerator(done chan interface{}) <-chan apiUpl
 						}
 					}
 					select {
-					case <-done:
+					case <-ctx.Done():
 						file.Close()
 						return
 					case mixpanelRecordStream <- info:
@@ -493,16 +516,9 @@ func mixpanelEventRecordsFromFilesGenerator(done chan interface{}) <-chan apiUpl
 				}
 			}
 			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-				select {
-				case <-done:
-					file.Close()
-					return
-				default:
-					done <- struct{}{}
-					file.Close()
-					return
-				}
+				fail(ctx, err)
+				file.Close()
+				return
 			}
 
 			file.Close()
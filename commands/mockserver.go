@@ -0,0 +1,273 @@
+package commands
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// mockServerCommand serves a local stand-in for the CleverTap upload API (/1/upload) and the SDK endpoint (/a1)
+// so that full runs can be exercised with -apiEndpoint and -sdkEndpoint pointing at it
+type mockServerCommand struct {
+}
+
+var mockRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+var mockStats = struct {
+	sync.Mutex
+	requests    int64
+	processed   int64
+	unprocessed int64
+	injected    int64
+}{}
+
+func (m *mockServerCommand) Execute() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1/upload", mockUploadHandler)
+	mux.HandleFunc("/a1", mockSDKHandler)
+	logger.Printf("Mock CleverTap server listening on %v", *globals.MockServerAddr)
+	logger.Printf("Upload API endpoint: http://%v/1/upload , SDK endpoint: http://%v/a1",
+		*globals.MockServerAddr, *globals.MockServerAddr)
+	if *globals.MockFilesDir != "" {
+		mux.Handle("/files/", mockFilesHandler(*globals.MockFilesDir))
+		logger.Printf("Serving files of %v at http://%v/files/", *globals.MockFilesDir, *globals.MockServerAddr)
+	}
+	return http.ListenAndServe(*globals.MockServerAddr, mux)
+}
+
+func mockChance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	mockRand.Lock()
+	defer mockRand.Unlock()
+	return mockRand.Float64() < rate
+}
+
+func writeMockResponse(w http.ResponseWriter, statusCode int, resp *CTResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// injectMockError fails the request with a 429 or 5xx according to -mockThrottleRate and -mockErrorRate
+func injectMockError(w http.ResponseWriter) bool {
+	if mockChance(*globals.MockThrottleRate) {
+		mockStats.Lock()
+		mockStats.injected++
+		mockStats.Unlock()
+		w.Header().Set("Retry-After", "1")
+		writeMockResponse(w, http.StatusTooManyRequests, &CTResponse{Status: "fail", Error: "Too many requests"})
+		return true
+	}
+	if mockChance(*globals.MockErrorRate) {
+		mockStats.Lock()
+		mockStats.injected++
+		mockStats.Unlock()
+		statusCode := http.StatusInternalServerError
+		if mockChance(0.5) {
+			statusCode = http.StatusServiceUnavailable
+		}
+		writeMockResponse(w, statusCode, &CTResponse{Status: "fail", Error: http.StatusText(statusCode)})
+		return true
+	}
+	return false
+}
+
+func mockUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMockResponse(w, http.StatusMethodNotAllowed, &CTResponse{Status: "fail", Error: "Method not allowed"})
+		return
+	}
+	//{ "status" : "fail" , "error" : "Invalid Account ID or Passcode" , "code" : 401}
+	accountID := r.Header.Get("X-CleverTap-Account-Id")
+	passcode := r.Header.Get("X-CleverTap-Passcode")
+	if accountID == "" || passcode == "" || (*globals.AccountID != "" && accountID != *globals.AccountID) ||
+		(*globals.AccountPasscode != "" && passcode != *globals.AccountPasscode) {
+		writeMockResponse(w, http.StatusUnauthorized, &CTResponse{Status: "fail", Error: "Invalid Account ID or Passcode"})
+		return
+	}
+	if injectMockError(w) {
+		return
+	}
+	body, err := readMockBody(r)
+	payload := struct {
+		D []interface{} `json:"d"`
+	}{}
+	if err != nil || json.Unmarshal(body, &payload) != nil || payload.D == nil {
+		writeMockResponse(w, http.StatusBadRequest, &CTResponse{Status: "fail", Error: "Malformed request"})
+		return
+	}
+	//a record that is not a JSON object fails the whole request
+	for _, d := range payload.D {
+		if _, ok := d.(map[string]interface{}); !ok {
+			writeMockResponse(w, http.StatusBadRequest, &CTResponse{Status: "fail", Error: "Malformed request"})
+			return
+		}
+	}
+	resp := &CTResponse{Status: "success"}
+	for _, d := range payload.D {
+		errMsg, code := validateMockRecord(d)
+		if errMsg == "" && mockChance(*globals.MockRejectRate) {
+			errMsg, code = "Record rejected by mock server", 599
+		}
+		if errMsg != "" {
+			resp.Unprocessed = append(resp.Unprocessed, map[string]interface{}{
+				"status": "fail",
+				"code":   code,
+				"error":  errMsg,
+				"record": d,
+			})
+			continue
+		}
+		resp.Processed++
+	}
+	if len(resp.Unprocessed) > 0 {
+		resp.Status = "partial"
+	}
+	mockStats.Lock()
+	mockStats.requests++
+	mockStats.processed += int64(resp.Processed)
+	mockStats.unprocessed += int64(len(resp.Unprocessed))
+	logger.Printf("Upload request %v from %v: processed %v , unprocessed %v (totals: processed %v , unprocessed %v , injected errors %v)",
+		mockStats.requests, accountID, resp.Processed, len(resp.Unprocessed), mockStats.processed,
+		mockStats.unprocessed, mockStats.injected)
+	mockStats.Unlock()
+	writeMockResponse(w, http.StatusOK, resp)
+}
+
+// validateMockRecord applies the basic checks CleverTap does on every uploaded record and returns the error
+// message and code CleverTap would report, or an empty message for a valid record
+func validateMockRecord(d interface{}) (string, int) {
+	record, ok := d.(map[string]interface{})
+	if !ok {
+		return "Record is not a JSON object", 500
+	}
+	identityFound := false
+	for _, key := range []string{"identity", "objectId", "FBID", "GPID"} {
+		if v, ok := record[key]; ok && v != "" && v != nil {
+			identityFound = true
+		}
+	}
+	if !identityFound {
+		return "Identity, objectId, FBID or GPID is mandatory", 500
+	}
+	if ts, ok := record["ts"]; ok {
+		if _, ok := ts.(float64); !ok {
+			return "Invalid timestamp", 508
+		}
+	}
+	switch record["type"] {
+	case "event":
+		evtName, _ := record["evtName"].(string)
+		if evtName == "" {
+			return "Event name is mandatory", 512
+		}
+		if evtData, ok := record["evtData"]; ok {
+			if _, ok := evtData.(map[string]interface{}); !ok {
+				return "evtData must be a JSON object", 513
+			}
+		}
+	case "profile":
+		if _, ok := record["profileData"].(map[string]interface{}); !ok {
+			return "profileData is mandatory and must be a JSON object", 514
+		}
+	default:
+		return "Record type must be either profile or event", 511
+	}
+	return "", 0
+}
+
+//[{"type":"meta","id":"<account id>","tk":"<token>","g":"<object id>","af":{...}},{"type":"data",...}]
+
+func mockSDKHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if injectMockError(w) {
+		return
+	}
+	body, err := readMockBody(r)
+	var payload []map[string]interface{}
+	if err != nil || json.Unmarshal(body, &payload) != nil || len(payload) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	meta := payload[0]
+	id, _ := meta["id"].(string)
+	tk, _ := meta["tk"].(string)
+	if meta["type"] != "meta" || id == "" || tk == "" || (*globals.AccountID != "" && id != *globals.AccountID) ||
+		(*globals.AccountToken != "" && tk != *globals.AccountToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	mockStats.Lock()
+	mockStats.requests++
+	mockStats.processed++
+	mockStats.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// mockFilesHandler serves the files of dir as a stand-in for inputs given by URL. Besides the errors of
+// injectMockError, -mockErrorRate breaks downloads off half way, as a dropped connection would.
+func mockFilesHandler(dir string) http.Handler {
+	files := http.StripPrefix("/files/", http.FileServer(http.Dir(dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if injectMockError(w) {
+			return
+		}
+		if mockChance(*globals.MockErrorRate) {
+			mockStats.Lock()
+			mockStats.injected++
+			mockStats.Unlock()
+			w = &breakingWriter{ResponseWriter: w, left: -1}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// breakingWriter aborts the response after half of its Content-Length has been written
+type breakingWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (b *breakingWriter) Write(p []byte) (int, error) {
+	if b.left < 0 {
+		size, _ := strconv.Atoi(b.Header().Get("Content-Length"))
+		b.left = size / 2
+	}
+	if len(p) <= b.left {
+		b.left -= len(p)
+		return b.ResponseWriter.Write(p)
+	}
+	b.ResponseWriter.Write(p[:b.left])
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// readMockBody reads the body of a request, gunzipping it if it was sent with -gzip
+func readMockBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(r.Body)
+	}
+	z, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	return ioutil.ReadAll(z)
+}
@@ -2,10 +2,10 @@ package commands
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -25,30 +25,37 @@ import (
 type uploadEventsFromMParticle struct {
 }
 
-func (u *uploadEventsFromMParticle) Execute() {
-	log.Println("started")
+func (u *uploadEventsFromMParticle) Execute() error {
+	logger.Println("started")
 	//ct batch size of 100 for MP
 	ctBatchSize = 100
 	var wg sync.WaitGroup
-	done := make(chan interface{})
+	p := startPipeline()
+	defer p.stop()
+	stopProgress := startProgress()
 	if globals.StartDate != nil && *globals.StartDate != "" {
-		batchAndSendToCTAPI(done, processAPIRecordForUpload(done, mparticleEventRecordsGenerator(done,
-			mparticleStartEndDateS3ObjectsGenerator(done))), &wg)
+		batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, mparticleEventRecordsGenerator(p.intake,
+			mparticleStartEndDateS3ObjectsGenerator(p.intake))), &wg)
 	} else {
-		batchAndSendToCTAPI(done, processAPIRecordForUpload(done, mparticleEventRecordsGenerator(done,
-			mparticleAllS3ObjectsGenerator(done))), &wg)
+		batchAndSendToCTAPI(p.ctx, processAPIRecordForUpload(p.ctx, mparticleEventRecordsGenerator(p.intake,
+			mparticleAllS3ObjectsGenerator(p.intake))), &wg)
 	}
 
 	wg.Wait()
-	log.Println("done")
-	log.Println("---------------------Summary---------------------")
-	log.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	stopProgress()
+	logger.Println("done")
+	logger.Println("---------------------Summary---------------------")
+	logger.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
 	if len(Summary.mpParseErrorResponses) > 0 {
-		log.Println("Mparticle Events Parse Error Responses:")
+		logger.Println("Mparticle Events Parse Error Responses:")
 		for _, parseErrorResponse := range Summary.mpParseErrorResponses {
-			log.Println(parseErrorResponse)
+			logger.Println(parseErrorResponse)
 		}
 	}
+	return p.Err()
 }
 
 func buildRequestWithBodyReader(serviceName, region, bucketName, objectName string, body io.Reader) (*http.Request, io.ReadSeeker, error) {
@@ -130,19 +137,22 @@ func (info *mparticleEventRecordInfo) convertToCTAPIFormat() ([]interface{}, err
 		eventData := eventFromMParticle.Data
 		eventNameI, ok := eventData["event_name"]
 		if !ok {
-			log.Printf("Event name missing for record: %v . Skipping", info)
+			logger.Printf("Event name missing for record: %v . Skipping", info)
+			countSkipped("", skipMissingEventName)
 			continue
 		}
 		eventName := eventNameI.(string)
 		if eventName == "" {
-			log.Printf("Event name missing for record: %v . Skipping", info)
+			logger.Printf("Event name missing for record: %v . Skipping", info)
+			countSkipped("", skipMissingEventName)
 			continue
 		}
 		if globals.FilterEventsSet != nil {
 			_, ok := globals.FilterEventsSet[eventName]
 			if ok {
 				//filter event
-				log.Printf("Filtered event: %v.", eventName)
+				logger.Printf("Filtered event: %v.", eventName)
+				countSkipped("", skipFilteredEvent)
 				continue
 			}
 		}
@@ -160,12 +170,14 @@ func (info *mparticleEventRecordInfo) convertToCTAPIFormat() ([]interface{}, err
 		record["evtName"] = eventName
 		tsInterface, ok := eventData["timestamp_unixtime_ms"]
 		if !ok {
-			log.Printf("Time stamp is missing for record: %v . Skipping", info)
+			logger.Printf("Time stamp is missing for record: %v . Skipping", info)
+			countSkipped("", skipMissingTimestamp)
 			continue
 		}
 		ts, err := strconv.ParseInt(tsInterface.(string), 10, 64)
 		if err != nil {
-			log.Printf("Time stamp is in wrong format for record: %v . Skipping", info)
+			logger.Printf("Time stamp is in wrong format for record: %v . Skipping", info)
+			countSkipped("", skipBadTimestamp)
 			continue
 		}
 		record["ts"] = ts / 1000
@@ -187,7 +199,8 @@ func (info *mparticleEventRecordInfo) convertToCTAPIFormat() ([]interface{}, err
 				if ok {
 					record["objectId"] = "-g" + strings.Replace(iosAdID.(string), "-", "", -1)
 				} else {
-					log.Printf("Both user_id and advertising ids are missing for record: %v . Skipping", eventFromMParticle)
+					logger.Printf("Both user_id and advertising ids are missing for record: %v . Skipping", eventFromMParticle)
+					countSkipped("", skipMissingIdentity)
 					continue
 				}
 			}
@@ -258,7 +271,7 @@ func (info *mparticleEventRecordInfo) print() {
 	//fmt.Printf("\nresponse: %v", e.response)
 }
 
-func getCommonPrefixes(svc *s3.S3) ([]string, error) {
+func getCommonPrefixes(ctx context.Context, svc *s3.S3) ([]string, error) {
 	marker := ""
 	commonPrefixes := make([]string, 0)
 	for {
@@ -268,20 +281,24 @@ func getCommonPrefixes(svc *s3.S3) ([]string, error) {
 			Prefix:    aws.String(""),
 			Delimiter: aws.String("/"),
 		}
-		result, err := svc.ListObjects(input)
+		var result *s3.ListObjectsOutput
+		err := retryS3(ctx, "mParticle S3 listing", func() (err error) {
+			result, err = svc.ListObjectsWithContext(ctx, input)
+			return err
+		})
 
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); ok {
 				switch aerr.Code() {
 				case s3.ErrCodeNoSuchBucket:
-					log.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+					logger.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
 				default:
-					log.Println(aerr.Error())
+					logger.Println(aerr.Error())
 				}
 			} else {
 				// Print the error, cast err to awserr.Error to get the Code and
 				// Message from an error.
-				log.Println(err.Error())
+				logger.Println(err.Error())
 			}
 			return nil, err
 		}
@@ -305,7 +322,7 @@ func getCommonPrefixes(svc *s3.S3) ([]string, error) {
 
 //android/2018-10-02
 
-func mparticleStartEndDateS3ObjectsGenerator(done chan interface{}) <-chan []*s3.Object {
+func mparticleStartEndDateS3ObjectsGenerator(ctx context.Context) <-chan []*s3.Object {
 	mparticleObjectsStream := make(chan []*s3.Object)
 	go func() {
 		defer close(mparticleObjectsStream)
@@ -314,20 +331,17 @@ func mparticleStartEndDateS3ObjectsGenerator(done chan interface{}) <-chan []*s3
 		sess, _ := session.NewSession(&aws.Config{
 			Region:      aws.String(*globals.AWSRegion),
 			Credentials: creds,
+			//listings are retried by retryS3
+			MaxRetries: aws.Int(0),
 		},
 		)
 
 		svc := s3.New(sess)
-		prefixes, err := getCommonPrefixes(svc)
+		prefixes, err := getCommonPrefixes(ctx, svc)
 
 		if err != nil {
-			select {
-			case <-done:
-				return
-			default:
-				done <- struct{}{}
-				return
-			}
+			fail(ctx, err)
+			return
 		}
 
 		eventsDate := *globals.StartDate
@@ -337,7 +351,7 @@ func mparticleStartEndDateS3ObjectsGenerator(done chan interface{}) <-chan []*s3
 			endDate = time.Now().Local().Format("2006-01-02")
 		}
 
-		log.Printf("Fetching events with start date: %v and end date: %v ", eventsDate, endDate)
+		logger.Printf("Fetching events with start date: %v and end date: %v ", eventsDate, endDate)
 
 		for _, prefix := range prefixes {
 			//for each prefix
@@ -351,33 +365,32 @@ func mparticleStartEndDateS3ObjectsGenerator(done chan interface{}) <-chan []*s3
 						Marker: aws.String(marker),
 						Prefix: aws.String(prefix + eventsDate),
 					}
-					result, err := svc.ListObjects(input)
+					var result *s3.ListObjectsOutput
+					err := retryS3(ctx, "mParticle S3 listing of "+prefix+eventsDate, func() (err error) {
+						result, err = svc.ListObjectsWithContext(ctx, input)
+						return err
+					})
 
 					if err != nil {
 						if aerr, ok := err.(awserr.Error); ok {
 							switch aerr.Code() {
 							case s3.ErrCodeNoSuchBucket:
-								log.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+								logger.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
 							default:
-								log.Println(aerr.Error())
+								logger.Println(aerr.Error())
 							}
 						} else {
 							// Print the error, cast err to awserr.Error to get the Code and
 							// Message from an error.
-							log.Println(err.Error())
+							logger.Println(err.Error())
 						}
 
-						select {
-						case <-done:
-							return
-						default:
-							done <- struct{}{}
-							return
-						}
+						fail(ctx, err)
+						return
 					}
 
 					select {
-					case <-done:
+					case <-ctx.Done():
 						return
 					case mparticleObjectsStream <- result.Contents:
 					}
@@ -408,7 +421,7 @@ func mparticleStartEndDateS3ObjectsGenerator(done chan interface{}) <-chan []*s3
 	return mparticleObjectsStream
 }
 
-func mparticleAllS3ObjectsGenerator(done chan interface{}) <-chan []*s3.Object {
+func mparticleAllS3ObjectsGenerator(ctx context.Context) <-chan []*s3.Object {
 	mparticleObjectsStream := make(chan []*s3.Object)
 	go func() {
 		defer close(mparticleObjectsStream)
@@ -417,6 +430,8 @@ func mparticleAllS3ObjectsGenerator(done chan interface{}) <-chan []*s3.Object {
 		sess, _ := session.NewSession(&aws.Config{
 			Region:      aws.String(*globals.AWSRegion),
 			Credentials: creds,
+			//listings are retried by retryS3
+			MaxRetries: aws.Int(0),
 		},
 		)
 
@@ -433,34 +448,33 @@ func mparticleAllS3ObjectsGenerator(done chan interface{}) <-chan []*s3.Object {
 				Marker: aws.String(marker),
 				Prefix: aws.String(""),
 			}
-			result, err := svc.ListObjects(input)
+			var result *s3.ListObjectsOutput
+			err := retryS3(ctx, "mParticle S3 listing", func() (err error) {
+				result, err = svc.ListObjectsWithContext(ctx, input)
+				return err
+			})
 
 			if err != nil {
 				if aerr, ok := err.(awserr.Error); ok {
 					switch aerr.Code() {
 					case s3.ErrCodeNoSuchBucket:
-						log.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+						logger.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
 					default:
-						log.Println(aerr.Error())
+						logger.Println(aerr.Error())
 					}
 				} else {
 					// Print the error, cast err to awserr.Error to get the Code and
 					// Message from an error.
-					log.Println(err.Error())
+					logger.Println(err.Error())
 				}
 
-				select {
-				case <-done:
-					return
-				default:
-					done <- struct{}{}
-					return
-				}
+				fail(ctx, err)
+				return
 
 			}
 
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return
 			case mparticleObjectsStream <- result.Contents:
 			}
@@ -479,7 +493,7 @@ func mparticleAllS3ObjectsGenerator(done chan interface{}) <-chan []*s3.Object {
 	return mparticleObjectsStream
 }
 
-func mparticleEventRecordsGenerator(done chan interface{}, inputBucketStream <-chan []*s3.Object) <-chan apiUploadRecordInfo {
+func mparticleEventRecordsGenerator(ctx context.Context, inputBucketStream <-chan []*s3.Object) <-chan apiUploadRecordInfo {
 	mparticleRecordStream := make(chan apiUploadRecordInfo)
 	go func() {
 		defer close(mparticleRecordStream)
@@ -490,25 +504,24 @@ func mparticleEventRecordsGenerator(done chan interface{}, inputBucketStream <-c
 
 		for objects := range inputBucketStream {
 			for _, content := range objects {
-				log.Printf("Processing file %v\n", *content.Key)
+				logger.Printf("Processing file %v\n", *content.Key)
+				retries := newRetrier(ctx, "mParticle S3 download of "+*content.Key)
 				for {
 					req, body, err := buildRequest("s3", *globals.AWSRegion, *globals.S3Bucket,
 						*content.Key, "")
 					if err != nil {
-						log.Fatal(err)
-						select {
-						case <-done:
-							return
-						default:
-							done <- struct{}{}
-							return
-						}
+						fail(ctx, err)
+						return
 					}
 					signer.Sign(req, body, "s3", *globals.AWSRegion, time.Now())
 					client := &http.Client{}
-					resp, err := client.Do(req)
+					resp, err := client.Do(req.WithContext(ctx))
+					var input io.Reader
+					if err == nil && resp.StatusCode < 300 {
+						input, err = decompressInput(resp.Body, *content.Key)
+					}
 					if err == nil && resp.StatusCode < 300 {
-						scanner := bufio.NewScanner(resp.Body)
+						scanner := bufio.NewScanner(input)
 						buf := make([]byte, 0, 64*1024)
 						scanner.Buffer(buf, 20*1024*1024)
 						scanner.Split(ScanCRLF)
@@ -521,20 +534,14 @@ func mparticleEventRecordsGenerator(done chan interface{}, inputBucketStream <-c
 							//customAttributes := info.Events[0].Data["custom_attributes"].(map[string]interface{})
 							//fmt.Println("user id: ", customAttributes["user_id"])
 							select {
-							case <-done:
+							case <-ctx.Done():
 								return
 							case mparticleRecordStream <- info:
 							}
 						}
 						if err := scanner.Err(); err != nil {
-							log.Fatal(err)
-							select {
-							case <-done:
-								return
-							default:
-								done <- struct{}{}
-								return
-							}
+							fail(ctx, err)
+							return
 						}
 
 						resp.Body.Close()
@@ -543,17 +550,18 @@ func mparticleEventRecordsGenerator(done chan interface{}, inputBucketStream <-c
 
 					}
 					if err != nil {
-						log.Println("Error while fetching events data from Mparticle ", err)
-						log.Printf("retrying after 20 seconds for file: %v", *content.Key)
+						logger.Println("Error while fetching events data from Mparticle ", err)
 					} else {
 						body, _ := ioutil.ReadAll(resp.Body)
-						log.Println("response body: ", string(body))
-						log.Printf("retrying after 20 seconds for file: %v", *content.Key)
+						logger.Println("response body: ", string(body))
 					}
 					if resp != nil {
 						resp.Body.Close()
 					}
-					time.Sleep(20 * time.Second)
+					if err := retries.backoff(resp); err != nil {
+						fail(ctx, err)
+						return
+					}
 				}
 			}
 		}
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	errInterrupted = errors.New("interrupted, in-flight batches were flushed")
+	errStopped     = errors.New("stopped, in-flight batches were not flushed")
+)
+
+type pipelineKey struct{}
+
+// pipeline holds the contexts shared by the stages of a run. Generators read their input until intake is done,
+// the stages after them until ctx is done. A fatal error in any stage cancels ctx, and with it intake, so the whole
+// pipeline stops. Stopping only intake lets the later stages drain and flush the batches they hold.
+type pipeline struct {
+	sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	intake     context.Context
+	stopIntake context.CancelFunc
+	err        error
+	interrupts int
+	signals    chan os.Signal
+}
+
+func newPipeline(parent context.Context) *pipeline {
+	p := &pipeline{}
+	p.ctx, p.cancel = context.WithCancel(context.WithValue(parent, pipelineKey{}, p))
+	p.intake, p.stopIntake = context.WithCancel(p.ctx)
+	return p
+}
+
+// startPipeline starts a pipeline for a command line run. The first SIGINT or SIGTERM stops intake so that the
+// batches in flight are flushed and the summary is written, a second one stops the pipeline right away.
+func startPipeline() *pipeline {
+	p := newPipeline(context.Background())
+	p.signals = make(chan os.Signal, 2)
+	signal.Notify(p.signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case sig := <-p.signals:
+				p.Lock()
+				p.interrupts++
+				first := p.interrupts == 1
+				p.Unlock()
+				if first {
+					logger.Printf("Received %v, finishing in-flight batches. Send it again to stop right away", sig)
+					p.stopIntake()
+				} else {
+					logger.Printf("Received %v again, stopping", sig)
+					p.cancel()
+				}
+			}
+		}
+	}()
+	return p
+}
+
+// stop releases the signal handlers and the contexts of the pipeline
+func (p *pipeline) stop() {
+	if p.signals != nil {
+		signal.Stop(p.signals)
+	}
+	p.cancel()
+}
+
+// fail records the first fatal error and stops the pipeline
+func (p *pipeline) fail(err error) {
+	p.Lock()
+	if p.err == nil {
+		p.err = err
+		logger.Println("Fatal error, stopping:", err)
+	}
+	p.Unlock()
+	p.cancel()
+}
+
+// Err returns the fatal error of the run, or errInterrupted or errStopped if it was stopped by signals
+func (p *pipeline) Err() error {
+	p.Lock()
+	defer p.Unlock()
+	switch {
+	case p.err != nil:
+		return p.err
+	case p.interrupts > 1:
+		return errStopped
+	case p.interrupts == 1:
+		return errInterrupted
+	}
+	return nil
+}
+
+// fail stops the pipeline that ctx belongs to because of a fatal error in one of its stages. A generator whose
+// intake was stopped by a signal gets errors from the reads and listings it had in flight, those end its input
+// rather than the run, so that the later stages still flush their batches.
+func fail(ctx context.Context, err error) {
+	if p, ok := ctx.Value(pipelineKey{}).(*pipeline); ok {
+		if intakeStopped(ctx) {
+			logger.Printf("Stopped reading input: %v", err)
+			return
+		}
+		p.fail(err)
+		return
+	}
+	logger.Fatal(err)
+}
+
+// intakeStopped tells whether ctx is the intake of a pipeline that was stopped by a signal while the rest of the
+// pipeline is still running
+func intakeStopped(ctx context.Context) bool {
+	p, ok := ctx.Value(pipelineKey{}).(*pipeline)
+	return ok && ctx.Err() != nil && p.ctx.Err() == nil
+}
@@ -2,8 +2,10 @@ package commands
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
-	"os"
+	"fmt"
+	"runtime"
 	"strings"
 	"sync"
 
@@ -11,15 +13,13 @@ import (
 
 	"strconv"
 
-	"log"
-
-	"encoding/csv"
-
 	"github.com/ankit-arora/clevertap-data-upload/globals"
 )
 
+// paths of the upload API and the SDK endpoint on the hosts of a region
 const (
-	uploadEndpoint = "api.clevertap.com/1/upload"
+	uploadPath    = "/1/upload"
+	sdkUploadPath = "/a1"
 )
 
 var apiConcurrency = 3
@@ -30,72 +30,204 @@ var ctBatchSize = 1000
 type uploadEventsProfilesFromCSVCommand struct {
 }
 
-func (u *uploadEventsProfilesFromCSVCommand) Execute() {
-	log.Println("started")
+func (u *uploadEventsProfilesFromCSVCommand) Execute() error {
+	logger.Println("started")
 
-	done := make(chan interface{})
+	if *globals.CheckpointFilePath != "" {
+		if err := initCheckpoint(); err != nil {
+			return fmt.Errorf("error reading checkpoint file: %v", err)
+		}
+	}
+
+	p := startPipeline()
+	defer p.stop()
 
 	var wg sync.WaitGroup
+	stopProgress := startProgress()
 
-	if *globals.CSVFilePath != "" {
-		batchAndSendToCTAPI(done, processCSVLineForUpload(done, csvLineGenerator(done)), &wg)
+	if len(globals.CSVFiles) > 0 {
+		batchAndSendToCTAPI(p.ctx, processCSVLineForUpload(p.ctx, csvLineGenerator(p.intake)), &wg)
 	}
 
-	if *globals.JSONFilePath != "" {
-		batchAndSendToCTAPI(done, jsonLineGenerator(done), &wg)
+	if len(globals.JSONFiles) > 0 {
+		batchAndSendToCTAPI(p.ctx, jsonLineGenerator(p.intake), &wg)
 	}
 
 	wg.Wait()
+	checkpoint.flush()
+	stopProgress()
 
-	log.Println("done")
+	logger.Println("done")
 
-	log.Println("---------------------Summary---------------------")
+	logger.Println("---------------------Summary---------------------")
 	if *globals.Type == "profile" {
-		log.Printf("Profiles Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+		logger.Printf("Profiles Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
 	} else {
-		log.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
+		logger.Printf("Events Processed: %v , Unprocessed: %v", Summary.ctProcessed, Summary.ctUnprocessed)
 	}
+	logDeadLetterSummary()
+	logRetrySummary()
+	writeReport()
+	return p.Err()
 }
 
-func jsonLineGenerator(done chan interface{}) <-chan interface{} {
-	recordStream := make(chan interface{})
+func jsonLineGenerator(ctx context.Context) <-chan ctRecordInfo {
+	recordStream := make(chan ctRecordInfo)
 	go func() {
 		defer close(recordStream)
-		//read json file
-		file, err := os.Open(*globals.JSONFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Split(ScanCRLF)
-		for scanner.Scan() {
-			s := scanner.Text()
-			s = strings.Trim(s, " \n \r")
-			var jsonData interface{}
-			err = json.NewDecoder(strings.NewReader(s)).Decode(&jsonData)
-			if err != nil {
-				log.Printf("Error in processing json record: %s : %s\n", s, err)
-			} else {
-				select {
-				case <-done:
-					return
-				case recordStream <- jsonData:
-				}
+		trackInputFiles(globals.JSONFiles)
+		for filePath := range inputPaths(ctx, globals.JSONFiles) {
+			if !readJSONFile(ctx, filePath, recordStream) {
+				return
 			}
 		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
 	}()
 	return recordStream
 }
 
+// readJSONFile sends the records of a json file on recordStream. It returns false if the pipeline stops.
+func readJSONFile(ctx context.Context, filePath string, recordStream chan<- ctRecordInfo) bool {
+	if severalInputs() {
+		logger.Printf("Reading json file: %v", filePath)
+	}
+	//read json file
+	file, err := openInput(ctx, filePath)
+	if err != nil {
+		fail(ctx, err)
+		return false
+	}
+	defer file.Close()
+	input, err := decompressSingleFileInput(file, filePath)
+	if err != nil {
+		fail(ctx, err)
+		return false
+	}
+	br := bufio.NewReader(input)
+	if startsWithArray(br) {
+		return readJSONArray(ctx, filePath, br, recordStream)
+	}
+	resumeFrom := checkpoint.resumeLine(filePath)
+	if resumeFrom >= 0 {
+		logger.Printf("Resuming %v after line number: %v", filePath, resumeFrom+1)
+	}
+	scanner := bufio.NewScanner(br)
+	scanner.Split(ScanCRLF)
+	i := 0
+	for scanner.Scan() {
+		lineNum := i
+		i++
+		if lineNum <= resumeFrom {
+			continue
+		}
+		s := scanner.Text()
+		s = strings.Trim(s, " \n \r")
+		if s == "" {
+			checkpoint.markDone(filePath, lineNum)
+			continue
+		}
+		if !processJSONRecord(ctx, s, filePath, lineNum, recordStream) {
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(ctx, err)
+		return false
+	}
+	return true
+}
+
+// startsWithArray tells whether the first character of a json file, after white space, opens an array
+func startsWithArray(br *bufio.Reader) bool {
+	for n := 1; n <= br.Size(); n++ {
+		b, _ := br.Peek(n)
+		if len(b) < n {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[n-1] == '['
+	}
+	return false
+}
+
+// readJSONArray sends the records of a json file holding one array of records, decoding one element at a time so
+// that the array is never held in memory. Elements take the place of lines in the checkpoint and the report.
+func readJSONArray(ctx context.Context, filePath string, br *bufio.Reader, recordStream chan<- ctRecordInfo) bool {
+	resumeFrom := checkpoint.resumeLine(filePath)
+	if resumeFrom >= 0 {
+		logger.Printf("Resuming %v after array element: %v", filePath, resumeFrom+1)
+	}
+	decoder := json.NewDecoder(br)
+	if _, err := decoder.Token(); err != nil {
+		fail(ctx, fmt.Errorf("error in reading json array of %v: %v", filePath, err))
+		return false
+	}
+	i := 0
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			fail(ctx, fmt.Errorf("error in reading json array of %v at element %v: %v", filePath, i+1, err))
+			return false
+		}
+		lineNum := i
+		i++
+		if lineNum <= resumeFrom {
+			continue
+		}
+		if !processJSONRecord(ctx, string(element), filePath, lineNum, recordStream) {
+			return false
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		fail(ctx, fmt.Errorf("error in reading json array of %v after element %v: %v", filePath, i, err))
+		return false
+	}
+	return true
+}
+
+// processJSONRecord decodes a json record, maps it with -jsonMapping if it is set, and sends it on. It returns false
+// if the pipeline stops.
+func processJSONRecord(ctx context.Context, s string, filePath string, lineNum int, recordStream chan<- ctRecordInfo) bool {
+	countRead(filePath)
+	var jsonData interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	if globals.JSONMapping != nil {
+		decoder.UseNumber()
+	}
+	if err := decoder.Decode(&jsonData); err != nil {
+		logger.Printf("Error in processing json record%v: %s : %s\n", fileLabel(filePath), s, err)
+		countSkipped(filePath, skipJSONParseError)
+		checkpoint.markDone(filePath, lineNum)
+		return true
+	}
+	if globals.JSONMapping != nil {
+		record, skipReason := mapJSONRecord(jsonData, s)
+		if skipReason != "" {
+			logger.Printf("Skipping json record%v : %s", fileLabel(filePath), s)
+			countSkipped(filePath, skipReason)
+			checkpoint.markDone(filePath, lineNum)
+			return true
+		}
+		jsonData = record
+	}
+	countConverted(1)
+	select {
+	case <-ctx.Done():
+		return false
+	case recordStream <- ctRecordInfo{Record: jsonData, Source: filePath, LineNum: lineNum}:
+	}
+	return true
+}
+
 //identity, objectID, FBID or GPID
 
-var headerKeys []string
-var keysLen int
-var tsExists = false
+// csvHeader holds the keys of a csv file, each file is converted with its own header
+type csvHeader struct {
+	keys     []string
+	tsExists bool
+}
 
 func isIdentity(val string) bool {
 	if val == "identity" || val == "objectId" || val == "FBID" || val == "GPID" {
@@ -128,9 +260,10 @@ func cleanKeys(keys []string) []string {
 	return cleanKeys
 }
 
-func processHeader(keys []string) bool {
+func processHeader(keys []string) (*csvHeader, bool) {
 	keys = cleanKeys(keys)
 	identityExists := false
+	tsExists := false
 
 	for _, val := range keys {
 		if isIdentity(val) {
@@ -140,50 +273,59 @@ func processHeader(keys []string) bool {
 			tsExists = true
 		}
 	}
-	if !identityExists {
-		log.Println("identity, objectID, FBID or GPID should be present")
-		return false
+	if !identityExists && !transformsSetIdentity() {
+		logger.Println("identity, objectID, FBID or GPID should be present")
+		return nil, false
 	}
 
 	if !tsExists {
-		log.Println("ts is missing. It will default to the current timestamp")
+		logger.Println("ts is missing. It will default to the current timestamp")
 	}
-	keysLen = len(keys)
-	headerKeys = keys
-	return true
+	return &csvHeader{keys: keys, tsExists: tsExists}, true
 }
 
-func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
+// processCSVUploadLine converts a csv row to a CleverTap record with the header of its file. It returns the reason
+// the row is skipped, or an empty reason for a valid row.
+func processCSVUploadLine(header *csvHeader, vals []string, line string) (interface{}, string) {
+	return convertRow(header, vals, nil, *globals.Type, *globals.EvtName, line)
+}
+
+// convertRow converts the values of a row to a record of type recType, named evtName if it is an event. raw holds
+// the typed values of a row mapped from json, nil for csv, which are kept for properties the schema does not type.
+func convertRow(header *csvHeader, vals []string, raw []interface{}, recType, evtName, line string) (interface{}, string) {
 	rowLen := len(vals)
-	if rowLen != keysLen {
-		log.Println("Mismatch in header and row data length")
-		return nil, false
+	if rowLen != len(header.keys) {
+		logger.Println("Mismatch in header and row data length")
+		return nil, skipHeaderMismatch
 	}
 	record := make(map[string]interface{})
-	if !tsExists {
+	if !header.tsExists {
 		record["ts"] = time.Now().Unix()
 	}
-	record["type"] = *globals.Type
-	if *globals.Type == "event" {
-		record["evtName"] = *globals.EvtName
+	record["type"] = recType
+	if recType == "event" {
+		record["evtName"] = evtName
 	}
 	propertyData := make(map[string]interface{})
 
 	for index, ep := range vals {
-		key := headerKeys[index]
+		key := header.keys[index]
+		if globals.CSVNullSet[ep] {
+			ep = ""
+		}
 		if isIdentity(key) {
 			if ep == "" {
-				log.Println("Identity field is missing.")
-				return nil, false
+				logger.Println("Identity field is missing.")
+				return nil, skipMissingIdentity
 			}
 			record[key] = ep
 			continue
 		}
 
-		if key == "evtName" && *globals.Type == "event" {
-			if ep != *globals.EvtName {
-				log.Println("Event name in record is different from command line option.")
-				return nil, false
+		if key == "evtName" && recType == "event" {
+			if ep != evtName {
+				logger.Println("Event name in record is different from command line option.")
+				return nil, skipEventNameMismatch
 			}
 			continue
 		}
@@ -191,8 +333,8 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 		if key == "ts" {
 			epTs := time.Now().Unix()
 			if ep == "" {
-				log.Println("Timestamp is missing. It will default to the current timestamp for: ")
-				log.Println(line)
+				logger.Println("Timestamp is missing. It will default to the current timestamp for: ")
+				logger.Println(line)
 				record["ts"] = epTs
 				continue
 			}
@@ -207,8 +349,8 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 						split := strings.Split(dataType, "$")
 						t, err := time.Parse(split[1], tsVal+" "+split[2])
 						if err != nil {
-							log.Println("Timestamp is in wrong format. Should be in " + dataType)
-							return nil, false
+							logger.Println("Timestamp is in wrong format. Should be in " + dataType)
+							return nil, skipBadTimestamp
 						}
 						epTs = t.Unix()
 					}
@@ -217,8 +359,8 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 				epI, err := strconv.Atoi(tsVal)
 
 				if err != nil {
-					log.Println("Timestamp is in wrong format. Should be an epoch in seconds")
-					return nil, false
+					logger.Println("Timestamp is in wrong format. Should be an epoch in seconds")
+					return nil, skipBadTimestamp
 				}
 
 				epTs = int64(epI)
@@ -228,7 +370,7 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 			continue
 		}
 
-		if *globals.Type == "profile" && ep == "" {
+		if recType == "profile" && ep == "" {
 			continue
 		}
 
@@ -263,11 +405,16 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 						propertyData[key] = v
 					}
 				}
-				if *globals.Type == "profile" {
+				if recType == "profile" {
 					if dataType == "string[]" {
 
 						addArray := make(map[string][]string)
 						result := strings.Split(ep, ",")
+						if raw != nil {
+							if items, ok := raw[index].([]interface{}); ok {
+								result = jsonStrings(items)
+							}
+						}
 						for i := range result {
 							addArray["$add"] = append(addArray["$add"], strings.TrimSpace(result[i]))
 						}
@@ -282,74 +429,120 @@ func processCSVUploadLine(vals []string, line string) (interface{}, bool) {
 		}
 		_, ok := propertyData[key]
 		if !ok {
-			propertyData[key] = ep
+			if raw != nil && raw[index] != nil {
+				propertyData[key] = raw[index]
+			} else {
+				propertyData[key] = ep
+			}
 		}
 	}
 
-	if *globals.Type == "event" {
+	if recType == "event" {
 		record["evtData"] = propertyData
 	}
-	if *globals.Type == "profile" {
+	if recType == "profile" {
 		record["profileData"] = propertyData
 	}
 
-	return record, true
+	return record, ""
 }
 
-func processCSVLineForUpload(done chan interface{}, rowStream <-chan csvLineInfo) <-chan interface{} {
-	recordStream := make(chan interface{})
+// processCSVLineForUpload converts the csv rows to CleverTap records in a pool of csvWorkers goroutines. The header
+// of each file is processed before its rows are handed to the workers. Records come out in the order the workers
+// finish them, each with its own file and line number.
+func processCSVLineForUpload(ctx context.Context, rowStream <-chan csvLineInfo) <-chan ctRecordInfo {
+	recordStream := make(chan ctRecordInfo)
+	workers := *globals.CSVWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	lineStream := make(chan csvLineInfo)
 	go func() {
-		defer close(recordStream)
+		defer close(lineStream)
+		var header *csvHeader
+		//a file with a bad header is skipped, the run fails only if no file had a good one
+		var headerErr error
+		validHeaders := 0
 		for lineInfo := range rowStream {
-			i := lineInfo.LineNum
-			l := lineInfo.Line
-			//sLine := strings.Split(l, ",")
-			r := csv.NewReader(strings.NewReader(l))
-			sLineArr, err := r.ReadAll()
-			if err != nil || len(sLineArr) != 1 {
-				if i == 0 {
-					log.Println("Error in processing header")
-					select {
-					case <-done:
-						return
-					default:
-						done <- struct{}{}
-						log.Println("...Exiting...")
-						return
-					}
+			if lineInfo.Header {
+				//header: line just process to get keys
+				var ok bool
+				header, headerErr = nil, nil
+				if lineInfo.Err != nil {
+					headerErr = fmt.Errorf("error in processing header of %v: %v", lineInfo.Source, lineInfo.Err)
+				} else if header, ok = processHeader(lineInfo.Fields); !ok {
+					headerErr = fmt.Errorf("invalid header in %v", lineInfo.Source)
 				}
-				if l != "" {
-					log.Printf("Error in processing record")
-					log.Printf("Skipping line number: %v : %v", i+1, l)
+				if headerErr != nil {
+					logger.Printf("%v, skipping the file", headerErr)
+					reportFileSkipped(lineInfo.Source, headerErr)
+					continue
 				}
+				validHeaders++
+				checkpoint.markDone(lineInfo.Source, lineInfo.LineNum)
 				continue
 			}
-			sLine := sLineArr[0]
-			if i == 0 {
-				//header: line just process to get keys
-				if !processHeader(sLine) {
-					select {
-					case <-done:
-						return
-					default:
-						done <- struct{}{}
-						log.Println("...Exiting...")
-						return
-					}
-				}
-			} else {
-				record, shouldAdd := processCSVUploadLine(sLine, l)
-				if shouldAdd {
-					select {
-					case <-done:
+			if header == nil {
+				//the checkpoint is left alone so that the file is read again once its header is fixed
+				countRead(lineInfo.Source)
+				countSkipped(lineInfo.Source, skipInvalidHeader)
+				continue
+			}
+			lineInfo.fileHeader = header
+			select {
+			case <-ctx.Done():
+				return
+			case lineStream <- lineInfo:
+			}
+		}
+		if validHeaders == 0 && headerErr != nil {
+			fail(ctx, headerErr)
+		}
+	}()
+	go func() {
+		defer close(recordStream)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for lineInfo := range lineStream {
+					if !processCSVLine(ctx, lineInfo, recordStream) {
 						return
-					case recordStream <- record:
 					}
-				} else {
-					log.Println("Skipping line number: ", i+1, " : ", l)
 				}
-			}
+			}()
 		}
+		wg.Wait()
 	}()
 	return recordStream
 }
+
+// processCSVLine converts a row and sends its record on. It returns false if the pipeline stops.
+func processCSVLine(ctx context.Context, lineInfo csvLineInfo, recordStream chan<- ctRecordInfo) bool {
+	i := lineInfo.LineNum
+	l := lineInfo.Line
+	source := lineInfo.Source
+	countRead(source)
+	if lineInfo.Err != nil {
+		logger.Printf("Error in processing record: %v", lineInfo.Err)
+		logger.Printf("Skipping %v%v : %v", lineInfo.lines(), fileLabel(source), l)
+		countSkipped(source, skipCSVParseError)
+		checkpoint.markDone(source, i)
+		return true
+	}
+	record, skipReason := processCSVUploadLine(lineInfo.fileHeader, lineInfo.Fields, l)
+	if skipReason != "" {
+		logger.Printf("Skipping %v%v : %v", lineInfo.lines(), fileLabel(source), l)
+		countSkipped(source, skipReason)
+		checkpoint.markDone(source, i)
+		return true
+	}
+	countConverted(1)
+	select {
+	case <-ctx.Done():
+		return false
+	case recordStream <- ctRecordInfo{Record: record, Source: source, LineNum: i}:
+	}
+	return true
+}
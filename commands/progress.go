@@ -0,0 +1,233 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// progress counts records and requests as they pass through the pipeline stages. The counters are updated for every
+// record, so they are atomic instead of sharing the Summary lock. Processed, unprocessed and retry counts are
+// taken from Summary.
+var progress = struct {
+	start           time.Time
+	read            int64
+	converted       int64
+	skipped         int64
+	batchesInFlight int64
+	batchesSent     int64
+	sdkInFlight     int64
+	sdkSent         int64
+	bytesRead       int64
+	bytesTotal      int64
+	bodyBytes       int64
+	bodyBytesSent   int64
+}{}
+
+// countRead counts a record read from source, which is empty for records that do not come from a file
+func countRead(source string) {
+	atomic.AddInt64(&progress.read, 1)
+	reportRead(source)
+}
+
+func countConverted(n int64) {
+	atomic.AddInt64(&progress.converted, n)
+}
+
+// countSkipped counts a record that is not uploaded, by the reason it was skipped
+func countSkipped(source, reason string) {
+	atomic.AddInt64(&progress.skipped, 1)
+	reportSkipped(source, reason)
+}
+
+// countingReader counts the bytes read from an input file so that the progress line can show an ETA
+type countingReader struct {
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&progress.bytesRead, int64(n))
+	return n, err
+}
+
+// trackInputFile adds the size of file to the input total and returns a reader that counts what is read from it
+func trackInputFile(file *os.File) io.Reader {
+	if info, err := file.Stat(); err == nil {
+		atomic.AddInt64(&progress.bytesTotal, info.Size())
+	}
+	return &countingReader{r: file}
+}
+
+// trackInputFiles adds the sizes of files that are read one after the other to the input total up front, so that
+// the ETA covers all of them
+func trackInputFiles(paths []string) {
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			atomic.AddInt64(&progress.bytesTotal, info.Size())
+		}
+	}
+}
+
+// severalInputs tells whether a run reads several csv or json files, counting each S3 prefix as several
+func severalInputs() bool {
+	for _, path := range append(append([]string{}, globals.CSVFiles...), globals.JSONFiles...) {
+		if globals.IsS3URL(path) {
+			return true
+		}
+	}
+	return len(globals.CSVFiles) > 1 || len(globals.JSONFiles) > 1
+}
+
+// fileLabel names an input file in log lines, it is empty unless several csv or json files are uploaded in a run
+func fileLabel(path string) string {
+	if !severalInputs() {
+		return ""
+	}
+	return " in " + path
+}
+
+type progressSnapshot struct {
+	read, converted, skipped, batchesInFlight, batchesSent, sdkInFlight, sdkSent int64
+	processed, unprocessed, retries, batchesGivenUp                              int64
+	bytesRead, bytesTotal, bodyBytes, bodyBytesSent                              int64
+	elapsed                                                                      time.Duration
+}
+
+func takeProgressSnapshot() progressSnapshot {
+	s := progressSnapshot{
+		read:            atomic.LoadInt64(&progress.read),
+		converted:       atomic.LoadInt64(&progress.converted),
+		skipped:         atomic.LoadInt64(&progress.skipped),
+		batchesInFlight: atomic.LoadInt64(&progress.batchesInFlight),
+		batchesSent:     atomic.LoadInt64(&progress.batchesSent),
+		sdkInFlight:     atomic.LoadInt64(&progress.sdkInFlight),
+		sdkSent:         atomic.LoadInt64(&progress.sdkSent),
+		bytesRead:       atomic.LoadInt64(&progress.bytesRead),
+		bytesTotal:      atomic.LoadInt64(&progress.bytesTotal),
+		bodyBytes:       atomic.LoadInt64(&progress.bodyBytes),
+		bodyBytesSent:   atomic.LoadInt64(&progress.bodyBytesSent),
+		elapsed:         time.Since(progress.start),
+	}
+	Summary.Lock()
+	s.processed = Summary.ctProcessed
+	s.unprocessed = Summary.ctUnprocessed
+	s.retries = Summary.retries
+	s.batchesGivenUp = Summary.batchesGivenUp
+	Summary.Unlock()
+	return s
+}
+
+// eta estimates the time left from the share of the input files read so far. It is only known for file sources.
+func (s progressSnapshot) eta() (time.Duration, bool) {
+	if s.bytesTotal <= 0 || s.bytesRead <= 0 {
+		return 0, false
+	}
+	left := float64(s.bytesTotal-s.bytesRead) / float64(s.bytesRead)
+	return time.Duration(float64(s.elapsed) * left).Round(time.Second), true
+}
+
+// startProgress prints a progress line every -progressInterval and serves the counters on -metricsAddr. The
+// returned function stops the progress line, the metrics endpoint keeps serving until the process exits.
+func startProgress() func() {
+	progress.start = time.Now()
+	if *globals.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		go func() {
+			logger.Printf("Serving metrics on http://%v/metrics", *globals.MetricsAddr)
+			if err := http.ListenAndServe(*globals.MetricsAddr, mux); err != nil {
+				logger.Println("Error serving metrics", err)
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	if *globals.ProgressInterval <= 0 {
+		return func() {}
+	}
+	go func() {
+		ticker := time.NewTicker(*globals.ProgressInterval)
+		defer ticker.Stop()
+		last := takeProgressSnapshot()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s := takeProgressSnapshot()
+				logProgress(s, last)
+				last = s
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+func perSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+func logProgress(s, last progressSnapshot) {
+	interval := s.elapsed - last.elapsed
+	line := fmt.Sprintf("Progress: read %v (%.0f/s) , converted %v , skipped %v , batches in flight %v , "+
+		"processed %v (%.0f/s) , unprocessed %v , retries %v", s.read, perSecond(s.read-last.read, interval),
+		s.converted, s.skipped, s.batchesInFlight+s.sdkInFlight, s.processed,
+		perSecond(s.processed-last.processed, interval), s.unprocessed, s.retries)
+	if eta, ok := s.eta(); ok {
+		line += fmt.Sprintf(" , %.1f%% of input , ETA %v", 100*float64(s.bytesRead)/float64(s.bytesTotal), eta)
+	}
+	logger.Println(line)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s := takeProgressSnapshot()
+	b := &strings.Builder{}
+	metric := func(name, kind, help string, values ...string) {
+		fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+		for _, v := range values {
+			fmt.Fprintf(b, "%v%v\n", name, v)
+		}
+	}
+	metric("clevertap_upload_records_total", "counter", "Records per pipeline stage.",
+		fmt.Sprintf(`{stage="read"} %v`, s.read),
+		fmt.Sprintf(`{stage="converted"} %v`, s.converted),
+		fmt.Sprintf(`{stage="skipped"} %v`, s.skipped),
+		fmt.Sprintf(`{stage="processed"} %v`, s.processed),
+		fmt.Sprintf(`{stage="unprocessed"} %v`, s.unprocessed))
+	metric("clevertap_upload_requests_in_flight", "gauge", "CleverTap requests waiting for a response.",
+		fmt.Sprintf(`{endpoint="api"} %v`, s.batchesInFlight),
+		fmt.Sprintf(`{endpoint="sdk"} %v`, s.sdkInFlight))
+	metric("clevertap_upload_requests_total", "counter", "CleverTap requests completed.",
+		fmt.Sprintf(`{endpoint="api"} %v`, s.batchesSent),
+		fmt.Sprintf(`{endpoint="sdk"} %v`, s.sdkSent))
+	metric("clevertap_upload_retries_total", "counter", "Retried requests.", fmt.Sprintf(" %v", s.retries))
+	metric("clevertap_upload_batches_given_up_total", "counter", "Batches given up on after retrying.",
+		fmt.Sprintf(" %v", s.batchesGivenUp))
+	metric("clevertap_upload_input_bytes_read_total", "counter", "Bytes read from input files.",
+		fmt.Sprintf(" %v", s.bytesRead))
+	metric("clevertap_upload_request_body_bytes_total", "counter", "CleverTap request body bytes, before and after compression.",
+		fmt.Sprintf(`{encoding="identity"} %v`, s.bodyBytes),
+		fmt.Sprintf(`{encoding="sent"} %v`, s.bodyBytesSent))
+	metric("clevertap_upload_input_bytes", "gauge", "Total size of the input files.", fmt.Sprintf(" %v", s.bytesTotal))
+	metric("clevertap_upload_records_per_second", "gauge", "Average records processed per second since the start.",
+		fmt.Sprintf(" %.2f", perSecond(s.processed, s.elapsed)))
+	metric("clevertap_upload_rate_limit_factor", "gauge", "Share of the configured rate allowed after throttling.",
+		fmt.Sprintf(" %.2f", rateLimitFactor()))
+	if eta, ok := s.eta(); ok {
+		metric("clevertap_upload_eta_seconds", "gauge", "Estimated time left for file sources.",
+			fmt.Sprintf(" %.0f", eta.Seconds()))
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
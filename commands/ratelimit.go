@@ -0,0 +1,208 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// on a 429 the rate is cut by throttleFactor, at most once per throttleCooldown
+	throttleFactor   = 0.5
+	throttleCooldown = time.Second
+	// the rate is raised by recoverFactor after every recoverInterval without a 429
+	recoverFactor   = 1.25
+	recoverInterval = 10 * time.Second
+	// the rate is never cut below minRateFactor of the configured rate
+	minRateFactor = 0.02
+)
+
+// tokenBucket holds up to one second of tokens at rate. Takers may drive the balance negative, which reserves the
+// tokens of the coming seconds and makes the next takers wait longer.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket at the rate scaled by factor, takes n tokens and returns how long to wait before
+// using them
+func (b *tokenBucket) take(n, factor float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	rate := b.rate * factor
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	} else {
+		b.tokens = rate
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// rateLimiter is shared by all CleverTap upload API and SDK workers of a target. It limits records and requests per
+// second, and slows down when CleverTap answers with a 429. Without a configured requests limit, the first 429 sets
+// one from the request rate seen so far, which is dropped again once the rate has fully recovered.
+type rateLimiter struct {
+	sync.Mutex
+	target       string
+	records      tokenBucket
+	requests     tokenBucket
+	learned      bool
+	factor       float64
+	lastThrottle time.Time
+	lastRecover  time.Time
+	sent         int64
+	sentSince    time.Time
+}
+
+// limiters holds a rateLimiter per target, each applying the configured limits on its own
+var limiters = struct {
+	sync.Mutex
+	recordsPerSecond  float64
+	requestsPerSecond float64
+	byTarget          map[string]*rateLimiter
+}{byTarget: make(map[string]*rateLimiter)}
+
+// setRateLimits configures the limiters, 0 means no limit. Setting the limits already in place keeps the state of
+// the limiters, so that the API and SDK workers of one run can both apply them.
+func setRateLimits(recordsPerSecond, requestsPerSecond float64) {
+	limiters.Lock()
+	defer limiters.Unlock()
+	if limiters.recordsPerSecond == recordsPerSecond && limiters.requestsPerSecond == requestsPerSecond {
+		return
+	}
+	limiters.recordsPerSecond = recordsPerSecond
+	limiters.requestsPerSecond = requestsPerSecond
+	limiters.byTarget = make(map[string]*rateLimiter)
+}
+
+// limiterFor returns the limiter of a target
+func limiterFor(target string) *rateLimiter {
+	limiters.Lock()
+	defer limiters.Unlock()
+	l, ok := limiters.byTarget[target]
+	if !ok {
+		l = &rateLimiter{
+			target:    target,
+			records:   tokenBucket{rate: limiters.recordsPerSecond},
+			requests:  tokenBucket{rate: limiters.requestsPerSecond},
+			factor:    1,
+			sentSince: time.Now(),
+		}
+		limiters.byTarget[target] = l
+	}
+	return l
+}
+
+// wait blocks until a request with records records may be sent. It returns an error if ctx is done first.
+func (l *rateLimiter) wait(ctx context.Context, records int) error {
+	l.Lock()
+	now := time.Now()
+	l.sent++
+	wait := l.records.take(float64(records), l.factor, now)
+	if w := l.requests.take(1, l.factor, now); w > wait {
+		wait = w
+	}
+	l.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitFactor returns the lowest share of the configured rate the limiters currently allow
+func rateLimitFactor() float64 {
+	limiters.Lock()
+	defer limiters.Unlock()
+	factor := 1.0
+	for _, l := range limiters.byTarget {
+		l.Lock()
+		if l.factor < factor {
+			factor = l.factor
+		}
+		l.Unlock()
+	}
+	return factor
+}
+
+// throttled slows the limiter down after CleverTap answered with a 429
+func (l *rateLimiter) throttled() {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastThrottle) < throttleCooldown {
+		//concurrent requests that were already in flight report the same throttling
+		return
+	}
+	l.lastThrottle = now
+	l.lastRecover = now
+	if l.requests.rate <= 0 {
+		elapsed := now.Sub(l.sentSince).Seconds()
+		if elapsed <= 0 {
+			return
+		}
+		l.requests = tokenBucket{rate: float64(l.sent) / elapsed}
+		l.learned = true
+		l.factor = 1
+	}
+	if l.factor*throttleFactor < minRateFactor {
+		return
+	}
+	l.factor *= throttleFactor
+	logger.Printf("CleverTap is throttling requests%v, slowing down to %.1f requests/s", targetLabel(l.target),
+		l.requests.rate*l.factor)
+}
+
+// notThrottled speeds the limiter back up once CleverTap has not throttled for a while
+func (l *rateLimiter) notThrottled() {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.factor >= 1 || now.Sub(l.lastRecover) < recoverInterval {
+		return
+	}
+	l.lastRecover = now
+	l.factor *= recoverFactor
+	if l.factor < 1 {
+		logger.Printf("CleverTap is not throttling%v, speeding up to %.1f requests/s", targetLabel(l.target),
+			l.requests.rate*l.factor)
+		return
+	}
+	l.factor = 1
+	if l.learned {
+		l.requests = tokenBucket{}
+		l.learned = false
+		logger.Printf("CleverTap is not throttling%v, no longer limiting requests", targetLabel(l.target))
+		return
+	}
+	logger.Printf("CleverTap is not throttling%v, back to %.1f requests/s", targetLabel(l.target), l.requests.rate)
+}
+
+// noteThrottling adjusts the limiter to a CleverTap response, resp is nil if the request failed
+func (l *rateLimiter) noteThrottling(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		l.throttled()
+	} else if resp.StatusCode < 300 {
+		l.notThrottled()
+	}
+}
@@ -0,0 +1,309 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// Reasons a source record is skipped without being uploaded, as grouped in the report
+const (
+	skipCSVParseError      = "CSV parse error"
+	skipHeaderMismatch     = "header mismatch"
+	skipMissingIdentity    = "missing identity"
+	skipBadTimestamp       = "bad timestamp"
+	skipMissingTimestamp   = "missing timestamp"
+	skipEventNameMismatch  = "event name mismatch"
+	skipMissingEventName   = "missing event name"
+	skipBadRecordType      = "bad record type"
+	skipFilteredEvent      = "filtered event"
+	skipJSONParseError     = "JSON parse error"
+	skipDeadLetterBadEntry = "bad dead-letter entry"
+	skipInvalidRecord      = "failed validation"
+	skipInvalidHeader      = "invalid header"
+	skipMissingDeviceID    = "missing device id"
+)
+
+type reportCounts struct {
+	Read        int64 `json:"read,omitempty"`
+	Skipped     int64 `json:"skipped,omitempty"`
+	Uploaded    int64 `json:"uploaded"`
+	Processed   int64 `json:"processed"`
+	Unprocessed int64 `json:"unprocessed"`
+	// Error is why an input file was skipped as a whole
+	Error string `json:"error,omitempty"`
+	// Targets holds the upload counts of an input file per target when uploading to several targets, every target
+	// gets each record read from the file
+	Targets map[string]*reportCounts `json:"targets,omitempty"`
+}
+
+type reportRetries struct {
+	Retries         int64 `json:"retries"`
+	RequestsRetried int64 `json:"requestsRetried"`
+	MaxAttempts     int   `json:"maxAttempts"`
+	BatchesGivenUp  int64 `json:"batchesGivenUp"`
+	// BatchesSplit counts the batches rejected with a 400 that were split to find the records causing it
+	BatchesSplit      int64 `json:"batchesSplit,omitempty"`
+	BadRequestRecords int64 `json:"badRequestRecords,omitempty"`
+}
+
+// reportBytes counts the bytes of the request bodies sent to CleverTap, retries included
+type reportBytes struct {
+	Uncompressed int64 `json:"uncompressed"`
+	Sent         int64 `json:"sent"`
+}
+
+//{"subcommand":"upload csv","start":"...","end":"...","parameters":{"id":"XXX","p":"REDACTED"},
+//"totals":{...},"byType":{"event":{...}},"byEvent":{"Charged":{...}},"skipped":{"missing identity":2},
+//"errors":{"Phone number not in E.164 format":1},"retries":{...},"files":{"/data/events.csv":{...}}}
+
+type runReport struct {
+	Subcommand      string                   `json:"subcommand"`
+	Start           time.Time                `json:"start"`
+	End             time.Time                `json:"end"`
+	DurationSeconds float64                  `json:"durationSeconds"`
+	Parameters      map[string]string        `json:"parameters"`
+	Totals          reportCounts             `json:"totals"`
+	Converted       int64                    `json:"converted"`
+	SDKRequests     int64                    `json:"sdkRequests,omitempty"`
+	ByType          map[string]*reportCounts `json:"byType"`
+	ByEvent         map[string]*reportCounts `json:"byEvent,omitempty"`
+	Skipped         map[string]int64         `json:"skipped"`
+	Errors          map[string]int64         `json:"errors"`
+	Retries         reportRetries            `json:"retries"`
+	BytesSent       *reportBytes             `json:"bytesSent,omitempty"`
+	DeadLetterFile  string                   `json:"deadLetterFile,omitempty"`
+	Files           map[string]*reportCounts `json:"files,omitempty"`
+	// Targets holds the counts per account when uploading to several targets, the other counts sum them up
+	Targets map[string]*targetCounts `json:"targets,omitempty"`
+	// Validation holds the issues found by -validate per check
+	Validation map[string]*validationCounts `json:"validation,omitempty"`
+}
+
+// report collects the breakdowns of the end-of-run report that the Summary and progress counters do not have
+var report = struct {
+	sync.Mutex
+	byType          map[string]*reportCounts
+	byEvent         map[string]*reportCounts
+	files           map[string]*reportCounts
+	skipped         map[string]int64
+	errors          map[string]int64
+	requestsRetried int64
+	maxAttempts     int
+}{
+	byType:  make(map[string]*reportCounts),
+	byEvent: make(map[string]*reportCounts),
+	files:   make(map[string]*reportCounts),
+	skipped: make(map[string]int64),
+	errors:  make(map[string]int64),
+}
+
+func reportCountsFor(m map[string]*reportCounts, key string) *reportCounts {
+	c, ok := m[key]
+	if !ok {
+		c = &reportCounts{}
+		m[key] = c
+	}
+	return c
+}
+
+// fileCounts returns the upload counts of the input file of r, those of its target when uploading to several
+// targets. Called with report locked.
+func fileCounts(r ctRecordInfo) *reportCounts {
+	c := reportCountsFor(report.files, r.Source)
+	if len(globals.Targets) < 2 {
+		return c
+	}
+	if c.Targets == nil {
+		c.Targets = make(map[string]*reportCounts)
+	}
+	return reportCountsFor(c.Targets, r.Target)
+}
+
+// recordKeys returns the type and, for events, the event name of a record in the CleverTap upload API format
+func recordKeys(record interface{}) (string, string) {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return "unknown", ""
+	}
+	recordType, _ := m["type"].(string)
+	if recordType == "" {
+		recordType = "unknown"
+	}
+	evtName, _ := m["evtName"].(string)
+	return recordType, evtName
+}
+
+func reportRead(source string) {
+	if source == "" {
+		return
+	}
+	report.Lock()
+	reportCountsFor(report.files, source).Read++
+	report.Unlock()
+}
+
+func reportSkipped(source, reason string) {
+	report.Lock()
+	defer report.Unlock()
+	report.skipped[reason]++
+	if source != "" {
+		reportCountsFor(report.files, source).Skipped++
+	}
+}
+
+// reportFileSkipped records why the records of an input file were all skipped
+func reportFileSkipped(source string, err error) {
+	report.Lock()
+	defer report.Unlock()
+	reportCountsFor(report.files, source).Error = err.Error()
+}
+
+// reportUploaded counts the records of a batch that got an answer from CleverTap, or was given up on
+func reportUploaded(batch []ctRecordInfo) {
+	report.Lock()
+	defer report.Unlock()
+	for _, r := range batch {
+		recordType, evtName := recordKeys(r.Record)
+		reportCountsFor(report.byType, recordType).Uploaded++
+		if evtName != "" {
+			reportCountsFor(report.byEvent, evtName).Uploaded++
+		}
+		if r.Source != "" {
+			fileCounts(r).Uploaded++
+		}
+	}
+}
+
+// reportRejected counts a record that CleverTap did not process, by error message
+func reportRejected(r ctRecordInfo, errMsg string) {
+	if errMsg == "" {
+		errMsg = "unknown error"
+	}
+	report.Lock()
+	defer report.Unlock()
+	report.errors[errMsg]++
+	recordType, evtName := recordKeys(r.Record)
+	reportCountsFor(report.byType, recordType).Unprocessed++
+	if evtName != "" {
+		reportCountsFor(report.byEvent, evtName).Unprocessed++
+	}
+	if r.Source != "" {
+		fileCounts(r).Unprocessed++
+	}
+}
+
+func reportRetry(attempt int) {
+	report.Lock()
+	defer report.Unlock()
+	if attempt == 1 {
+		report.requestsRetried++
+	}
+	if attempt+1 > report.maxAttempts {
+		report.maxAttempts = attempt + 1
+	}
+}
+
+func withProcessed(m map[string]*reportCounts) map[string]*reportCounts {
+	for _, c := range m {
+		c.Processed = c.Uploaded - c.Unprocessed
+		withProcessed(c.Targets)
+	}
+	return m
+}
+
+// logFileSummary logs the counts of each input file, when records were read from several files
+func logFileSummary() {
+	report.Lock()
+	defer report.Unlock()
+	if len(report.files) < 2 {
+		return
+	}
+	files := make([]string, 0, len(report.files))
+	for file := range report.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		c := report.files[file]
+		if c.Targets == nil {
+			logger.Printf("File %v: Read: %v , Skipped: %v , Processed: %v , Unprocessed: %v", file, c.Read, c.Skipped,
+				c.Uploaded-c.Unprocessed, c.Unprocessed)
+			continue
+		}
+		logger.Printf("File %v: Read: %v , Skipped: %v", file, c.Read, c.Skipped)
+		for _, t := range globals.Targets {
+			if tc, ok := c.Targets[t.Name]; ok {
+				logger.Printf("File %v, target %v: Processed: %v , Unprocessed: %v", file, t.Name,
+					tc.Uploaded-tc.Unprocessed, tc.Unprocessed)
+			}
+		}
+	}
+}
+
+// writeReport writes the JSON report of the run to -report, if set
+func writeReport() {
+	if *globals.ReportFilePath == "" {
+		return
+	}
+	s := takeProgressSnapshot()
+	r := &runReport{
+		Subcommand:      globals.Subcommand,
+		Start:           progress.start,
+		End:             time.Now(),
+		DurationSeconds: s.elapsed.Seconds(),
+		Parameters:      globals.Parameters(),
+		Totals: reportCounts{
+			Read:        s.read,
+			Skipped:     s.skipped,
+			Processed:   s.processed,
+			Unprocessed: s.unprocessed,
+		},
+		Converted:      s.converted,
+		SDKRequests:    s.sdkSent,
+		DeadLetterFile: *globals.DeadLetterFilePath,
+	}
+	report.Lock()
+	for _, c := range report.byType {
+		r.Totals.Uploaded += c.Uploaded
+	}
+	r.ByType = withProcessed(report.byType)
+	r.ByEvent = withProcessed(report.byEvent)
+	r.Files = withProcessed(report.files)
+	r.Skipped = report.skipped
+	r.Errors = report.errors
+	r.Retries = reportRetries{
+		Retries:         s.retries,
+		RequestsRetried: report.requestsRetried,
+		MaxAttempts:     report.maxAttempts,
+		BatchesGivenUp:  s.batchesGivenUp,
+	}
+	r.Targets = targetReport()
+	if s.bodyBytesSent > 0 {
+		r.BytesSent = &reportBytes{Uncompressed: s.bodyBytes, Sent: s.bodyBytesSent}
+	}
+	validation.Lock()
+	if validation.checked > 0 {
+		r.Validation = validation.issues
+	}
+	validation.Unlock()
+	Summary.Lock()
+	r.Retries.BatchesSplit = Summary.batchesSplit
+	r.Retries.BadRequestRecords = Summary.badRequestRecords
+	Summary.Unlock()
+	b, err := json.MarshalIndent(r, "", "  ")
+	report.Unlock()
+	if err != nil {
+		logger.Println("Error building report", err)
+		return
+	}
+	if err := ioutil.WriteFile(*globals.ReportFilePath, append(b, '\n'), 0644); err != nil {
+		logger.Println("Error writing report", err)
+		return
+	}
+	logger.Printf("Report written to: %v", *globals.ReportFilePath)
+}
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// retrier applies the retry policy from the command line to one logical request: exponential backoff with jitter
+// starting at -retryBaseDelay and capped at -retryMaxDelay, Retry-After on 429 and 503, and a budget of
+// -retryMaxAttempts attempts and -retryMaxTime total time after which the request is given up on.
+type retrier struct {
+	ctx     context.Context
+	what    string
+	attempt int
+	start   time.Time
+}
+
+// newRetrier starts the retry budget of a request. Waiting for the next attempt ends early when ctx is done.
+func newRetrier(ctx context.Context, what string) *retrier {
+	return &retrier{ctx: ctx, what: what, start: time.Now()}
+}
+
+// reset starts a fresh budget, used by fetchers that reuse one retrier for consecutive pages
+func (r *retrier) reset() {
+	r.attempt = 0
+	r.start = time.Now()
+}
+
+func logRetrySummary() {
+	Summary.Lock()
+	defer Summary.Unlock()
+	if Summary.retries > 0 || Summary.batchesGivenUp > 0 {
+		logger.Printf("Retries: %v , Batches given up: %v", Summary.retries, Summary.batchesGivenUp)
+	}
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// backoff sleeps before the next attempt. resp is the failed response, if any, and is only used for its
+// Retry-After header. It returns an error once the attempt or time budget is spent.
+func (r *retrier) backoff(resp *http.Response) error {
+	r.attempt++
+	if *globals.RetryMaxAttempts > 0 && r.attempt >= *globals.RetryMaxAttempts {
+		return fmt.Errorf("%v: giving up after %v attempts in %v", r.what, r.attempt,
+			time.Since(r.start).Round(time.Second))
+	}
+	delay := r.delay(resp)
+	if *globals.RetryMaxTime > 0 && time.Since(r.start)+delay > *globals.RetryMaxTime {
+		return fmt.Errorf("%v: giving up after %v attempts, retry time limit of %v reached", r.what, r.attempt,
+			*globals.RetryMaxTime)
+	}
+	Summary.Lock()
+	Summary.retries++
+	Summary.Unlock()
+	reportRetry(r.attempt)
+	logger.Printf("%v: retrying after %v (attempt %v)", r.what, delay.Round(time.Millisecond), r.attempt+1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.ctx.Done():
+		return fmt.Errorf("%v: %v", r.what, r.ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *retrier) delay(resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+	d := *globals.RetryBaseDelay
+	for i := 1; i < r.attempt && d < *globals.RetryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > *globals.RetryMaxDelay {
+		d = *globals.RetryMaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	//equal jitter: half of the delay is fixed, the other half random
+	jitter.Lock()
+	j := time.Duration(jitter.Int63n(int64(d)/2 + 1))
+	jitter.Unlock()
+	return d/2 + j
+}
+
+//Retry-After: 120
+//Retry-After: Wed, 21 Oct 2015 07:28:00 GMT
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
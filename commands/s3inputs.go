@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultS3Region is used for s3:// inputs without -awsRegion
+const defaultS3Region = "us-east-1"
+
+// s3Inputs lists and signs the requests of s3:// inputs. It uses -awsAccessKeyID and -awsSecretAccessKey, or the
+// credentials of the environment without them, and -s3Endpoint with path style addressing if it is set. The client
+// is set up again when the options change between runs of the library.
+var s3Inputs = struct {
+	sync.Mutex
+	options string
+	svc     *s3.S3
+	signer  *v4.Signer
+	region  string
+}{}
+
+func initS3Inputs() error {
+	s3Inputs.Lock()
+	defer s3Inputs.Unlock()
+	options := strings.Join([]string{*globals.AWSRegion, *globals.AWSAccessKeyID, *globals.AWSSecretAccessKey,
+		*globals.S3Endpoint}, "\n")
+	if s3Inputs.svc != nil && s3Inputs.options == options {
+		return nil
+	}
+	region := *globals.AWSRegion
+	if region == "" {
+		region = defaultS3Region
+	}
+	//listings are retried by retryS3
+	config := &aws.Config{Region: aws.String(region), MaxRetries: aws.Int(0)}
+	if *globals.AWSAccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(*globals.AWSAccessKeyID,
+			*globals.AWSSecretAccessKey, "")
+	}
+	if *globals.S3Endpoint != "" {
+		config.Endpoint = aws.String(*globals.S3Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return fmt.Errorf("error setting up S3 access: %v", err)
+	}
+	s3Inputs.options = options
+	s3Inputs.region = region
+	s3Inputs.svc = s3.New(sess)
+	s3Inputs.signer = v4.NewSigner(sess.Config.Credentials)
+	//object URLs are escaped once, the way S3 expects them
+	s3Inputs.signer.DisableURIPathEscaping = true
+	return nil
+}
+
+// splitS3URL returns the bucket and the key or prefix of s3://bucket/prefix
+func splitS3URL(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// inputPaths streams paths, with each s3://bucket/prefix replaced by the objects under it in key order. Objects are
+// listed a page at a time, so uploading starts before a large prefix is listed in full.
+func inputPaths(ctx context.Context, paths []string) <-chan string {
+	pathStream := make(chan string)
+	go func() {
+		defer close(pathStream)
+		for _, path := range paths {
+			if !globals.IsS3URL(path) {
+				select {
+				case <-ctx.Done():
+					return
+				case pathStream <- path:
+				}
+				continue
+			}
+			if !listS3Objects(ctx, path, pathStream) {
+				return
+			}
+		}
+	}()
+	return pathStream
+}
+
+// listS3Objects sends the objects under an s3:// prefix on pathStream. It returns false if the pipeline stops.
+func listS3Objects(ctx context.Context, prefix string, pathStream chan<- string) bool {
+	if err := initS3Inputs(); err != nil {
+		fail(ctx, err)
+		return false
+	}
+	bucket, keyPrefix := splitS3URL(prefix)
+	logger.Printf("Listing objects under %v", prefix)
+	objects := 0
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(keyPrefix)}
+	s3Inputs.Lock()
+	svc := s3Inputs.svc
+	s3Inputs.Unlock()
+	for {
+		var page *s3.ListObjectsV2Output
+		err := retryS3(ctx, "S3 listing of "+prefix, func() (err error) {
+			page, err = svc.ListObjectsV2WithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			fail(ctx, fmt.Errorf("error listing %v: %v", prefix, err))
+			return false
+		}
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if strings.HasSuffix(key, "/") {
+				//folder marker
+				continue
+			}
+			objects++
+			atomic.AddInt64(&progress.bytesTotal, aws.Int64Value(object.Size))
+			select {
+			case <-ctx.Done():
+				return false
+			case pathStream <- "s3://" + bucket + "/" + key:
+			}
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+	if objects == 0 {
+		fail(ctx, fmt.Errorf("no objects under %v", prefix))
+		return false
+	}
+	return true
+}
+
+// retryS3 sends an S3 request made by the AWS SDK until it succeeds, retrying throttling, server and network errors
+// under the retry policy of the run. The sessions turn off the retries of the SDK, so that the retry options hold.
+func retryS3(ctx context.Context, what string, send func() error) error {
+	retries := newRetrier(ctx, what)
+	for {
+		err := send()
+		if err == nil || !isRetryableS3Error(err) || ctx.Err() != nil {
+			return err
+		}
+		logger.Printf("%v failed: %v", what, err)
+		if err := retries.backoff(nil); err != nil {
+			return err
+		}
+	}
+}
+
+func isRetryableS3Error(err error) bool {
+	if failure, ok := err.(awserr.RequestFailure); ok && isRetryableStatus(failure.StatusCode()) {
+		return true
+	}
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
+
+// s3ObjectURL returns the URL of an object, path style on -s3Endpoint or virtual hosted style on AWS
+func s3ObjectURL(bucket, key, region string) *url.URL {
+	if *globals.S3Endpoint != "" {
+		u, _ := url.Parse(*globals.S3Endpoint)
+		u.Path = "/" + bucket + "/" + key
+		u.RawPath = rest.EscapePath(u.Path, false)
+		return u
+	}
+	return &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + key,
+		RawPath: rest.EscapePath("/"+key, false)}
+}
+
+// openS3Object streams an object of an s3:// input with signed requests, which go through the retry policy and
+// resume a download that breaks off like URL inputs
+func openS3Object(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := initS3Inputs(); err != nil {
+		return nil, err
+	}
+	s3Inputs.Lock()
+	signer, region := s3Inputs.signer, s3Inputs.region
+	s3Inputs.Unlock()
+	bucket, key := splitS3URL(path)
+	sign := func(req *http.Request) error {
+		_, err := signer.Sign(req, nil, "s3", region, time.Now())
+		return err
+	}
+	u, err := openURL(ctx, path, s3ObjectURL(bucket, key, region).String(), sign)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
@@ -0,0 +1,161 @@
+package commands
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// targetBufferSize is how many records or SDK requests a target may fall behind the fastest target before it holds
+// up the others. A target that stays slower than the others holds them all up again once it is that far behind.
+const targetBufferSize = 10000
+
+type targetCounts struct {
+	Processed      int64 `json:"processed"`
+	Unprocessed    int64 `json:"unprocessed"`
+	SDKRequests    int64 `json:"sdkRequests,omitempty"`
+	BatchesGivenUp int64 `json:"batchesGivenUp"`
+}
+
+// targetSummary counts, per target, what CleverTap answered. It is only reported when uploading to several targets,
+// Summary has the totals.
+var targetSummary = struct {
+	sync.Mutex
+	counts map[string]*targetCounts
+}{counts: make(map[string]*targetCounts)}
+
+func countForTarget(target string, count func(c *targetCounts)) {
+	targetSummary.Lock()
+	defer targetSummary.Unlock()
+	c, ok := targetSummary.counts[target]
+	if !ok {
+		c = &targetCounts{}
+		targetSummary.counts[target] = c
+	}
+	count(c)
+}
+
+// targetLabel names a target in log lines, it is empty for the only target of a run
+func targetLabel(target string) string {
+	if target == "" {
+		return ""
+	}
+	return " for target " + target
+}
+
+func logTargetSummary() {
+	if len(globals.Targets) < 2 {
+		return
+	}
+	targetSummary.Lock()
+	defer targetSummary.Unlock()
+	for _, t := range globals.Targets {
+		c, ok := targetSummary.counts[t.Name]
+		if !ok {
+			c = &targetCounts{}
+		}
+		logger.Printf("Target %v (%v): Processed: %v , Unprocessed: %v , SDK requests: %v , Batches given up: %v", t.Name,
+			t.ID, c.Processed, c.Unprocessed, c.SDKRequests, c.BatchesGivenUp)
+	}
+}
+
+// targetReport returns the counts per target for the report, nil unless uploading to several targets
+func targetReport() map[string]*targetCounts {
+	if len(globals.Targets) < 2 {
+		return nil
+	}
+	targetSummary.Lock()
+	defer targetSummary.Unlock()
+	counts := make(map[string]*targetCounts)
+	for _, t := range globals.Targets {
+		c := targetCounts{}
+		if tc, ok := targetSummary.counts[t.Name]; ok {
+			c = *tc
+		}
+		counts[t.Name] = &c
+	}
+	return counts
+}
+
+// fanOutRecords copies every record to one stream per target, so that each target is batched and sent on its own
+func fanOutRecords(ctx context.Context, recordStream <-chan ctRecordInfo, targets []globals.Target) []<-chan ctRecordInfo {
+	if len(targets) == 1 {
+		return []<-chan ctRecordInfo{recordStream}
+	}
+	outs := make([]chan ctRecordInfo, len(targets))
+	streams := make([]<-chan ctRecordInfo, len(targets))
+	for i := range targets {
+		outs[i] = make(chan ctRecordInfo, targetBufferSize)
+		streams[i] = outs[i]
+	}
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for r := range recordStream {
+			for i, out := range outs {
+				r.Target = targets[i].Name
+				select {
+				case <-ctx.Done():
+					return
+				case out <- r:
+				}
+			}
+		}
+	}()
+	return streams
+}
+
+// fanOutSDKRequests copies every SDK request to one stream per target, with the account id and token of the
+// target in its meta records
+func fanOutSDKRequests(ctx context.Context, requestStream <-chan []map[string]interface{},
+	targets []globals.Target) []<-chan []map[string]interface{} {
+	if len(targets) == 1 {
+		return []<-chan []map[string]interface{}{requestStream}
+	}
+	outs := make([]chan []map[string]interface{}, len(targets))
+	streams := make([]<-chan []map[string]interface{}, len(targets))
+	for i := range targets {
+		outs[i] = make(chan []map[string]interface{}, targetBufferSize)
+		streams[i] = outs[i]
+	}
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for request := range requestStream {
+			for i, out := range outs {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- sdkRequestForTarget(request, &targets[i]):
+				}
+			}
+		}
+	}()
+	return streams
+}
+
+// sdkRequestForTarget returns a copy of request whose meta records carry the account id and token of t
+func sdkRequestForTarget(request []map[string]interface{}, t *globals.Target) []map[string]interface{} {
+	copied := make([]map[string]interface{}, len(request))
+	for i, record := range request {
+		if record["type"] != "meta" {
+			copied[i] = record
+			continue
+		}
+		meta := make(map[string]interface{}, len(record))
+		for k, v := range record {
+			meta[k] = v
+		}
+		meta["id"] = t.ID
+		meta["tk"] = t.Token
+		copied[i] = meta
+	}
+	return copied
+}
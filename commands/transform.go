@@ -0,0 +1,288 @@
+package commands
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// transformRecords applies the -transform rules to the converted records before they are validated and batched,
+// whichever source they come from
+func transformRecords(ctx context.Context, recordStream <-chan ctRecordInfo) <-chan ctRecordInfo {
+	if len(globals.Transforms) == 0 {
+		return recordStream
+	}
+	transformedRecordStream := make(chan ctRecordInfo)
+	go func() {
+		defer close(transformedRecordStream)
+		for r := range recordStream {
+			if !r.Transformed {
+				transformRecord(r.Record)
+				r.Transformed = true
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case transformedRecordStream <- r:
+			}
+		}
+	}()
+	return transformedRecordStream
+}
+
+// transformSDKRequest applies the -transform rules to the meta records of an SDK request, as profiles of their
+// device: objectId is the device id (g) and the properties are the app fields (af). It returns false when the rules
+// leave a meta record without a device id, the request cannot be sent then.
+func transformSDKRequest(request []map[string]interface{}) bool {
+	if len(globals.Transforms) == 0 {
+		return true
+	}
+	for _, m := range request {
+		if m["type"] != "meta" {
+			continue
+		}
+		record := map[string]interface{}{"type": "profile", "objectId": m["g"]}
+		if af, ok := m["af"].(map[string]interface{}); ok {
+			record["profileData"] = af
+		}
+		transformRecord(record)
+		g, ok := record["objectId"].(string)
+		if !ok || g == "" {
+			return false
+		}
+		m["g"] = g
+		if af, ok := record["profileData"].(map[string]interface{}); ok {
+			m["af"] = af
+		} else {
+			delete(m, "af")
+		}
+	}
+	return true
+}
+
+// transformRecord applies the -transform rules to a record in place
+func transformRecord(record interface{}) {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for i := range globals.Transforms {
+		applyTransform(m, &globals.Transforms[i])
+	}
+}
+
+// recordFields are the fields of a record outside of its properties
+var recordFields = map[string]bool{"identity": true, "objectId": true, "FBID": true, "GPID": true, "ts": true,
+	"evtName": true, "type": true}
+
+// propertiesField returns evtData or profileData, whichever holds the properties of record
+func propertiesField(record map[string]interface{}) string {
+	switch record["type"] {
+	case "event":
+		return "evtData"
+	case "profile":
+		return "profileData"
+	}
+	if _, ok := record["evtData"]; ok {
+		return "evtData"
+	}
+	return "profileData"
+}
+
+// locate returns the map that holds a -transform field of record and the key of the field in it. The properties
+// map is created if create is set, otherwise it is nil when the record has none.
+func locate(record map[string]interface{}, field string, create bool) (map[string]interface{}, string) {
+	if recordFields[field] {
+		return record, field
+	}
+	part, key := propertiesField(record), field
+	for _, p := range []string{"profileData", "evtData"} {
+		if strings.HasPrefix(field, p+".") {
+			part, key = p, strings.TrimPrefix(field, p+".")
+			break
+		}
+	}
+	properties, ok := record[part].(map[string]interface{})
+	if !ok && create {
+		properties = make(map[string]interface{})
+		record[part] = properties
+	}
+	return properties, key
+}
+
+func getField(record map[string]interface{}, field string) (interface{}, bool) {
+	m, key := locate(record, field, false)
+	if m == nil {
+		return nil, false
+	}
+	value, ok := m[key]
+	return value, ok
+}
+
+func setField(record map[string]interface{}, field string, value interface{}) {
+	m, key := locate(record, field, true)
+	m[key] = value
+}
+
+func deleteField(record map[string]interface{}, field string) {
+	if m, key := locate(record, field, false); m != nil {
+		delete(m, key)
+	}
+}
+
+// transformsSetIdentity tells whether a -transform rule writes identity, objectId, FBID or GPID, so that a csv file
+// may do without those columns
+func transformsSetIdentity() bool {
+	for _, rule := range globals.Transforms {
+		for _, field := range append([]string{rule.To, rule.Field}, rule.Into...) {
+			if isIdentity(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transformString returns a value as text for concat, with numbers written out in full
+func transformString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return jsonString(value)
+}
+
+// copyValue returns a deep copy of a value decoded from JSON, so that records do not share the arrays and objects
+// of a rule
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e)
+		}
+		return c
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyValue(e)
+		}
+		return c
+	}
+	return value
+}
+
+// applies tells whether a rule is limited to other types of records or other events
+func applies(record map[string]interface{}, rule *globals.TransformRule) bool {
+	if rule.Type != "" && record["type"] != rule.Type {
+		return false
+	}
+	if len(rule.Events) == 0 {
+		return true
+	}
+	for _, e := range rule.Events {
+		if record["evtName"] == e {
+			return true
+		}
+	}
+	return false
+}
+
+// listed tells whether the property key of part is one of the fields of an allow or deny rule, or matches its
+// pattern
+func listed(rule *globals.TransformRule, part, key string) bool {
+	for _, field := range rule.Fields {
+		if field == key || field == part+"."+key {
+			return true
+		}
+	}
+	return rule.Regexp != nil && rule.Regexp.MatchString(key)
+}
+
+// mapStrings replaces the string values of fields with f of them, other values are left as they are
+func mapStrings(record map[string]interface{}, fields []string, f func(string) string) {
+	for _, field := range fields {
+		if s, ok := getFieldString(record, field); ok {
+			setField(record, field, f(s))
+		}
+	}
+}
+
+func getFieldString(record map[string]interface{}, field string) (string, bool) {
+	value, _ := getField(record, field)
+	s, ok := value.(string)
+	return s, ok
+}
+
+func applyTransform(record map[string]interface{}, rule *globals.TransformRule) {
+	if !applies(record, rule) {
+		return
+	}
+	switch rule.Op {
+	case "rename":
+		if value, ok := getField(record, rule.From); ok {
+			deleteField(record, rule.From)
+			setField(record, rule.To, value)
+		}
+	case "drop":
+		for _, field := range rule.Fields {
+			deleteField(record, field)
+		}
+	case "allow", "deny":
+		for _, part := range []string{"profileData", "evtData"} {
+			properties, _ := record[part].(map[string]interface{})
+			for key := range properties {
+				if listed(rule, part, key) != (rule.Op == "allow") {
+					delete(properties, key)
+				}
+			}
+		}
+	case "set":
+		setField(record, rule.Field, copyValue(rule.Value))
+	case "concat":
+		var values []string
+		for _, field := range rule.Fields {
+			if value, ok := getField(record, field); ok && value != nil {
+				if s := transformString(value); s != "" {
+					values = append(values, s)
+				}
+			}
+		}
+		if len(values) > 0 {
+			setField(record, rule.To, strings.Join(values, rule.Separator))
+		}
+	case "split":
+		s, ok := getFieldString(record, rule.Field)
+		if !ok {
+			return
+		}
+		if len(rule.Into) == 0 {
+			parts := make([]interface{}, 0)
+			for _, part := range strings.Split(s, rule.Separator) {
+				if part = strings.TrimSpace(part); part != "" {
+					parts = append(parts, part)
+				}
+			}
+			setField(record, rule.Field, parts)
+			return
+		}
+		//the last field gets the rest of the value
+		for i, part := range strings.SplitN(s, rule.Separator, len(rule.Into)) {
+			setField(record, rule.Into[i], strings.TrimSpace(part))
+		}
+	case "replace":
+		mapStrings(record, rule.Fields, func(s string) string { return rule.Regexp.ReplaceAllString(s, rule.With) })
+	case "lowercase":
+		mapStrings(record, rule.Fields, strings.ToLower)
+	case "trim":
+		mapStrings(record, rule.Fields, strings.TrimSpace)
+	}
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// setTestTransforms sets the -transform rules for a test, it returns a func that removes them
+func setTestTransforms(rules ...globals.TransformRule) func() {
+	globals.Transforms = rules
+	return func() { globals.Transforms = nil }
+}
+
+func TestTransformSDKRequest(t *testing.T) {
+	defer setTestTransforms(
+		globals.TransformRule{Op: "lowercase", Fields: []string{"objectId"}},
+		globals.TransformRule{Op: "rename", From: "Model", To: "Device Model"},
+		globals.TransformRule{Op: "set", Type: "event", Field: "Source", Value: "leanplum"},
+	)()
+	request := []map[string]interface{}{
+		{"type": "meta", "g": "DEVICE-1", "af": map[string]interface{}{"Model": "Pixel", "App Version": "1.2"}},
+		{"type": "data", "data": map[string]interface{}{"action": "register"}},
+	}
+	if !transformSDKRequest(request) {
+		t.Fatal("request dropped")
+	}
+	want := []map[string]interface{}{
+		{"type": "meta", "g": "device-1", "af": map[string]interface{}{"Device Model": "Pixel", "App Version": "1.2"}},
+		{"type": "data", "data": map[string]interface{}{"action": "register"}},
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("got %v, want %v", request, want)
+	}
+
+	defer setTestTransforms(globals.TransformRule{Op: "drop", Fields: []string{"objectId"}})()
+	if transformSDKRequest([]map[string]interface{}{{"type": "meta", "g": "DEVICE-1"}}) {
+		t.Error("request without a device id was kept")
+	}
+}
+
+func TestReplayLeavesTransformedRecordsAlone(t *testing.T) {
+	var mu sync.Mutex
+	uploaded := make(map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			D []map[string]interface{} `json:"d"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, record := range payload.D {
+			uploaded[record["identity"].(string)] = record["profileData"].(map[string]interface{})["Name"]
+		}
+		mu.Unlock()
+		writeMockResponse(w, http.StatusOK, &CTResponse{Status: "success", Processed: len(payload.D)})
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replayPath := writeTestFile(t, dir, "rejected.jsonl",
+		`{"error":"e","record":{"identity":"1","type":"profile","profileData":{"Name":" Ann "}},"transformed":true}
+{"error":"e","record":{"identity":"2","type":"profile","profileData":{"Name":" Bob "}}}
+`)
+	transformPath := writeTestFile(t, dir, "transform.json", `{"rules": [{"op": "trim", "fields": ["Name"]}]}`)
+
+	if _, err := testUpload(t, server, "replay", map[string]string{"replay": replayPath, "transform": transformPath},
+		nil); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	want := map[string]interface{}{"1": " Ann ", "2": "Bob"}
+	if !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded %v, want %v", uploaded, want)
+	}
+}
+
+func TestSetGivesEachRecordItsOwnValue(t *testing.T) {
+	defer setTestTransforms(globals.TransformRule{Op: "set", Field: "Tags",
+		Value: []interface{}{"imported", map[string]interface{}{"source": "csv"}}})()
+	first := map[string]interface{}{"type": "profile", "identity": "1", "profileData": map[string]interface{}{}}
+	second := map[string]interface{}{"type": "profile", "identity": "2", "profileData": map[string]interface{}{}}
+	transformRecord(first)
+	transformRecord(second)
+	tags := first["profileData"].(map[string]interface{})["Tags"].([]interface{})
+	tags[0] = "changed"
+	tags[1].(map[string]interface{})["source"] = "changed"
+
+	want := []interface{}{"imported", map[string]interface{}{"source": "csv"}}
+	if got := second["profileData"].(map[string]interface{})["Tags"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("second record has %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(globals.Transforms[0].Value, want) {
+		t.Errorf("rule value changed to %v", globals.Transforms[0].Value)
+	}
+}
@@ -0,0 +1,195 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// testUpload runs a subcommand with options the way the command line would, against the upload API of server,
+// and returns the report of the run and its error. setup, if not nil, is called once the options are set.
+func testUpload(t *testing.T, server *httptest.Server, subcommand string, options map[string]string,
+	setup func()) (*runReport, error) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, ok := options["target"]; !ok {
+		options["id"], options["p"] = "TEST-ACCOUNT", "passcode"
+	}
+	options["apiEndpoint"] = server.URL + uploadPath
+	options["report"] = filepath.Join(dir, "report.json")
+	if err := globals.Configure(subcommand, options); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup()
+	}
+	//state kept between runs of the same process
+	resetRunState()
+
+	runErr := Get().Execute()
+	b, err := ioutil.ReadFile(options["report"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r runReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	return &r, runErr
+}
+
+// writeTestFile writes content to name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCSVUploadSkipsFilesWithBadHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(mockUploadHandler))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bad := writeTestFile(t, dir, "a.csv", "name,city\nAnn,Pune\nBob,Goa\n")
+	good := writeTestFile(t, dir, "b.csv", string(testLines(10)))
+
+	r, err := testUpload(t, server, "upload csv", map[string]string{"csv": bad + "\n" + good}, nil)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if c := r.Files[bad]; c == nil || !strings.Contains(c.Error, "invalid header") || c.Skipped != 2 {
+		t.Errorf("file with a bad header: %+v, want its 2 records skipped for an invalid header", c)
+	}
+	if c := r.Files[good]; c == nil || c.Processed != 10 || c.Error != "" {
+		t.Errorf("file with a good header: %+v, want 10 records processed", c)
+	}
+
+	_, err = testUpload(t, server, "upload csv", map[string]string{"csv": bad}, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid header") {
+		t.Errorf("got error %v, want an invalid header when no file can be read", err)
+	}
+}
+
+func TestCSVUploadAgainstMockServer(t *testing.T) {
+	//the first requests fail with a 503 and are retried, the mock handler answers the rest
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			writeMockResponse(w, http.StatusServiceUnavailable, &CTResponse{Status: "fail", Error: "Service Unavailable"})
+			return
+		}
+		mockUploadHandler(w, r)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const lines, rejectRate = 500, 0.2
+	csvPath := writeTestFile(t, dir, "in.csv", string(testLines(lines)))
+	deadLetterPath := filepath.Join(dir, "dead-letter.jsonl")
+
+	//the mock server draws one number per record, so the same seed rejects the same number of records
+	seeded := rand.New(rand.NewSource(1))
+	wantUnprocessed := int64(0)
+	for i := 0; i < lines; i++ {
+		if seeded.Float64() < rejectRate {
+			wantUnprocessed++
+		}
+	}
+	mockRand.Lock()
+	savedRand := mockRand.Rand
+	mockRand.Rand = rand.New(rand.NewSource(1))
+	mockRand.Unlock()
+	defer func() {
+		mockRand.Lock()
+		mockRand.Rand = savedRand
+		mockRand.Unlock()
+	}()
+	var restoreRetries func()
+	r, err := testUpload(t, server, "upload csv", map[string]string{"csv": csvPath, "deadLetterFile": deadLetterPath},
+		func() {
+			restoreRetries = setFastRetries()
+			*globals.MockRejectRate = rejectRate
+		})
+	restoreRetries()
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	c := r.Files[csvPath]
+	if c == nil || c.Read != lines || c.Processed != lines-wantUnprocessed || c.Unprocessed != wantUnprocessed {
+		t.Fatalf("file counts %+v, want %v read, %v processed and %v unprocessed", c, lines, lines-wantUnprocessed,
+			wantUnprocessed)
+	}
+	Summary.Lock()
+	if Summary.retries != 2 {
+		t.Errorf("retried %v times, want 2", Summary.retries)
+	}
+	Summary.Unlock()
+
+	b, err := ioutil.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if int64(len(entries)) != wantUnprocessed {
+		t.Fatalf("%v dead-letter entries, want %v", len(entries), wantUnprocessed)
+	}
+	for _, line := range entries {
+		var entry deadLetterEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		record, _ := entry.Record.(map[string]interface{})
+		//line 1 is the header, record n is on line n+1 of testLines
+		want := fmt.Sprintf("user-%d", entry.LineNum-2)
+		if entry.Source != csvPath || entry.Code != 599 || record["identity"] != want {
+			t.Errorf("dead-letter entry %v, want code 599 and identity %v from %v", line, want, csvPath)
+		}
+	}
+}
+
+func TestCSVUploadReportsFileCountsPerTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(mockUploadHandler))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := writeTestFile(t, dir, "in.csv", string(testLines(30)))
+
+	r, err := testUpload(t, server, "upload csv", map[string]string{"csv": csvPath,
+		"target": "name=a,id=ACCOUNT-A,p=passcode\nname=b,id=ACCOUNT-B,p=passcode"}, nil)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	c := r.Files[csvPath]
+	if c == nil || c.Read != 30 || c.Uploaded != 0 || len(c.Targets) != 2 {
+		t.Fatalf("file counts %+v, want 30 read and the uploads of 2 targets", c)
+	}
+	for _, name := range []string{"a", "b"} {
+		if tc := c.Targets[name]; tc == nil || tc.Uploaded != 30 || tc.Processed != 30 {
+			t.Errorf("file counts of target %v: %+v, want 30 processed", name, tc)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ankit-arora/clevertap-data-upload/globals"
+)
+
+// CleverTap limits checked by -validate. The property count is capped at maxPropsCount, as the Mixpanel importer does.
+const (
+	maxEventNameLength   = 512
+	maxPropertyKeyLength = 120
+	maxStringValueLength = 512
+	maxArrayLength       = 100
+	// timestamps further in the future are rejected, or taken for milliseconds by -autoFix
+	maxTimestampSkew = 24 * time.Hour
+)
+
+// forbiddenChars cannot be used in event names and property keys
+const forbiddenChars = ".:$'\"\\"
+
+var minTimestamp = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// Checks made by -validate, used to group the issues in the summary and the report
+const (
+	checkNotObject        = "record is not an object"
+	checkMissingIdentity  = "missing identity"
+	checkRecordType       = "invalid record type"
+	checkMissingEventName = "missing event name"
+	checkEventNameLength  = "event name too long"
+	checkEventNameChars   = "forbidden characters in event name"
+	checkRestrictedEvent  = "restricted event name"
+	checkKeyLength        = "property key too long"
+	checkKeyChars         = "forbidden characters in property key"
+	checkPropertyCount    = "too many properties"
+	checkValueType        = "invalid property value type"
+	checkValueLength      = "property value too long"
+	checkArrayLength      = "array too long"
+	checkTimestamp        = "timestamp out of range"
+)
+
+type recordIssue struct {
+	check  string
+	detail string
+	// fixed is set when -autoFix changed the record to get rid of the issue
+	fixed bool
+}
+
+// recordValidator collects the issues of one record. With autoFix it changes the record in place where it can.
+type recordValidator struct {
+	autoFix bool
+	issues  []recordIssue
+}
+
+func (v *recordValidator) add(check string, fixed bool, format string, args ...interface{}) {
+	v.issues = append(v.issues, recordIssue{check: check, detail: fmt.Sprintf(format, args...), fixed: fixed})
+}
+
+// validateRecord checks a record in the CleverTap upload API format and returns its issues
+func validateRecord(record interface{}, autoFix bool) []recordIssue {
+	v := &recordValidator{autoFix: autoFix}
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		v.add(checkNotObject, false, "record %v is not a JSON object", record)
+		return v.issues
+	}
+	v.checkIdentity(m)
+	v.checkTimestamp(m)
+	switch m["type"] {
+	case "event":
+		v.checkEventName(m)
+		evtName, _ := m["evtName"].(string)
+		v.checkProperties(m, "evtData", evtName)
+	case "profile":
+		v.checkProperties(m, "profileData", "")
+	default:
+		v.add(checkRecordType, false, "type is %v, should be event or profile", m["type"])
+	}
+	return v.issues
+}
+
+func (v *recordValidator) checkIdentity(m map[string]interface{}) {
+	for _, key := range []string{"identity", "objectId", "FBID", "GPID"} {
+		if id, ok := m[key]; ok && id != nil && id != "" {
+			return
+		}
+	}
+	v.add(checkMissingIdentity, false, "identity, objectId, FBID or GPID is mandatory")
+}
+
+func (v *recordValidator) checkTimestamp(m map[string]interface{}) {
+	value, ok := m["ts"]
+	if !ok {
+		return
+	}
+	var ts int64
+	switch t := value.(type) {
+	case float64:
+		ts = int64(t)
+	case int64:
+		ts = t
+	case int:
+		ts = int64(t)
+	default:
+		v.add(checkTimestamp, false, "ts %v is not a number", value)
+		return
+	}
+	maxTs := time.Now().Add(maxTimestampSkew).Unix()
+	if ts > maxTs && ts/1000 >= minTimestamp && ts/1000 <= maxTs && v.autoFix {
+		m["ts"] = ts / 1000
+		v.add(checkTimestamp, true, "ts %v is in milliseconds, changed it to %v", ts, ts/1000)
+		return
+	}
+	if ts < minTimestamp || ts > maxTs {
+		v.add(checkTimestamp, false, "ts %v is not between %v and a day from now", ts,
+			time.Unix(minTimestamp, 0).UTC().Format("2006-01-02"))
+	}
+}
+
+func (v *recordValidator) checkEventName(m map[string]interface{}) {
+	name, _ := m["evtName"].(string)
+	if name == "" {
+		v.add(checkMissingEventName, false, "evtName is mandatory for events")
+		return
+	}
+	if strings.ContainsAny(name, forbiddenChars) {
+		fixed := stripForbiddenChars(name)
+		if !v.autoFix || fixed == "" {
+			v.add(checkEventNameChars, false, "event name %q contains one of %v", name, forbiddenChars)
+			return
+		}
+		v.add(checkEventNameChars, true, "renamed event %q to %q", name, fixed)
+		name = fixed
+	}
+	for _, r := range restrictedEvents {
+		if name == r {
+			if !v.autoFix {
+				v.add(checkRestrictedEvent, false, "event name %q is reserved for CleverTap system events", name)
+				return
+			}
+			v.add(checkRestrictedEvent, true, "renamed event %q to %q", name, "_"+name)
+			name = "_" + name
+			break
+		}
+	}
+	if utf8.RuneCountInString(name) > maxEventNameLength {
+		if !v.autoFix {
+			v.add(checkEventNameLength, false, "event name %.40q... is longer than %v characters", name, maxEventNameLength)
+			return
+		}
+		v.add(checkEventNameLength, true, "truncated event name %.40q... to %v characters", name, maxEventNameLength)
+		name = truncateString(name, maxEventNameLength)
+	}
+	m["evtName"] = name
+}
+
+// checkProperties checks the keys and values of the evtData or profileData of a record. evtName is empty for
+// profiles.
+func (v *recordValidator) checkProperties(m map[string]interface{}, field, evtName string) {
+	data, ok := m[field]
+	if !ok {
+		return
+	}
+	props, ok := data.(map[string]interface{})
+	if !ok {
+		v.add(checkValueType, false, "%v is not a JSON object", field)
+		return
+	}
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		newKey, ok := v.checkKey(props, key)
+		if ok {
+			v.checkValue(props, newKey, evtName)
+		}
+	}
+	if len(props) > maxPropsCount {
+		if !v.autoFix {
+			v.add(checkPropertyCount, false, "%v has %v properties, at most %v are allowed", field, len(props), maxPropsCount)
+			return
+		}
+		keys = keys[:0]
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys[maxPropsCount:] {
+			delete(props, key)
+		}
+		v.add(checkPropertyCount, true, "dropped %v of the %v properties of %v: %v", len(keys)-maxPropsCount,
+			len(keys), field, strings.Join(keys[maxPropsCount:], ", "))
+	}
+}
+
+// checkKey checks a property key. It returns the key the property has after fixes, and false if the property was
+// dropped or cannot be fixed.
+func (v *recordValidator) checkKey(props map[string]interface{}, key string) (string, bool) {
+	newKey := key
+	if strings.ContainsAny(newKey, forbiddenChars) {
+		if !v.autoFix {
+			v.add(checkKeyChars, false, "property key %q contains one of %v", key, forbiddenChars)
+			return key, false
+		}
+		newKey = stripForbiddenChars(newKey)
+	}
+	if utf8.RuneCountInString(newKey) > maxPropertyKeyLength {
+		if !v.autoFix {
+			v.add(checkKeyLength, false, "property key %.40q... is longer than %v characters", key, maxPropertyKeyLength)
+			return key, false
+		}
+		newKey = truncateString(newKey, maxPropertyKeyLength)
+	}
+	if newKey == key {
+		return key, true
+	}
+	check := checkKeyChars
+	if !strings.ContainsAny(key, forbiddenChars) {
+		check = checkKeyLength
+	}
+	value := props[key]
+	delete(props, key)
+	if _, used := props[newKey]; used || newKey == "" {
+		v.add(check, true, "dropped property %.40q, its fixed key %.40q is empty or already used", key, newKey)
+		return newKey, false
+	}
+	props[newKey] = value
+	if check == checkKeyLength {
+		v.add(check, true, "truncated property key %.40q... to %v characters", key, maxPropertyKeyLength)
+	} else {
+		v.add(check, true, "renamed property %.40q to %.40q", key, newKey)
+	}
+	return newKey, true
+}
+
+func (v *recordValidator) checkValue(props map[string]interface{}, key, evtName string) {
+	profile := evtName == ""
+	switch value := props[key].(type) {
+	case nil:
+		v.dropInvalid(props, key, "it has no value")
+	case string:
+		if fixed, ok := v.checkString(key, value); ok {
+			props[key] = fixed
+		}
+	case bool, float64, float32, int, int64, int32:
+	case []interface{}:
+		if profile {
+			props[key] = v.checkMultiValue(key, value)
+		} else if evtName == "Charged" && key == "Items" {
+			props[key] = v.checkItems(value)
+		} else {
+			v.dropInvalid(props, key, "arrays are only allowed in profiles and in Charged event Items")
+		}
+	case []string:
+		if profile {
+			props[key] = v.checkMultiValue(key, stringsToInterfaces(value))
+		} else {
+			v.dropInvalid(props, key, "arrays are only allowed in profiles and in Charged event Items")
+		}
+	case map[string][]string:
+		//{"$add": ["a", "b"]}, as set up by the CSV importer for string[] columns
+		if !profile {
+			v.dropInvalid(props, key, "objects are only allowed as profile property operations")
+			return
+		}
+		for op, values := range value {
+			value[op] = interfacesToStrings(v.checkMultiValue(key, stringsToInterfaces(values)))
+		}
+	case map[string]interface{}:
+		//{"$add": [...]}, {"$incr": 1} and the other profile property operations
+		if !profile {
+			v.dropInvalid(props, key, "objects are only allowed as profile property operations")
+			return
+		}
+		for op, opValue := range value {
+			if !strings.HasPrefix(op, "$") {
+				v.dropInvalid(props, key, "%v is not a profile property operation", op)
+				return
+			}
+			if values, ok := opValue.([]interface{}); ok {
+				value[op] = v.checkMultiValue(key, values)
+			}
+		}
+	default:
+		v.dropInvalid(props, key, "values of type %T are not allowed", value)
+	}
+}
+
+// checkString returns the string value of a property after fixes, and false if it is fine as it is
+func (v *recordValidator) checkString(key, value string) (string, bool) {
+	if utf8.RuneCountInString(value) <= maxStringValueLength {
+		return value, false
+	}
+	if !v.autoFix {
+		v.add(checkValueLength, false, "value of property %q is longer than %v characters", key, maxStringValueLength)
+		return value, false
+	}
+	v.add(checkValueLength, true, "truncated value of property %q to %v characters", key, maxStringValueLength)
+	return truncateString(value, maxStringValueLength), true
+}
+
+// checkMultiValue checks the values of a multi-value profile property and returns them after fixes
+func (v *recordValidator) checkMultiValue(key string, values []interface{}) []interface{} {
+	values = v.checkArrayLength(key, values)
+	for i, value := range values {
+		switch s := value.(type) {
+		case string:
+			if fixed, ok := v.checkString(key, s); ok {
+				values[i] = fixed
+			}
+		case float64, int, int64, bool:
+		default:
+			v.add(checkValueType, false, "property %q has a value of type %T in its array", key, value)
+		}
+	}
+	return values
+}
+
+// checkItems checks the Items of a Charged event, which are objects with the properties of each item
+func (v *recordValidator) checkItems(items []interface{}) []interface{} {
+	items = v.checkArrayLength("Items", items)
+	for _, item := range items {
+		props, ok := item.(map[string]interface{})
+		if !ok {
+			v.add(checkValueType, false, "Charged event item %v is not a JSON object", item)
+			continue
+		}
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if newKey, ok := v.checkKey(props, key); ok {
+				v.checkValue(props, newKey, "Charged item")
+			}
+		}
+	}
+	return items
+}
+
+func (v *recordValidator) checkArrayLength(key string, values []interface{}) []interface{} {
+	if len(values) <= maxArrayLength {
+		return values
+	}
+	if !v.autoFix {
+		v.add(checkArrayLength, false, "property %q has %v values, at most %v are allowed", key, len(values), maxArrayLength)
+		return values
+	}
+	v.add(checkArrayLength, true, "dropped %v of the %v values of property %q", len(values)-maxArrayLength,
+		len(values), key)
+	return values[:maxArrayLength]
+}
+
+// dropInvalid reports a property with a value CleverTap does not accept, and drops it with -autoFix
+func (v *recordValidator) dropInvalid(props map[string]interface{}, key string, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	if !v.autoFix {
+		v.add(checkValueType, false, "property %q is invalid, %v", key, reason)
+		return
+	}
+	delete(props, key)
+	v.add(checkValueType, true, "dropped property %q, %v", key, reason)
+}
+
+func stripForbiddenChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(forbiddenChars, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func truncateString(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, s := range values {
+		out[i] = s
+	}
+	return out
+}
+
+func interfacesToStrings(values []interface{}) []string {
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		out = append(out, fmt.Sprintf("%v", value))
+	}
+	return out
+}
+
+// validation counts the records checked by -validate, and the issues found per check
+var validation = struct {
+	sync.Mutex
+	checked int64
+	invalid int64
+	fixed   int64
+	issues  map[string]*validationCounts
+}{
+	issues: make(map[string]*validationCounts),
+}
+
+type validationCounts struct {
+	Failed int64 `json:"failed,omitempty"`
+	Fixed  int64 `json:"fixed,omitempty"`
+}
+
+// validateRecords checks the converted records before they are batched. Records with issues are logged with their
+// source line and skipped. With -autoFix the issues are fixed where possible and every change is logged. With
+// -validateOnly no record is passed on, and the run fails if any record is invalid.
+func validateRecords(ctx context.Context, recordStream <-chan ctRecordInfo) <-chan ctRecordInfo {
+	if !*globals.Validate {
+		return recordStream
+	}
+	validRecordStream := make(chan ctRecordInfo)
+	go func() {
+		defer close(validRecordStream)
+		invalidRecords := 0
+		for r := range recordStream {
+			issues := validateRecord(r.Record, *globals.AutoFix)
+			invalid, fixed := false, false
+			for _, issue := range issues {
+				logRecordIssue(r, issue)
+				invalid = invalid || !issue.fixed
+				fixed = fixed || issue.fixed
+			}
+			countValidation(issues, invalid, fixed)
+			if invalid {
+				invalidRecords++
+				countSkipped(r.Source, skipInvalidRecord)
+				checkpoint.markDone(r.Source, r.LineNum)
+				continue
+			}
+			if *globals.ValidateOnly {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case validRecordStream <- r:
+			}
+		}
+		if *globals.ValidateOnly && invalidRecords > 0 && ctx.Err() == nil {
+			fail(ctx, fmt.Errorf("%v records failed validation", invalidRecords))
+		}
+	}()
+	return validRecordStream
+}
+
+func logRecordIssue(r ctRecordInfo, issue recordIssue) {
+	prefix := "Invalid record"
+	if issue.fixed {
+		prefix = "Fixed record"
+	}
+	if r.Source != "" {
+		logger.Printf("%v at line %v of %v: %v", prefix, r.LineNum+1, r.Source, issue.detail)
+		return
+	}
+	logger.Printf("%v %v: %v", prefix, r.Record, issue.detail)
+}
+
+func countValidation(issues []recordIssue, invalid, fixed bool) {
+	validation.Lock()
+	defer validation.Unlock()
+	validation.checked++
+	if invalid {
+		validation.invalid++
+	} else if fixed {
+		validation.fixed++
+	}
+	for _, issue := range issues {
+		c, ok := validation.issues[issue.check]
+		if !ok {
+			c = &validationCounts{}
+			validation.issues[issue.check] = c
+		}
+		if issue.fixed {
+			c.Fixed++
+		} else {
+			c.Failed++
+		}
+	}
+}
+
+func logValidationSummary() {
+	validation.Lock()
+	defer validation.Unlock()
+	if validation.checked == 0 {
+		return
+	}
+	logger.Printf("Validated records: %v , invalid: %v , fixed: %v", validation.checked, validation.invalid,
+		validation.fixed)
+	checks := make([]string, 0, len(validation.issues))
+	for check := range validation.issues {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	for _, check := range checks {
+		c := validation.issues[check]
+		logger.Printf("  %v: %v failed , %v fixed", check, c.Failed, c.Fixed)
+	}
+}
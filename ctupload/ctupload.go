@@ -0,0 +1,167 @@
+// Package ctupload runs CleverTap data uploads from Go code.
+//
+// An upload reads records from a Source and hands them in batches to a Sink. The importers of the command line tool
+// (csv, json, mixpanel-events, mixpanel-profiles, mparticle, replay and leanplum-load) and the clevertap sink are
+// registered by package commands, so importing it for its side effects makes them available:
+//
+//	import (
+//		"github.com/ankit-arora/clevertap-data-upload/ctupload"
+//		_ "github.com/ankit-arora/clevertap-data-upload/commands"
+//	)
+//
+//	result, err := ctupload.Run(ctx, ctupload.Config{
+//		Source:  "csv",
+//		Options: map[string]string{"csv": "events.csv", "t": "event", "id": "XXX", "p": "XXX"},
+//	})
+//
+// Options are keyed by the command line option names of the tool.
+//
+// The built-in sources and the clevertap sink keep their configuration in the process-wide options of the tool, which
+// each Run sets from its Options, so Run uploads one at a time: a Run called while another is running waits for it
+// to return. The summary, report and dead-letter state of the tool are kept in the process too, and reset at the
+// start of each Run.
+package ctupload
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// APIRecord is a source record that converts to one or more records of the CleverTap upload API format
+type APIRecord interface {
+	ConvertToCTAPIFormat() ([]interface{}, error)
+}
+
+// SDKRecord is a source record that converts to a request for the CleverTap SDK endpoint. A nil request is
+// skipped.
+type SDKRecord interface {
+	ConvertToCTSDKFormat() ([]map[string]interface{}, error)
+}
+
+// Record is a record already in the CleverTap upload API format. Source and LineNum (0 based) tell where it was
+// read from and are empty for records that do not come from a file.
+type Record struct {
+	Data    interface{}
+	Source  string
+	LineNum int
+	// Transformed is set for records the -transform rules were already applied to, which the sink sends as they are
+	Transformed bool
+}
+
+// ConvertToCTAPIFormat makes Record an APIRecord
+func (r Record) ConvertToCTAPIFormat() ([]interface{}, error) {
+	return []interface{}{r.Data}, nil
+}
+
+// Streams are the records of an opened Source. Channels are closed by the source once it is exhausted or the
+// context of Open is done.
+type Streams struct {
+	API <-chan APIRecord
+	// SDK streams are keyed by the os of the SDK endpoint, e.g. iOS or android
+	SDK map[string]<-chan SDKRecord
+	// Err, if set, is called once the channels are closed and returns the error that stopped the source early
+	Err func() error
+	// Close, if set, is called when Run returns, to stop whatever the source still has running and save its state
+	Close func()
+}
+
+// Source produces the records of one upload
+type Source interface {
+	Open(ctx context.Context) (*Streams, error)
+}
+
+// BatchResult is what the sink reports for one batch of upload API records
+type BatchResult struct {
+	Processed   int
+	Unprocessed int
+}
+
+// Sink uploads converted records. It is called concurrently.
+type Sink interface {
+	UploadAPI(ctx context.Context, batch []Record) (BatchResult, error)
+	UploadSDK(ctx context.Context, os string, request []map[string]interface{}) error
+}
+
+// TargetSink is a Sink that uploads every record to several targets, such as the accounts of -target. Run gives
+// each target batchers of its own, fed from the queue FanOut returns for it, and reports the results of each target
+// in Result.Targets. A target slower than the others only holds them up once its queue is full, so the queues set
+// how long a stall the other targets ride out.
+type TargetSink interface {
+	Sink
+	// Targets returns the names of the targets, with fewer than two the sink is used as a plain Sink
+	Targets() []string
+	// FanOut copies every record to one queue per target, in the order of Targets, and closes the queues once
+	// records is closed or ctx is done
+	FanOut(ctx context.Context, records <-chan Record) []<-chan Record
+	// UploadAPITo uploads a batch to one of the targets
+	UploadAPITo(ctx context.Context, target string, batch []Record) (BatchResult, error)
+}
+
+// SourceFactory creates a source for the given configuration
+type SourceFactory func(cfg Config) (Source, error)
+
+// SinkFactory creates a sink for the given configuration
+type SinkFactory func(cfg Config) (Sink, error)
+
+var registry = struct {
+	sync.Mutex
+	sources map[string]SourceFactory
+	sinks   map[string]SinkFactory
+}{
+	sources: make(map[string]SourceFactory),
+	sinks:   make(map[string]SinkFactory),
+}
+
+// RegisterSource makes a source available under name. It panics if the name is already taken.
+func RegisterSource(name string, factory SourceFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.sources[name]; ok {
+		panic("ctupload: source " + name + " registered twice")
+	}
+	registry.sources[name] = factory
+}
+
+// RegisterSink makes a sink available under name. It panics if the name is already taken.
+func RegisterSink(name string, factory SinkFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.sinks[name]; ok {
+		panic("ctupload: sink " + name + " registered twice")
+	}
+	registry.sinks[name] = factory
+}
+
+// Sources returns the names of the registered sources in sorted order
+func Sources() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.sources))
+	for name := range registry.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupSource(name string) (SourceFactory, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	factory, ok := registry.sources[name]
+	if !ok {
+		return nil, fmt.Errorf("ctupload: unknown source %q", name)
+	}
+	return factory, nil
+}
+
+func lookupSink(name string) (SinkFactory, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	factory, ok := registry.sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("ctupload: unknown sink %q", name)
+	}
+	return factory, nil
+}
@@ -0,0 +1,297 @@
+package ctupload
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default batch size and concurrency, used when the Config leaves them at zero
+const (
+	DefaultBatchSize      = 100
+	DefaultConcurrency    = 3
+	DefaultSDKConcurrency = 100
+)
+
+// Config describes one upload
+type Config struct {
+	// Source is the name of a registered source
+	Source string
+	// Sink is the name of a registered sink, clevertap when empty
+	Sink string
+	// Options configure the source and the sink
+	Options map[string]string
+	// Intake, if set, stops reading from the source once done. The records already read are still uploaded,
+	// unlike when the ctx of Run is done.
+	Intake         context.Context
+	BatchSize      int
+	Concurrency    int
+	SDKConcurrency int
+	// RecordsPerSecond and RequestsPerSecond limit what the sink sends, 0 for no limit
+	RecordsPerSecond  float64
+	RequestsPerSecond float64
+	// Logger is what the source and sink log to, nothing is logged when nil
+	Logger *log.Logger
+}
+
+// Result sums up an upload
+type Result struct {
+	Start time.Time
+	End   time.Time
+	// RecordsRead counts the records produced by the source, before conversion
+	RecordsRead int64
+	// Records counts the converted upload API records
+	Records       int64
+	Processed     int64
+	Unprocessed   int64
+	SDKRequests   int64
+	BatchesFailed int64
+	// Errors holds the conversion and upload errors, in the order they happened
+	Errors []string
+	// Targets holds the results per target when the sink is a TargetSink with several targets, Processed,
+	// Unprocessed and BatchesFailed sum them up
+	Targets map[string]*TargetResult
+}
+
+// TargetResult sums up the upload API batches of one target
+type TargetResult struct {
+	Processed     int64
+	Unprocessed   int64
+	BatchesFailed int64
+}
+
+// runs holds Run to one upload at a time, see the package doc
+var runs sync.Mutex
+
+type runState struct {
+	sync.Mutex
+	result *Result
+}
+
+func (s *runState) add(f func(r *Result)) {
+	s.Lock()
+	f(s.result)
+	s.Unlock()
+}
+
+func (s *runState) addError(err error) {
+	s.add(func(r *Result) {
+		r.Errors = append(r.Errors, err.Error())
+	})
+}
+
+// Run uploads every record of the configured source to the configured sink. Records that fail to convert and
+// batches that fail to upload are reported in the result, they do not stop the run. The error is only set when the
+// upload cannot start, the source stops because of an error or ctx is done before the source is exhausted. Runs are
+// serialized, Run waits for the one in progress to return.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	runs.Lock()
+	defer runs.Unlock()
+	if cfg.Sink == "" {
+		cfg.Sink = "clevertap"
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+	if cfg.SDKConcurrency <= 0 {
+		cfg.SDKConcurrency = DefaultSDKConcurrency
+	}
+	newSink, err := lookupSink(cfg.Sink)
+	if err != nil {
+		return nil, err
+	}
+	newSource, err := lookupSource(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newSink(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("ctupload: sink %v: %v", cfg.Sink, err)
+	}
+	source, err := newSource(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("ctupload: source %v: %v", cfg.Source, err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	state := &runState{result: &Result{Start: time.Now()}}
+	sourceCtx, stopSource := context.WithCancel(runCtx)
+	defer stopSource()
+	if cfg.Intake != nil {
+		go func() {
+			select {
+			case <-cfg.Intake.Done():
+				stopSource()
+			case <-sourceCtx.Done():
+			}
+		}()
+	}
+	streams, err := source.Open(sourceCtx)
+	if err != nil {
+		return nil, fmt.Errorf("ctupload: source %v: %v", cfg.Source, err)
+	}
+	if streams.Close != nil {
+		defer streams.Close()
+	}
+	var wg sync.WaitGroup
+	if streams.API != nil {
+		records := convertAPIRecords(runCtx, streams.API, state)
+		ts, _ := sink.(TargetSink)
+		var targets []string
+		if ts != nil {
+			targets = ts.Targets()
+		}
+		if len(targets) < 2 {
+			for i := 0; i < cfg.Concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					uploadAPIBatches(runCtx, "", sink.UploadAPI, records, cfg.BatchSize, state)
+				}()
+			}
+		} else {
+			state.result.Targets = make(map[string]*TargetResult)
+			for _, target := range targets {
+				state.result.Targets[target] = &TargetResult{}
+			}
+			for i, queue := range ts.FanOut(runCtx, records) {
+				target := targets[i]
+				upload := func(ctx context.Context, batch []Record) (BatchResult, error) {
+					return ts.UploadAPITo(ctx, target, batch)
+				}
+				for w := 0; w < cfg.Concurrency; w++ {
+					wg.Add(1)
+					go func(queue <-chan Record) {
+						defer wg.Done()
+						uploadAPIBatches(runCtx, target, upload, queue, cfg.BatchSize, state)
+					}(queue)
+				}
+			}
+		}
+	}
+	for os, stream := range streams.SDK {
+		for i := 0; i < cfg.SDKConcurrency; i++ {
+			wg.Add(1)
+			go func(os string, stream <-chan SDKRecord) {
+				defer wg.Done()
+				uploadSDKRequests(runCtx, sink, os, stream, state)
+			}(os, stream)
+		}
+	}
+	wg.Wait()
+	state.result.End = time.Now()
+	if ctx.Err() != nil {
+		return state.result, ctx.Err()
+	}
+	if streams.Err != nil {
+		if err := streams.Err(); err != nil {
+			return state.result, fmt.Errorf("ctupload: source %v: %v", cfg.Source, err)
+		}
+	}
+	return state.result, nil
+}
+
+func convertAPIRecords(ctx context.Context, stream <-chan APIRecord, state *runState) <-chan Record {
+	records := make(chan Record)
+	go func() {
+		defer close(records)
+		for r := range stream {
+			state.add(func(res *Result) { res.RecordsRead++ })
+			converted := make([]Record, 0, 1)
+			if record, ok := r.(Record); ok {
+				converted = append(converted, record)
+			} else {
+				data, err := r.ConvertToCTAPIFormat()
+				if err != nil {
+					state.addError(fmt.Errorf("converting record: %v", err))
+					continue
+				}
+				for _, d := range data {
+					converted = append(converted, Record{Data: d})
+				}
+			}
+			for _, record := range converted {
+				select {
+				case <-ctx.Done():
+					return
+				case records <- record:
+					state.add(func(res *Result) { res.Records++ })
+				}
+			}
+		}
+	}()
+	return records
+}
+
+// uploadAPIBatches batches records and uploads them with upload. target is empty unless uploading to one of the
+// targets of a TargetSink.
+func uploadAPIBatches(ctx context.Context, target string,
+	upload func(ctx context.Context, batch []Record) (BatchResult, error), records <-chan Record, batchSize int,
+	state *runState) {
+	batch := make([]Record, 0, batchSize)
+	send := func() {
+		br, err := upload(ctx, batch)
+		state.add(func(res *Result) {
+			res.Processed += int64(br.Processed)
+			res.Unprocessed += int64(br.Unprocessed)
+			if err != nil {
+				res.BatchesFailed++
+				msg := fmt.Sprintf("uploading batch of %v records: %v", len(batch), err)
+				if target != "" {
+					msg = fmt.Sprintf("uploading batch of %v records to target %v: %v", len(batch), target, err)
+				}
+				res.Errors = append(res.Errors, msg)
+			}
+			if t, ok := res.Targets[target]; ok {
+				t.Processed += int64(br.Processed)
+				t.Unprocessed += int64(br.Unprocessed)
+				if err != nil {
+					t.BatchesFailed++
+				}
+			}
+		})
+		batch = make([]Record, 0, batchSize)
+	}
+	for r := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		batch = append(batch, r)
+		if len(batch) == batchSize {
+			send()
+		}
+	}
+	if len(batch) > 0 && ctx.Err() == nil {
+		send()
+	}
+}
+
+func uploadSDKRequests(ctx context.Context, sink Sink, os string, stream <-chan SDKRecord, state *runState) {
+	for r := range stream {
+		if ctx.Err() != nil {
+			return
+		}
+		state.add(func(res *Result) { res.RecordsRead++ })
+		request, err := r.ConvertToCTSDKFormat()
+		if err != nil {
+			state.addError(fmt.Errorf("converting SDK record: %v", err))
+			continue
+		}
+		if request == nil {
+			continue
+		}
+		if err := sink.UploadSDK(ctx, os, request); err != nil {
+			state.add(func(res *Result) {
+				res.BatchesFailed++
+				res.Errors = append(res.Errors, fmt.Sprintf("uploading SDK request for %v: %v", os, err))
+			})
+			continue
+		}
+		state.add(func(res *Result) { res.SDKRequests++ })
+	}
+}
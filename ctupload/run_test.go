@@ -0,0 +1,191 @@
+package ctupload
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRegistrations int64
+
+type testSource struct {
+	records int
+}
+
+func (s *testSource) Open(ctx context.Context) (*Streams, error) {
+	out := make(chan APIRecord)
+	go func() {
+		defer close(out)
+		for i := 0; i < s.records; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- Record{Data: map[string]interface{}{"identity": i}}:
+			}
+		}
+	}()
+	return &Streams{API: out}, nil
+}
+
+// testTargetSink uploads to a fast target, which signals fastDone once it has every record, and a slow target that
+// waits for release
+type testTargetSink struct {
+	sync.Mutex
+	records  int
+	fast     int
+	fastDone chan struct{}
+	release  chan struct{}
+}
+
+func (s *testTargetSink) UploadAPI(ctx context.Context, batch []Record) (BatchResult, error) {
+	panic("UploadAPI called on a sink with several targets")
+}
+
+func (s *testTargetSink) UploadSDK(ctx context.Context, os string, request []map[string]interface{}) error {
+	return nil
+}
+
+func (s *testTargetSink) Targets() []string {
+	return []string{"fast", "slow"}
+}
+
+// FanOut gives each target a queue that holds every record, so that the slow target never holds up the fast one
+func (s *testTargetSink) FanOut(ctx context.Context, records <-chan Record) []<-chan Record {
+	fast, slow := make(chan Record, s.records), make(chan Record, s.records)
+	go func() {
+		defer close(fast)
+		defer close(slow)
+		for r := range records {
+			fast <- r
+			slow <- r
+		}
+	}()
+	return []<-chan Record{fast, slow}
+}
+
+func (s *testTargetSink) UploadAPITo(ctx context.Context, target string, batch []Record) (BatchResult, error) {
+	if target == "slow" {
+		<-s.release
+		return BatchResult{Processed: len(batch) - 1, Unprocessed: 1}, nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.fast += len(batch)
+	if s.fast == s.records {
+		close(s.fastDone)
+	}
+	return BatchResult{Processed: len(batch)}, nil
+}
+
+func TestRunUploadsToEachTargetOnItsOwn(t *testing.T) {
+	const records, batchSize = 500, 10
+	sink := &testTargetSink{records: records, fastDone: make(chan struct{}), release: make(chan struct{})}
+	//names are registered once per process, so each run of the test takes new ones
+	name := fmt.Sprintf("test-targets-%v", atomic.AddInt64(&testRegistrations, 1))
+	RegisterSource(name, func(cfg Config) (Source, error) { return &testSource{records: records}, nil })
+	RegisterSink(name, func(cfg Config) (Sink, error) { return sink, nil })
+
+	go func() {
+		//the fast target gets every record while the slow one has not finished a batch
+		select {
+		case <-sink.fastDone:
+		case <-time.After(10 * time.Second):
+			t.Error("the fast target was held up by the slow one")
+		}
+		close(sink.release)
+	}()
+	result, err := Run(context.Background(), Config{Source: name, Sink: name,
+		BatchSize: batchSize, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, slow := result.Targets["fast"], result.Targets["slow"]
+	if fast == nil || fast.Processed != records || fast.Unprocessed != 0 {
+		t.Errorf("fast target %+v, want %v processed", fast, records)
+	}
+	if slow == nil || slow.Processed != records-records/batchSize || slow.Unprocessed != records/batchSize {
+		t.Errorf("slow target %+v, want %v processed and %v unprocessed", slow, records-records/batchSize,
+			records/batchSize)
+	}
+	if result.Processed != fast.Processed+slow.Processed || result.Unprocessed != slow.Unprocessed {
+		t.Errorf("result processed %v, unprocessed %v, want the sums of the targets", result.Processed,
+			result.Unprocessed)
+	}
+}
+
+// closingSource records that Run closed its streams
+type closingSource struct {
+	closed bool
+}
+
+func (s *closingSource) Open(ctx context.Context) (*Streams, error) {
+	out := make(chan APIRecord)
+	close(out)
+	return &Streams{API: out, Close: func() { s.closed = true }}, nil
+}
+
+func TestRunClosesStreams(t *testing.T) {
+	source := &closingSource{}
+	name := fmt.Sprintf("test-close-%v", atomic.AddInt64(&testRegistrations, 1))
+	RegisterSource(name, func(cfg Config) (Source, error) { return source, nil })
+	RegisterSink(name, func(cfg Config) (Sink, error) { return &testTargetSink{}, nil })
+
+	if _, err := Run(context.Background(), Config{Source: name, Sink: name}); err != nil {
+		t.Fatal(err)
+	}
+	if !source.closed {
+		t.Error("the streams were not closed")
+	}
+}
+
+// countingSource counts the sources open at once, it holds its stream open until release is closed
+type countingSource struct {
+	open, maxOpen *int64
+	release       chan struct{}
+}
+
+func (s *countingSource) Open(ctx context.Context) (*Streams, error) {
+	n := atomic.AddInt64(s.open, 1)
+	for {
+		max := atomic.LoadInt64(s.maxOpen)
+		if n <= max || atomic.CompareAndSwapInt64(s.maxOpen, max, n) {
+			break
+		}
+	}
+	out := make(chan APIRecord)
+	go func() {
+		<-s.release
+		close(out)
+	}()
+	return &Streams{API: out, Close: func() { atomic.AddInt64(s.open, -1) }}, nil
+}
+
+func TestRunUploadsOneAtATime(t *testing.T) {
+	var open, maxOpen int64
+	release := make(chan struct{})
+	name := fmt.Sprintf("test-serial-%v", atomic.AddInt64(&testRegistrations, 1))
+	RegisterSource(name, func(cfg Config) (Source, error) {
+		return &countingSource{open: &open, maxOpen: &maxOpen, release: release}, nil
+	})
+	RegisterSink(name, func(cfg Config) (Sink, error) { return &testTargetSink{}, nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Run(context.Background(), Config{Source: name, Sink: name}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if maxOpen != 1 {
+		t.Errorf("%v runs at once, want 1", maxOpen)
+	}
+}
@@ -0,0 +1,135 @@
+package globals
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var ConfigFilePath = new(string)
+var ProfileName = new(string)
+
+/**
+{
+	"profiles": {
+		"staging": {
+			"id": "XXX-XXX-XXXX",
+			"p": "XXX-XXX-XXXX",
+			"r": "in",
+			"batchSize": 500,
+			"filterEvent": ["App Launched", "Stayed"]
+		}
+	}
+}
+*/
+
+type configFile struct {
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+	// Regions add regions to the built-in ones, or change their hosts
+	Regions map[string]RegionHosts `json:"regions"`
+}
+
+// applyConfigProfile sets every flag of fs that the selected profile defines and that was not passed on the
+// command line. Profile keys are flag names, list values are used for repeatable flags.
+func applyConfigProfile(fs *flag.FlagSet) bool {
+	customRegions = nil
+	if *ConfigFilePath == "" {
+		if *ProfileName != "" {
+			Logger.Println("Profile can only be used with a config file")
+			return false
+		}
+		return true
+	}
+	config, ok := readConfigFile()
+	if !ok || !setCustomRegions(config.Regions) {
+		return false
+	}
+	name := *ProfileName
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(config.Profiles))
+		for n := range config.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		Logger.Printf("Profile %v not found in config file. Available profiles: %v", name, names)
+		return false
+	}
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if _, known := flagDefs[key]; f == nil && known {
+			//valid option that the running subcommand does not accept
+			continue
+		}
+		if f == nil || key == "config" || key == "profile" {
+			Logger.Printf("Unknown option %v in profile %v", key, name)
+			return false
+		}
+		if setOnCommandLine[key] {
+			continue
+		}
+		values, isList := profile[key].([]interface{})
+		if !isList {
+			values = []interface{}{profile[key]}
+		}
+		if _, repeatable := f.Value.(*arrayFlags); isList && !repeatable {
+			Logger.Printf("Option %v in profile %v cannot be a list", key, name)
+			return false
+		}
+		for _, v := range values {
+			if err := fs.Set(key, configValueString(v)); err != nil {
+				Logger.Printf("Invalid value for option %v in profile %v: %v", key, name, err)
+				return false
+			}
+		}
+	}
+	Logger.Printf("Using profile %v from config file %v", name, *ConfigFilePath)
+	return true
+}
+
+func readConfigFile() (*configFile, bool) {
+	file, err := os.Open(*ConfigFilePath)
+	if err != nil {
+		Logger.Println("Error in reading config file")
+		Logger.Println(err)
+		return nil, false
+	}
+	defer file.Close()
+	config := &configFile{}
+	if err := json.NewDecoder(file).Decode(config); err != nil {
+		Logger.Println("Unable to parse config file")
+		Logger.Println(err)
+		return nil, false
+	}
+	return config, true
+}
+
+func configValueString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
@@ -6,35 +6,143 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-var CSVFilePath *string
-var JSONFilePath *string
-var SchemaFilePath *string
-var MixpanelSecret *string
-var LeanplumClientKey *string
-var LeanplumAppID *string
-var ImportService *string
-var AWSSecretAccessKey *string
-var AWSAccessKeyID *string
-var AWSRegion *string
-var S3Bucket *string
-var StartDate *string
-var EndDate *string
-var AccountID *string
-var AccountPasscode *string
-var AccountToken *string
-var EvtName *string
-var Type *string
-var Region *string
-var DryRun *bool
-var StartTs *float64
-var LeanplumOutFilesPath *string
-var LeanplumAPIEndpoint *string
+// Logger is what the tool logs through. It writes to standard error like the standard logger, programs that run the
+// importers as a library get what an upload logs on the logger of its ctupload.Config instead.
+var Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+var SchemaFilePath = new(string)
+var MixpanelSecret = new(string)
+var LeanplumClientKey = new(string)
+var LeanplumAppID = new(string)
+var ImportService = new(string)
+var AWSSecretAccessKey = new(string)
+var AWSAccessKeyID = new(string)
+var AWSRegion = new(string)
+var S3Bucket = new(string)
+var S3Endpoint = new(string)
+var StartDate = new(string)
+var EndDate = new(string)
+var AccountID = new(string)
+var AccountPasscode = new(string)
+var AccountToken = new(string)
+var EvtName = new(string)
+var Type = new(string)
+var Region = new(string)
+var DryRun = new(bool)
+var StartTs = new(float64)
+var LeanplumOutFilesPath = new(string)
+var LeanplumAPIEndpoint = new(string)
+var LeanplumThrottled = new(bool)
+var CheckpointFilePath = new(string)
+var Resume = new(bool)
+var DeadLetterFilePath = new(string)
+var ReplayFilePath = new(string)
+var RetryMaxAttempts = new(int)
+var RetryMaxTime = new(time.Duration)
+var RetryBaseDelay = new(time.Duration)
+var RetryMaxDelay = new(time.Duration)
+var APIEndpoint = new(string)
+var SDKEndpoint = new(string)
+var MockServerAddr = new(string)
+var MockErrorRate = new(float64)
+var MockFilesDir = new(string)
+var MockThrottleRate = new(float64)
+var MockRejectRate = new(float64)
+var BatchSize = new(int)
+var APIConcurrency = new(int)
+var SDKConcurrency = new(int)
+var CSVWorkers = new(int)
+var CSVQuote = new(string)
+var CSVLazyQuotes = new(bool)
+var CSVMaxRecordSize = new(int)
+var CSVDelimiter = new(string)
+var CSVComment = new(string)
+var CSVEncoding = new(string)
+var MaxRecordsPerSecond = new(float64)
+var MaxRequestsPerSecond = new(float64)
+var Validate = new(bool)
+var ValidateOnly = new(bool)
+var AutoFix = new(bool)
+var Gzip = new(bool)
+var MetricsAddr = new(string)
+var ReportFilePath = new(string)
+var ProgressInterval = new(time.Duration)
+var RunSource = new(string)
+var RunOptions arrayFlags
 
 //var AutoConvert *bool
 
+// parsedFlags is the flag set the options were parsed into, used to report them
+var parsedFlags *flag.FlagSet
+
+// secretFlags are replaced by REDACTED when the options are reported
+var secretFlags = map[string]bool{"p": true, "tk": true, "mixpanelSecret": true, "leanplumClientKey": true,
+	"awsAccessKeyID": true, "awsSecretAccessKey": true, "target": true}
+
+// Parameters returns the options set for this run, from the command line or the config file, with secrets redacted
+func Parameters() map[string]string {
+	params := make(map[string]string)
+	if parsedFlags == nil {
+		return params
+	}
+	parsedFlags.Visit(func(f *flag.Flag) {
+		if secretFlags[f.Name] {
+			params[f.Name] = "REDACTED"
+			return
+		}
+		params[f.Name] = f.Value.String()
+	})
+	return params
+}
+
+// SavedOptions are the values of options keyed by name, repeatable options with one value per time they were given
+type SavedOptions map[string][]string
+
+// SaveOptions returns the options set for this run, from the command line, the config file or Configure
+func SaveOptions() SavedOptions {
+	saved := make(SavedOptions)
+	if parsedFlags == nil {
+		return saved
+	}
+	parsedFlags.Visit(func(f *flag.Flag) {
+		if values, ok := f.Value.(*arrayFlags); ok {
+			saved[f.Name] = append([]string(nil), *values...)
+			return
+		}
+		saved[f.Name] = []string{f.Value.String()}
+	})
+	return saved
+}
+
+// Restore sets the saved options back to their saved values, the other options are left as they are
+func (s SavedOptions) Restore() {
+	for name, values := range s {
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		defineFlags(fs, []string{name})
+		f := fs.Lookup(name)
+		if repeated, ok := f.Value.(*arrayFlags); ok {
+			*repeated = nil
+		}
+		for _, v := range values {
+			//the values were valid when saved
+			f.Value.Set(v)
+		}
+	}
+}
+
+// Subcommand is the command to run, e.g. "upload csv". It is either given on the command line or, for the
+// flag-only invocation style, inferred from the flags.
+var Subcommand string
+
+// HelpRequested is set when Init returns false because the usage was asked for with help or -h, which is not an
+// error
+var HelpRequested bool
+
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -49,61 +157,416 @@ func (i *arrayFlags) Set(value string) error {
 var MPEventsFilePaths arrayFlags
 var FEvents arrayFlags
 
+// CSVNulls are the -csvNull options, csv fields equal to one of them are uploaded as empty
+var CSVNulls arrayFlags
+
+// flagDefs registers each option, by name, on a flag set. Every subcommand registers the subset of options it
+// accepts, the flag-only invocation style registers all of them.
+var flagDefs = map[string]func(fs *flag.FlagSet){
+	"mixpanelEventsFile": func(fs *flag.FlagSet) {
+		fs.Var(&MPEventsFilePaths, "mixpanelEventsFile", "Absolute path to the MixPanel events file")
+	},
+	"filterEvent": func(fs *flag.FlagSet) {
+		fs.Var(&FEvents, "filterEvent", "Event to be filtered (would not be uploaded)")
+	},
+	"csv": func(fs *flag.FlagSet) {
+		fs.Var(&CSVFilePaths, "csv", "Absolute path to the csv file, a directory or a glob pattern, - for standard input, an http(s) URL or s3://bucket/prefix. Can be repeated")
+	},
+	"json": func(fs *flag.FlagSet) {
+		fs.Var(&JSONFilePaths, "json", "Absolute path to the json file, a directory or a glob pattern, - for standard input, an http(s) URL or s3://bucket/prefix. Can be repeated")
+	},
+	"schema": func(fs *flag.FlagSet) {
+		fs.StringVar(SchemaFilePath, "schema", "", "Absolute path to the schema file")
+	},
+	"transform": func(fs *flag.FlagSet) {
+		fs.StringVar(TransformFilePath, "transform", "", "Absolute path to a file of rules that rename, drop and rewrite the fields of the records before they are uploaded")
+	},
+	"jsonMapping": func(fs *flag.FlagSet) {
+		fs.StringVar(JSONMappingFilePath, "jsonMapping", "", "Absolute path to a file mapping the fields of nested json documents to CleverTap records")
+	},
+	"mixpanelSecret": func(fs *flag.FlagSet) {
+		fs.StringVar(MixpanelSecret, "mixpanelSecret", "", "Mixpanel API secret key")
+	},
+	"leanplumClientKey": func(fs *flag.FlagSet) {
+		fs.StringVar(LeanplumClientKey, "leanplumClientKey", "", "Leanplum Client Key")
+	},
+	"leanplumAppID": func(fs *flag.FlagSet) {
+		fs.StringVar(LeanplumAppID, "leanplumAppID", "", "Leanplum App ID")
+	},
+	"leanplumOutFilesPath": func(fs *flag.FlagSet) {
+		fs.StringVar(LeanplumOutFilesPath, "leanplumOutFilesPath", "", "Absolute path to file that contains names of files generated by LeanPlum")
+	},
+	"leanplumAPIEndpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(LeanplumAPIEndpoint, "leanplumAPIEndpoint", "", "LeanPlum API Endpoint")
+	},
+	"throttled": func(fs *flag.FlagSet) {
+		fs.BoolVar(LeanplumThrottled, "throttled", false, "Export from Leanplum five days at a time")
+	},
+	"importService": func(fs *flag.FlagSet) {
+		fs.StringVar(ImportService, "importService", "", "Service you want to import data from")
+	},
+	"awsAccessKeyID": func(fs *flag.FlagSet) {
+		fs.StringVar(AWSAccessKeyID, "awsAccessKeyID", "", "AWS access key id")
+	},
+	"awsSecretAccessKey": func(fs *flag.FlagSet) {
+		fs.StringVar(AWSSecretAccessKey, "awsSecretAccessKey", "", "AWS secret access key")
+	},
+	"awsRegion": func(fs *flag.FlagSet) {
+		fs.StringVar(AWSRegion, "awsRegion", "", "AWS Region")
+	},
+	"s3Endpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(S3Endpoint, "s3Endpoint", "", "S3 compatible endpoint for s3:// inputs, e.g. http://localhost:9000 for MinIO. Objects are addressed path style")
+	},
+	"s3Bucket": func(fs *flag.FlagSet) {
+		fs.StringVar(S3Bucket, "s3Bucket", "", "S3 bucket")
+	},
+	"startDate": func(fs *flag.FlagSet) {
+		fs.StringVar(StartDate, "startDate", "", "Start date for exporting events "+
+			"<yyyy-mm-dd>")
+	},
+	"endDate": func(fs *flag.FlagSet) {
+		fs.StringVar(EndDate, "endDate", "", "End date for exporting events "+
+			"<yyyy-mm-dd>")
+	},
+	"startTs": func(fs *flag.FlagSet) {
+		fs.Float64Var(StartTs, "startTs", 0, "Start timestamp for events upload")
+	},
+	"id": func(fs *flag.FlagSet) {
+		fs.StringVar(AccountID, "id", "", "CleverTap Account ID")
+	},
+	"p": func(fs *flag.FlagSet) {
+		fs.StringVar(AccountPasscode, "p", "", "CleverTap Account Passcode")
+	},
+	"tk": func(fs *flag.FlagSet) {
+		fs.StringVar(AccountToken, "tk", "", "CleverTap Account Token")
+	},
+	"target": func(fs *flag.FlagSet) {
+		fs.Var(&TargetSpecs, "target", "CleverTap account to upload to, as name=...,id=...,p=...,tk=...,r=... or the name of a "+
+			"config file profile. Can be repeated to upload to several accounts")
+	},
+	"evtName": func(fs *flag.FlagSet) {
+		fs.StringVar(EvtName, "evtName", "", "Event name")
+	},
+	"t": func(fs *flag.FlagSet) {
+		fs.StringVar(Type, "t", "profile", "The type of data, either profile, event, or both, defaults to profile")
+	},
+	"r": func(fs *flag.FlagSet) {
+		fs.StringVar(Region, "r", "eu", "The account region, e.g. eu, in, sg, us, sk, aps3, mec1 or a region of the config file, defaults to eu")
+	},
+	"dryrun": func(fs *flag.FlagSet) {
+		fs.BoolVar(DryRun, "dryrun", false, "Do a dry run, process records but do not upload")
+	},
+	"checkpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(CheckpointFilePath, "checkpoint", "", "Absolute path to the checkpoint file that tracks csv/json upload progress")
+	},
+	"resume": func(fs *flag.FlagSet) {
+		fs.BoolVar(Resume, "resume", false, "Resume a csv/json upload from the line recorded in the checkpoint file")
+	},
+	"deadLetterFile": func(fs *flag.FlagSet) {
+		fs.StringVar(DeadLetterFilePath, "deadLetterFile", "", "Absolute path to the file where records rejected by CleverTap are written")
+	},
+	"replay": func(fs *flag.FlagSet) {
+		fs.StringVar(ReplayFilePath, "replay", "", "Absolute path to a dead-letter file whose records should be uploaded again")
+	},
+	"retryMaxAttempts": func(fs *flag.FlagSet) {
+		fs.IntVar(RetryMaxAttempts, "retryMaxAttempts", 10, "Maximum number of attempts for a request before giving up, 0 for no limit")
+	},
+	"retryMaxTime": func(fs *flag.FlagSet) {
+		fs.DurationVar(RetryMaxTime, "retryMaxTime", 0, "Maximum time spent retrying a request before giving up, e.g. 30m, 0 for no limit")
+	},
+	"retryBaseDelay": func(fs *flag.FlagSet) {
+		fs.DurationVar(RetryBaseDelay, "retryBaseDelay", 5*time.Second, "Delay before the first retry, doubled on every further retry")
+	},
+	"retryMaxDelay": func(fs *flag.FlagSet) {
+		fs.DurationVar(RetryMaxDelay, "retryMaxDelay", 5*time.Minute, "Maximum delay between two retries")
+	},
+	"apiEndpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(APIEndpoint, "apiEndpoint", "", "CleverTap upload API URL, overrides the region, e.g. http://localhost:8080/1/upload")
+	},
+	"sdkEndpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(SDKEndpoint, "sdkEndpoint", "", "CleverTap SDK upload URL, e.g. http://localhost:8080/a1")
+	},
+	"mockServer": func(fs *flag.FlagSet) {
+		fs.StringVar(MockServerAddr, "mockServer", "", "Run a mock CleverTap server on this address instead of uploading, e.g. localhost:8080")
+	},
+	"addr": func(fs *flag.FlagSet) {
+		fs.StringVar(MockServerAddr, "addr", "localhost:8080", "Address the mock CleverTap server listens on")
+	},
+	"mockErrorRate": func(fs *flag.FlagSet) {
+		fs.Float64Var(MockErrorRate, "mockErrorRate", 0, "Fraction of mock server requests that fail with a 5xx error")
+	},
+	"mockFilesDir": func(fs *flag.FlagSet) {
+		fs.StringVar(MockFilesDir, "mockFilesDir", "", "Directory whose files the mock server serves under /files/, for testing URL inputs")
+	},
+	"mockThrottleRate": func(fs *flag.FlagSet) {
+		fs.Float64Var(MockThrottleRate, "mockThrottleRate", 0, "Fraction of mock server requests that fail with a 429 error")
+	},
+	"mockRejectRate": func(fs *flag.FlagSet) {
+		fs.Float64Var(MockRejectRate, "mockRejectRate", 0, "Fraction of valid records the mock server reports as unprocessed")
+	},
+	"batchSize": func(fs *flag.FlagSet) {
+		fs.IntVar(BatchSize, "batchSize", 0, "Number of records per CleverTap upload request, at most 1000, 0 for the importer default")
+	},
+	"apiConcurrency": func(fs *flag.FlagSet) {
+		fs.IntVar(APIConcurrency, "apiConcurrency", 0, "Number of concurrent CleverTap upload API requests, 0 for the importer default")
+	},
+	"sdkConcurrency": func(fs *flag.FlagSet) {
+		fs.IntVar(SDKConcurrency, "sdkConcurrency", 0, "Number of concurrent CleverTap SDK requests, 0 for the importer default")
+	},
+	"csvWorkers": func(fs *flag.FlagSet) {
+		fs.IntVar(CSVWorkers, "csvWorkers", 0, "Number of goroutines converting csv rows, 0 for the number of CPUs")
+	},
+	"csvQuote": func(fs *flag.FlagSet) {
+		fs.StringVar(CSVQuote, "csvQuote", "\"", "Character that quotes csv fields, empty if fields are never quoted")
+	},
+	"csvLazyQuotes": func(fs *flag.FlagSet) {
+		fs.BoolVar(CSVLazyQuotes, "csvLazyQuotes", false, "Accept quotes in unquoted csv fields and quotes that are not doubled in quoted fields")
+	},
+	"csvMaxRecordSize": func(fs *flag.FlagSet) {
+		fs.IntVar(CSVMaxRecordSize, "csvMaxRecordSize", 10*1024*1024, "Largest csv record in bytes, larger records are skipped")
+	},
+	"csvDelimiter": func(fs *flag.FlagSet) {
+		fs.StringVar(CSVDelimiter, "csvDelimiter", ",", "Character that separates csv fields, e.g. ; or | or tab")
+	},
+	"csvComment": func(fs *flag.FlagSet) {
+		fs.StringVar(CSVComment, "csvComment", "", "Character that starts a csv comment line, which is skipped")
+	},
+	"csvEncoding": func(fs *flag.FlagSet) {
+		fs.StringVar(CSVEncoding, "csvEncoding", "utf-8", "Encoding of the csv file: "+strings.Join(CSVEncodings, ", ")+". utf-8 and utf-16 detect a byte order mark")
+	},
+	"csvNull": func(fs *flag.FlagSet) {
+		fs.Var(&CSVNulls, "csvNull", "Csv field value to upload as empty, e.g. NULL or N/A or \\N. Can be given several times")
+	},
+	"maxRecordsPerSecond": func(fs *flag.FlagSet) {
+		fs.Float64Var(MaxRecordsPerSecond, "maxRecordsPerSecond", 0, "Maximum records per second sent to CleverTap, API and SDK combined, 0 for no limit")
+	},
+	"maxRequestsPerSecond": func(fs *flag.FlagSet) {
+		fs.Float64Var(MaxRequestsPerSecond, "maxRequestsPerSecond", 0, "Maximum CleverTap requests per second, API and SDK combined, 0 for no limit")
+	},
+	"validate": func(fs *flag.FlagSet) {
+		fs.BoolVar(Validate, "validate", false, "Check records against the CleverTap limits before uploading and skip the invalid ones")
+	},
+	"validateOnly": func(fs *flag.FlagSet) {
+		fs.BoolVar(ValidateOnly, "validateOnly", false, "Check records against the CleverTap limits without uploading them")
+	},
+	"autoFix": func(fs *flag.FlagSet) {
+		fs.BoolVar(AutoFix, "autoFix", false, "Fix records that fail validation by truncating, renaming or dropping, where possible")
+	},
+	"gzip": func(fs *flag.FlagSet) {
+		fs.BoolVar(Gzip, "gzip", false, "Gzip the bodies of the requests to CleverTap")
+	},
+	"report": func(fs *flag.FlagSet) {
+		fs.StringVar(ReportFilePath, "report", "", "Absolute path to the JSON report written at the end of the run")
+	},
+	"metricsAddr": func(fs *flag.FlagSet) {
+		fs.StringVar(MetricsAddr, "metricsAddr", "", "Address to serve Prometheus metrics on at /metrics, e.g. localhost:9100")
+	},
+	"progressInterval": func(fs *flag.FlagSet) {
+		fs.DurationVar(ProgressInterval, "progressInterval", 30*time.Second, "Interval between progress lines, 0 to disable")
+	},
+	"source": func(fs *flag.FlagSet) {
+		fs.StringVar(RunSource, "source", "", "Name of a registered source, e.g. csv or mixpanel-events")
+	},
+	"o": func(fs *flag.FlagSet) {
+		fs.Var(&RunOptions, "o", "Source and sink option as name=value, where name is an option of the tool. Can be repeated")
+	},
+	"config": func(fs *flag.FlagSet) {
+		fs.StringVar(ConfigFilePath, "config", "", "Absolute path to the JSON config file with named profiles")
+	},
+	"profile": func(fs *flag.FlagSet) {
+		fs.StringVar(ProfileName, "profile", "", "Name of the config file profile to use, defaults to default")
+	},
+	//"autoConvert": func(fs *flag.FlagSet) {
+	//	fs.BoolVar(AutoConvert, "autoConvert", false, "automatically covert property value type to number for number entries")
+	//},
+}
+
+func defineFlags(fs *flag.FlagSet, names []string) {
+	for _, name := range names {
+		flagDefs[name](fs)
+	}
+}
+
 func Init() bool {
-	flag.Var(&MPEventsFilePaths, "mixpanelEventsFile", "Absolute path to the MixPanel events file")
-	flag.Var(&FEvents, "filterEvent", "Event to be filtered (would not be uploaded)")
-	CSVFilePath = flag.String("csv", "", "Absolute path to the csv file")
-	JSONFilePath = flag.String("json", "", "Absolute path to the json file")
-	SchemaFilePath = flag.String("schema", "", "Absolute path to the schema file")
-	MixpanelSecret = flag.String("mixpanelSecret", "", "Mixpanel API secret key")
-	LeanplumClientKey = flag.String("leanplumClientKey", "", "Leanplum Client Key")
-	LeanplumAppID = flag.String("leanplumAppID", "", "Leanplum App ID")
-	LeanplumOutFilesPath = flag.String("leanplumOutFilesPath", "", "Absolute path to file that contains names of files generated by LeanPlum")
-	LeanplumAPIEndpoint = flag.String("leanplumAPIEndpoint", "", "LeanPlum API Endpoint")
-	ImportService = flag.String("importService", "", "Service you want to import data from")
-	AWSAccessKeyID = flag.String("awsAccessKeyID", "", "AWS access key id")
-	AWSSecretAccessKey = flag.String("awsSecretAccessKey", "", "AWS secret access key")
-	AWSRegion = flag.String("awsRegion", "", "AWS Region")
-	S3Bucket = flag.String("s3Bucket", "", "S3 bucket")
-	StartDate = flag.String("startDate", "", "Start date for exporting events "+
-		"<yyyy-mm-dd>")
-	EndDate = flag.String("endDate", "", "End date for exporting events "+
-		"<yyyy-mm-dd>")
-	StartTs = flag.Float64("startTs", 0, "Start timestamp for events upload")
-	AccountID = flag.String("id", "", "CleverTap Account ID")
-	AccountPasscode = flag.String("p", "", "CleverTap Account Passcode")
-	AccountToken = flag.String("tk", "", "CleverTap Account Token")
-	EvtName = flag.String("evtName", "", "Event name")
-	Type = flag.String("t", "profile", "The type of data, either profile, event, or both, defaults to profile")
-	Region = flag.String("r", "eu", "The account region, either eu, in, sk,us ,or sg, defaults to eu")
-	DryRun = flag.Bool("dryrun", false, "Do a dry run, process records but do not upload")
-	//AutoConvert = flag.Bool("autoConvert", false, "automatically covert property value type to number for number entries")
+	names := make([]string, 0, len(flagDefs))
+	for name := range flagDefs {
+		//subcommand only options
+		if name != "throttled" && name != "addr" && name != "source" && name != "o" {
+			names = append(names, name)
+		}
+	}
+	defineFlags(flag.CommandLine, names)
+	flag.CommandLine.Usage = printUsage
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		return initSubcommand(os.Args[1:])
+	}
 	flag.Parse()
-	if (*JSONFilePath == "" && *CSVFilePath == "" && *MixpanelSecret == "" && MPEventsFilePaths == nil && *ImportService == "") || *AccountID == "" || (*AccountPasscode == "" && *ImportService != "leanplumToS3" && *ImportService != "leanplumToS3Throttled") {
-		log.Println("Mixpanel secret or CSV file path or JSON file path or Mixpanel events file path or Import service option, account id, and passcode are mandatory")
+	parsedFlags = flag.CommandLine
+	if !applyConfigProfile(flag.CommandLine) {
+		return false
+	}
+	if !validate() {
 		return false
 	}
-	if (*CSVFilePath != "" || *JSONFilePath != "") && *MixpanelSecret != "" {
-		log.Println("Both Mixpanel secret and CSV file path detected. Only one data source is allowed")
+	Subcommand = legacySubcommand()
+	if Subcommand == "" {
+		Logger.Println("Unable to work out what to run from the options given. Run with -h to see the subcommands")
+		return false
+	}
+	return true
+}
+
+// legacySubcommand infers the subcommand from the flag-only invocation style
+func legacySubcommand() string {
+	if *MockServerAddr != "" {
+		return "mock-server"
+	}
+	if *ReplayFilePath != "" {
+		return "replay"
+	}
+	if *ImportService == "leanplumToS3" || *ImportService == "leanplumToS3Throttled" {
+		return "leanplum export"
+	}
+	if *ImportService == "leanplumS3ToCT" {
+		return "leanplum load"
+	}
+	if len(CSVFilePaths) > 0 && (*Type == "profile" || *Type == "event") {
+		return "upload csv"
+	}
+	if len(JSONFilePaths) > 0 && (*Type == "profile" || *Type == "event") {
+		return "upload json"
+	}
+	if *MixpanelSecret != "" && *Type == "profile" {
+		return "import mixpanel-profiles"
+	}
+	if (*MixpanelSecret != "" || len(MPEventsFilePaths) > 0) && *Type == "event" {
+		return "import mixpanel-events"
+	}
+	if *ImportService == "mparticle" {
+		return "import mparticle"
+	}
+	return ""
+}
+
+func validate() bool {
+	if *RunSource != "" {
+		//the options of the source are checked when it is configured
+		return true
+	}
+	if *MockServerAddr != "" {
+		if *MockErrorRate < 0 || *MockErrorRate > 1 || *MockThrottleRate < 0 || *MockThrottleRate > 1 ||
+			*MockRejectRate < 0 || *MockRejectRate > 1 {
+			Logger.Println("Mock server error, throttle and reject rates should be between 0 and 1")
+			return false
+		}
+		return true
+	}
+	if *ValidateOnly || *AutoFix {
+		*Validate = true
+	}
+	if (len(JSONFilePaths) == 0 && len(CSVFilePaths) == 0 && *MixpanelSecret == "" && MPEventsFilePaths == nil && *ImportService == "" && *ReplayFilePath == "") || (!*ValidateOnly && len(TargetSpecs) == 0 && (*AccountID == "" || (*AccountPasscode == "" && *ImportService != "leanplumToS3" && *ImportService != "leanplumToS3Throttled"))) {
+		Logger.Println("Mixpanel secret or CSV file path or JSON file path or Mixpanel events file path or Import service or replay option, account id, and passcode are mandatory")
+		return false
+	}
+	if (len(CSVFilePaths) > 0 || len(JSONFilePaths) > 0) && *MixpanelSecret != "" {
+		Logger.Println("Both Mixpanel secret and CSV file path detected. Only one data source is allowed")
 		return false
 	}
 	if *Type != "profile" && *Type != "event" && *Type != "both" {
-		log.Println("Type can be either profile or event")
+		Logger.Println("Type can be either profile or event")
+		return false
+	}
+	if (len(CSVFilePaths) > 0 || len(JSONFilePaths) > 0) && *Type == "both" {
+		Logger.Println("Type can be either profile or event for csv and json file uploads")
+		return false
+	}
+	if *ReplayFilePath != "" && (len(JSONFilePaths) > 0 || len(CSVFilePaths) > 0 || *MixpanelSecret != "" || MPEventsFilePaths != nil || *ImportService != "") {
+		Logger.Println("Replay of a dead-letter file cannot be combined with another data source")
+		return false
+	}
+	if *ReplayFilePath != "" && *ReplayFilePath == *DeadLetterFilePath {
+		Logger.Println("Dead-letter file for a replay must be different from the file being replayed")
+		return false
+	}
+	if *BatchSize < 0 || *BatchSize > 1000 || *APIConcurrency < 0 || *SDKConcurrency < 0 || *CSVWorkers < 0 {
+		Logger.Println("Batch size should be between 1 and 1000 and concurrency and csv workers cannot be negative")
+		return false
+	}
+	if *CSVDelimiter == "\\t" || strings.EqualFold(*CSVDelimiter, "tab") {
+		*CSVDelimiter = "\t"
+	}
+	if utf8.RuneCountInString(*CSVDelimiter) != 1 || *CSVDelimiter == "\n" || *CSVDelimiter == "\r" ||
+		*CSVDelimiter == string(utf8.RuneError) {
+		Logger.Println("CSV delimiter should be a single character other than line breaks")
+		return false
+	}
+	if utf8.RuneCountInString(*CSVQuote) > 1 || *CSVQuote == *CSVDelimiter || *CSVQuote == "\n" || *CSVQuote == "\r" {
+		Logger.Println("CSV quote should be a single character other than the delimiter and line breaks")
+		return false
+	}
+	if utf8.RuneCountInString(*CSVComment) > 1 || *CSVComment == *CSVDelimiter || *CSVComment == "\n" ||
+		*CSVComment == "\r" || (*CSVComment != "" && *CSVComment == *CSVQuote) {
+		Logger.Println("CSV comment should be a single character other than the delimiter, the quote and line breaks")
+		return false
+	}
+	if !validCSVEncoding(*CSVEncoding) {
+		Logger.Printf("CSV encoding %v is unknown. Encodings: %v", *CSVEncoding, CSVEncodings)
+		return false
+	}
+	if *CSVMaxRecordSize <= 0 {
+		Logger.Println("CSV max record size should be positive")
+		return false
+	}
+	if *RetryMaxAttempts < 0 || *RetryMaxTime < 0 || *RetryBaseDelay < 0 || *RetryMaxDelay < *RetryBaseDelay {
+		Logger.Println("Retry options cannot be negative and max retry delay cannot be less than base retry delay")
+		return false
+	}
+	if *MaxRecordsPerSecond < 0 || *MaxRequestsPerSecond < 0 {
+		Logger.Println("Records and requests per second limits cannot be negative")
+		return false
+	}
+	if *ProgressInterval < 0 {
+		Logger.Println("Progress interval cannot be negative")
+		return false
+	}
+	if *ValidateOnly && *CheckpointFilePath != "" {
+		Logger.Println("Checkpoint file cannot be used when only validating")
+		return false
+	}
+	if *Resume && *CheckpointFilePath == "" {
+		Logger.Println("Checkpoint file path is mandatory when resuming an upload")
 		return false
 	}
-	if *CSVFilePath != "" && *EvtName == "" && *Type == "event" {
-		log.Println("Event name is mandatory for event csv uploads")
+	if *CheckpointFilePath != "" && len(CSVFilePaths) == 0 && len(JSONFilePaths) == 0 {
+		Logger.Println("Checkpoint file is supported only with csv or json file uploads")
+		return false
+	}
+	if *Resume {
+		for _, path := range append(append([]string(nil), CSVFilePaths...), JSONFilePaths...) {
+			if path == StdinPath {
+				Logger.Println("Resuming an upload is not supported for standard input, which cannot be read again")
+				return false
+			}
+			if IsURL(path) {
+				Logger.Printf("Resuming an upload is not supported for %v, the lines of a download may change "+
+					"between runs", path)
+				return false
+			}
+		}
+	}
+	if len(CSVFilePaths) > 0 && *EvtName == "" && *Type == "event" {
+		Logger.Println("Event name is mandatory for event csv uploads")
 		return false
 	}
 	if *MixpanelSecret != "" && *Type == "event" && *StartDate == "" {
-		log.Println("Start date is mandatory when exporting events from Mixpanel. Format: <yyyy-mm-dd>")
+		Logger.Println("Start date is mandatory when exporting events from Mixpanel. Format: <yyyy-mm-dd>")
 		return false
 	}
 	if *MixpanelSecret != "" && *Type == "event" && *StartDate != "" {
 		//check start date format
 		_, err := time.Parse("2006-01-02", *StartDate)
 		if err != nil {
-			log.Println("Start date is not in correct format. Format: <yyyy-mm-dd>")
+			Logger.Println("Start date is not in correct format. Format: <yyyy-mm-dd>")
 			return false
 		}
 	}
@@ -111,7 +574,7 @@ func Init() bool {
 		//check end date format
 		_, err := time.Parse("2006-01-02", *EndDate)
 		if err != nil {
-			log.Println("End date is not in correct format. Format: <yyyy-mm-dd>")
+			Logger.Println("End date is not in correct format. Format: <yyyy-mm-dd>")
 			return false
 		}
 	}
@@ -120,37 +583,44 @@ func Init() bool {
 		s, _ := time.Parse("2006-01-02", *StartDate)
 		e, _ := time.Parse("2006-01-02", *EndDate)
 		if s.After(e) {
-			log.Println("Start date cannot be after End date")
+			Logger.Println("Start date cannot be after End date")
 			return false
 		}
 	}
 	if MPEventsFilePaths != nil && len(MPEventsFilePaths) > 0 && *Type != "event" {
-		log.Println("Mixpanel events file path is supported only with events")
+		Logger.Println("Mixpanel events file path is supported only with events")
 		return false
 	}
-	if *Region != "eu" && *Region != "in" && *Region != "sk" && *Region != "sg" && *Region != "us" {
-		log.Println("Region can be either eu, in, sk, us or sg")
+	if !validRegion(*Region) {
+		Logger.Printf("Region %v is unknown. Regions: %v", *Region, regionCodes())
 		return false
 	}
 	if *ImportService == "mparticle" && (*AWSSecretAccessKey == "" || *AWSAccessKeyID == "" || *S3Bucket == "" ||
 		*AWSRegion == "") {
-		log.Println("Importing from mparticle requires AWS access key, secret key, region, and S3 bucket")
+		Logger.Println("Importing from mparticle requires AWS access key, secret key, region, and S3 bucket")
 		return false
 	}
 
-	if (*ImportService == "leanplumToS3" || *ImportService == "leanplumS3ToCT" || *ImportService == "leanplumToS3Throttled") && (*AWSSecretAccessKey == "" || *AWSAccessKeyID == "" || *S3Bucket == "" ||
+	if (*ImportService == "leanplumToS3" || *ImportService == "leanplumToS3Throttled") && (*AWSSecretAccessKey == "" || *AWSAccessKeyID == "" || *S3Bucket == "" ||
 		*AWSRegion == "" || *LeanplumAppID == "" || *LeanplumClientKey == "" || *StartDate == "" ||
 		*EndDate == "" || *LeanplumOutFilesPath == "") {
-		log.Println("Importing from Leanplum to S3 requires AWS access key, secret key, region, S3 bucket, " +
+		Logger.Println("Importing from Leanplum to S3 requires AWS access key, secret key, region, S3 bucket, " +
 			"leanplum app ID, leanplum client ID, leanplum out files path, and start and end date")
 		return false
 	}
 
+	if *ImportService == "leanplumS3ToCT" && (*AWSSecretAccessKey == "" || *AWSAccessKeyID == "" || *S3Bucket == "" ||
+		*AWSRegion == "" || *StartDate == "" || *EndDate == "" || *LeanplumOutFilesPath == "") {
+		Logger.Println("Loading Leanplum data from S3 requires AWS access key, secret key, region, S3 bucket, " +
+			"leanplum out files path, and start and end date")
+		return false
+	}
+
 	if (*ImportService == "leanplumToS3" || *ImportService == "leanplumS3ToCT" || *ImportService == "leanplumToS3Throttled") && *EndDate != "" {
 		//check end date format
 		t, err := time.Parse("2006-01-02", *EndDate)
 		if err != nil {
-			log.Println("End date is not in correct format. Format: <yyyy-mm-dd>")
+			Logger.Println("End date is not in correct format. Format: <yyyy-mm-dd>")
 			return false
 		}
 		*EndDate = t.Format("20060102")
@@ -160,18 +630,18 @@ func Init() bool {
 		//check start date format
 		t, err := time.Parse("2006-01-02", *StartDate)
 		if err != nil {
-			log.Println("Start date is not in correct format. Format: <yyyy-mm-dd>")
+			Logger.Println("Start date is not in correct format. Format: <yyyy-mm-dd>")
 			return false
 		}
 		*StartDate = t.Format("20060102")
 	}
 
-	if *ImportService == "leanplumS3ToCT" && *AccountToken == "" {
-		log.Println("Account token is missing")
+	if *ImportService == "leanplumS3ToCT" && *AccountToken == "" && len(TargetSpecs) == 0 {
+		Logger.Println("Account token is missing")
 		return false
 	}
 
-	return true
+	return setUpInputFiles() && setUpTargets()
 }
 
 var Schema map[string]string
@@ -190,8 +660,8 @@ func ParseSchema(file *os.File) bool {
 	*/
 	err := json.NewDecoder(file).Decode(&Schema)
 	if err != nil {
-		log.Println(err)
-		log.Println("Unable to parse schema file")
+		Logger.Println(err)
+		Logger.Println("Unable to parse schema file")
 		return false
 	}
 	return true
@@ -199,9 +669,57 @@ func ParseSchema(file *os.File) bool {
 
 var FilterEventsSet map[string]bool
 
+// CSVNullSet is the set of -csvNull values
+var CSVNullSet map[string]bool
+
+// CSVEncodings are the encodings of -csvEncoding, latin1 and cp1252 are accepted for iso-8859-1 and windows-1252
+var CSVEncodings = []string{"utf-8", "utf-16", "utf-16le", "utf-16be", "iso-8859-1", "windows-1252"}
+
+func validCSVEncoding(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "utf8", "latin1", "cp1252":
+		return true
+	}
+	for _, e := range CSVEncodings {
+		if strings.EqualFold(e, encoding) {
+			return true
+		}
+	}
+	return false
+}
+
 func InitFilterEventsSet() {
 	FilterEventsSet = make(map[string]bool)
 	for _, v := range FEvents {
 		FilterEventsSet[v] = true
 	}
 }
+
+// LoadSchemaAndFilters reads the schema, json mapping and transform files and builds the set of events to filter, if
+// those options are set
+func LoadSchemaAndFilters() bool {
+	if *SchemaFilePath != "" {
+		//read schema file
+		file, err := os.Open(*SchemaFilePath)
+		if err != nil {
+			Logger.Println("Error in parsing schema file")
+			Logger.Println(err)
+			return false
+		}
+		defer file.Close()
+		if !ParseSchema(file) {
+			return false
+		}
+	}
+	if FEvents != nil && len(FEvents) > 0 {
+		InitFilterEventsSet()
+	}
+	CSVNullSet = nil
+	if len(CSVNulls) > 0 {
+		CSVNullSet = make(map[string]bool)
+		for _, v := range CSVNulls {
+			CSVNullSet[v] = true
+		}
+	}
+	return loadJSONMapping() && loadTransforms()
+}
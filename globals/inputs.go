@@ -0,0 +1,157 @@
+package globals
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CSVFilePaths and JSONFilePaths are the -csv and -json options, each a file, a directory or a glob pattern
+var CSVFilePaths arrayFlags
+var JSONFilePaths arrayFlags
+
+// CSVFiles and JSONFiles are the files to upload, in the order they are read, set up by validate from the -csv and
+// -json options
+var CSVFiles []string
+var JSONFiles []string
+
+// StdinPath stands for standard input in -csv, -json and -mixpanelEventsFile
+const StdinPath = "-"
+
+// IsURL tells whether an input path is an http(s) URL, which is downloaded as it is read
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// IsS3URL tells whether an input path is an s3://bucket/prefix, which stands for the objects under the prefix
+func IsS3URL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+//-csv "/data/export/part-*.csv" -csv /data/extra.csv
+//-json /data/export
+//-csv - (standard input)
+//-json https://example.com/export.jsonl.gz
+//-csv s3://exports/2024-03-01/
+
+// expandInputPaths returns the files of paths. A glob pattern stands for the paths it matches, sorted, and a
+// directory for the files below it, sorted and recursively, leaving out hidden files and directories. A file given
+// more than once is read once. Standard input, URLs and S3 prefixes are kept as they are, S3 prefixes are listed
+// when they are read.
+func expandInputPaths(paths []string) ([]string, error) {
+	files := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	for _, p := range paths {
+		if p == StdinPath || IsURL(p) {
+			add(p)
+			continue
+		}
+		if IsS3URL(p) {
+			if strings.Trim(strings.TrimPrefix(p, "s3://"), "/") == "" || strings.HasPrefix(p, "s3:///") {
+				return nil, fmt.Errorf("%v has no bucket, it should be of the form s3://bucket/prefix", p)
+			}
+			add(p)
+			continue
+		}
+		matches := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			var err error
+			matches, err = filepath.Glob(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %v: %v", p, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %v", p)
+			}
+			sort.Strings(matches)
+		}
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(m)
+				continue
+			}
+			dirFiles, err := filesInDir(m)
+			if err != nil {
+				return nil, err
+			}
+			if len(dirFiles) == 0 {
+				return nil, fmt.Errorf("no files in directory %v", m)
+			}
+			for _, f := range dirFiles {
+				add(f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// filesInDir returns the regular files below dir in lexical order, without hidden files and directories
+func filesInDir(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// setUpInputFiles sets CSVFiles and JSONFiles from the -csv and -json options
+func setUpInputFiles() bool {
+	if *S3Endpoint != "" {
+		u, err := url.Parse(*S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			Logger.Printf("S3 endpoint %v should be a URL such as http://localhost:9000", *S3Endpoint)
+			return false
+		}
+	}
+	var err error
+	CSVFiles, JSONFiles = nil, nil
+	if CSVFiles, err = expandInputPaths(CSVFilePaths); err != nil {
+		Logger.Printf("Invalid csv file path: %v", err)
+		return false
+	}
+	if JSONFiles, err = expandInputPaths(JSONFilePaths); err != nil {
+		Logger.Printf("Invalid json file path: %v", err)
+		return false
+	}
+	stdin := 0
+	for _, paths := range [][]string{CSVFiles, JSONFiles, MPEventsFilePaths} {
+		for _, p := range paths {
+			if p == StdinPath {
+				stdin++
+			}
+		}
+	}
+	if stdin > 1 {
+		Logger.Println("Standard input (-) can only be read once")
+		return false
+	}
+	if len(CSVFiles) > 1 || len(JSONFiles) > 1 {
+		Logger.Printf("Input files: %v", len(CSVFiles)+len(JSONFiles))
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package globals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// JSONMappingFilePath is the -jsonMapping option
+var JSONMappingFilePath = new(string)
+
+// JSONMappingSpec picks the fields of a CleverTap record out of nested json documents. Paths are field names
+// separated by dots, with array elements picked by their index, e.g. user.emails.0
+type JSONMappingSpec struct {
+	Identity string `json:"identity"`
+	ObjectID string `json:"objectId"`
+	FBID     string `json:"FBID"`
+	GPID     string `json:"GPID"`
+	TS       string `json:"ts"`
+	EvtName  string `json:"evtName"`
+	// Type is the path of profile or event, the type of each record. Records without it are of the type of -t.
+	Type string `json:"type"`
+	// Properties maps property names to the paths of their values
+	Properties map[string]string `json:"properties"`
+	// PropertiesFrom are the paths of objects whose fields are all properties
+	PropertiesFrom []string `json:"propertiesFrom"`
+}
+
+// JSONMapping is the spec of -jsonMapping, nil when json records are uploaded as they are
+var JSONMapping *JSONMappingSpec
+
+/*
+{
+	"identity": "user.id",
+	"ts": "event.time",
+	"evtName": "event.name",
+	"properties": {"Plan": "user.plan.name", "First Email": "user.emails.0"},
+	"propertiesFrom": ["event.props"]
+}
+*/
+
+func (spec *JSONMappingSpec) check() error {
+	if spec.Identity == "" && spec.ObjectID == "" && spec.FBID == "" && spec.GPID == "" {
+		return fmt.Errorf("identity, objectId, FBID or GPID should be mapped")
+	}
+	for name, path := range spec.Properties {
+		switch name {
+		case "", "identity", "objectId", "FBID", "GPID", "ts", "evtName", "type":
+			return fmt.Errorf("%q cannot be a property name", name)
+		}
+		if path == "" {
+			return fmt.Errorf("property %v has no path", name)
+		}
+	}
+	for _, path := range spec.PropertiesFrom {
+		if path == "" {
+			return fmt.Errorf("propertiesFrom has an empty path")
+		}
+	}
+	if spec.Type == "" && spec.EvtName == "" && *Type == "event" && *EvtName == "" {
+		return fmt.Errorf("evtName should be mapped, or -evtName given, for events")
+	}
+	return nil
+}
+
+// loadJSONMapping reads the -jsonMapping file into JSONMapping
+func loadJSONMapping() bool {
+	JSONMapping = nil
+	if *JSONMappingFilePath == "" {
+		return true
+	}
+	file, err := os.Open(*JSONMappingFilePath)
+	if err != nil {
+		Logger.Println("Error in reading json mapping file")
+		Logger.Println(err)
+		return false
+	}
+	defer file.Close()
+	spec := &JSONMappingSpec{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(spec); err == nil {
+		err = spec.check()
+	}
+	if err != nil {
+		Logger.Printf("Invalid json mapping file %v: %v", *JSONMappingFilePath, err)
+		return false
+	}
+	JSONMapping = spec
+	return true
+}
@@ -0,0 +1,86 @@
+package globals
+
+import (
+	"sort"
+	"strings"
+)
+
+// RegionHosts are the hosts of the CleverTap upload API and of the SDK endpoint of a region. A host can also be a
+// base URL, e.g. http://localhost:8080, for regions that are not served over https.
+type RegionHosts struct {
+	API string `json:"api"`
+	SDK string `json:"sdk"`
+}
+
+// regions maps each CleverTap region code, as given with -r, to its hosts. The codes of the account dashboard
+// URLs, e.g. in1, are accepted as well.
+var regions = map[string]RegionHosts{
+	"eu":   {API: "api.clevertap.com", SDK: "wzrkt.com"},
+	"eu1":  {API: "eu1.api.clevertap.com", SDK: "eu1.wzrkt.com"},
+	"in":   {API: "in1.api.clevertap.com", SDK: "in1.wzrkt.com"},
+	"in1":  {API: "in1.api.clevertap.com", SDK: "in1.wzrkt.com"},
+	"sg":   {API: "sg1.api.clevertap.com", SDK: "sg1.wzrkt.com"},
+	"sg1":  {API: "sg1.api.clevertap.com", SDK: "sg1.wzrkt.com"},
+	"us":   {API: "us1.api.clevertap.com", SDK: "us1.wzrkt.com"},
+	"us1":  {API: "us1.api.clevertap.com", SDK: "us1.wzrkt.com"},
+	"sk":   {API: "sk1.api.clevertap.com", SDK: "sk1.wzrkt.com"},
+	"sk1":  {API: "sk1.api.clevertap.com", SDK: "sk1.wzrkt.com"},
+	"aps3": {API: "aps3.api.clevertap.com", SDK: "aps3.wzrkt.com"},
+	"mec1": {API: "mec1.api.clevertap.com", SDK: "mec1.wzrkt.com"},
+}
+
+// customRegions are the regions of the config file, which take precedence over the built-in ones
+var customRegions map[string]RegionHosts
+
+//"regions": {
+//	"eu2": {"api": "eu2.api.clevertap.com", "sdk": "eu2.wzrkt.com"}
+//}
+
+func setCustomRegions(r map[string]RegionHosts) bool {
+	customRegions = nil
+	for code, hosts := range r {
+		if hosts.API == "" || hosts.SDK == "" {
+			Logger.Printf("Region %v in config file needs both an api and an sdk host", code)
+			return false
+		}
+	}
+	customRegions = r
+	return true
+}
+
+// HostsForRegion returns the hosts of a region code
+func HostsForRegion(code string) (RegionHosts, bool) {
+	if hosts, ok := customRegions[code]; ok {
+		return hosts, true
+	}
+	hosts, ok := regions[code]
+	return hosts, ok
+}
+
+// RegionURL returns the URL of path on host, a host or a base URL of RegionHosts
+func RegionURL(host, path string) string {
+	if strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/") + path
+	}
+	return "https://" + host + path
+}
+
+// regionCodes returns the known region codes in sorted order, for error messages
+func regionCodes() []string {
+	codes := make([]string, 0, len(regions)+len(customRegions))
+	for code := range regions {
+		codes = append(codes, code)
+	}
+	for code := range customRegions {
+		if _, ok := regions[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func validRegion(code string) bool {
+	_, ok := HostsForRegion(code)
+	return ok
+}
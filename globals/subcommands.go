@@ -0,0 +1,304 @@
+package globals
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+type subcommand struct {
+	name        string
+	description string
+	flags       []string
+	// pathFlag, if set, is the option that receives the optional file path given after the options
+	pathFlag string
+	// setup sets the options implied by the subcommand and checks the ones it requires
+	setup func() bool
+}
+
+var accountFlags = []string{"id", "p", "r", "target", "config", "profile"}
+
+var apiUploadFlags = []string{"dryrun", "deadLetterFile", "retryMaxAttempts", "retryMaxTime", "retryBaseDelay",
+	"retryMaxDelay", "apiEndpoint", "batchSize", "apiConcurrency", "maxRecordsPerSecond", "maxRequestsPerSecond",
+	"gzip", "validate", "validateOnly", "autoFix", "progressInterval", "metricsAddr", "report"}
+
+var csvFlags = []string{"csvDelimiter", "csvQuote", "csvComment", "csvEncoding", "csvNull", "csvLazyQuotes",
+	"csvMaxRecordSize", "csvWorkers"}
+
+var awsFlags = []string{"awsAccessKeyID", "awsSecretAccessKey", "awsRegion", "s3Bucket"}
+
+// s3InputFlags are the options of s3:// inputs
+var s3InputFlags = []string{"awsAccessKeyID", "awsSecretAccessKey", "awsRegion", "s3Endpoint"}
+
+func withFlags(groups ...[]string) []string {
+	names := make([]string, 0)
+	for _, g := range groups {
+		names = append(names, g...)
+	}
+	return names
+}
+
+var subcommands = []subcommand{
+	{
+		name:        "upload csv",
+		description: "Upload profiles or events from a csv file",
+		flags:       withFlags(accountFlags, apiUploadFlags, csvFlags, s3InputFlags, []string{"csv", "t", "evtName", "schema", "transform", "checkpoint", "resume"}),
+		pathFlag:    "csv",
+		setup: func() bool {
+			if len(CSVFilePaths) == 0 {
+				Logger.Println("CSV file path is mandatory")
+				return false
+			}
+			return true
+		},
+	},
+	{
+		name:        "upload json",
+		description: "Upload profiles or events from json files with one record per line or an array of records",
+		flags:       withFlags(accountFlags, apiUploadFlags, s3InputFlags, []string{"json", "t", "evtName", "schema", "jsonMapping", "transform", "checkpoint", "resume"}),
+		pathFlag:    "json",
+		setup: func() bool {
+			if len(JSONFilePaths) == 0 {
+				Logger.Println("JSON file path is mandatory")
+				return false
+			}
+			return true
+		},
+	},
+	{
+		name:        "import mixpanel-events",
+		description: "Import events from the Mixpanel export API or from Mixpanel events files",
+		flags: withFlags(accountFlags, apiUploadFlags, []string{"mixpanelSecret", "mixpanelEventsFile", "startDate",
+			"endDate", "startTs", "transform"}),
+		setup: func() bool {
+			*Type = "event"
+			if *MixpanelSecret == "" && len(MPEventsFilePaths) == 0 {
+				Logger.Println("Mixpanel secret or Mixpanel events file path is mandatory")
+				return false
+			}
+			return true
+		},
+	},
+	{
+		name:        "import mixpanel-profiles",
+		description: "Import profiles from the Mixpanel engage API",
+		flags:       withFlags(accountFlags, apiUploadFlags, []string{"mixpanelSecret", "transform"}),
+		setup: func() bool {
+			*Type = "profile"
+			if *MixpanelSecret == "" {
+				Logger.Println("Mixpanel secret is mandatory")
+				return false
+			}
+			return true
+		},
+	},
+	{
+		name:        "import mparticle",
+		description: "Import events from mParticle files in an S3 bucket",
+		flags:       withFlags(accountFlags, apiUploadFlags, awsFlags, []string{"startDate", "endDate", "filterEvent", "schema", "transform"}),
+		setup: func() bool {
+			*Type = "event"
+			*ImportService = "mparticle"
+			return true
+		},
+	},
+	{
+		name:        "leanplum export",
+		description: "Export data from Leanplum to an S3 bucket",
+		flags: withFlags(awsFlags, []string{"id", "config", "profile", "leanplumAppID", "leanplumClientKey",
+			"leanplumAPIEndpoint", "leanplumOutFilesPath", "startDate", "endDate", "throttled", "retryMaxAttempts",
+			"retryMaxTime", "retryBaseDelay", "retryMaxDelay", "report"}),
+		setup: func() bool {
+			*ImportService = "leanplumToS3"
+			if *LeanplumThrottled {
+				*ImportService = "leanplumToS3Throttled"
+			}
+			return true
+		},
+	},
+	{
+		name:        "leanplum load",
+		description: "Upload data exported by leanplum export from S3 to CleverTap",
+		flags: withFlags(accountFlags, apiUploadFlags, awsFlags, []string{"tk", "leanplumOutFilesPath", "startDate",
+			"endDate", "sdkEndpoint", "sdkConcurrency", "transform"}),
+		setup: func() bool {
+			*ImportService = "leanplumS3ToCT"
+			return true
+		},
+	},
+	{
+		name:        "replay",
+		description: "Upload the records of a dead-letter file again",
+		flags:       withFlags(accountFlags, apiUploadFlags, []string{"replay", "t", "transform"}),
+		pathFlag:    "replay",
+		setup: func() bool {
+			if *ReplayFilePath == "" {
+				Logger.Println("Path of the dead-letter file to replay is mandatory")
+				return false
+			}
+			return true
+		},
+	},
+	{
+		name:        "run",
+		description: "Run a registered source, including sources added by programs that embed the importers",
+		flags: []string{"source", "o", "batchSize", "apiConcurrency", "sdkConcurrency", "maxRecordsPerSecond",
+			"maxRequestsPerSecond", "gzip", "validate", "validateOnly", "autoFix", "progressInterval", "metricsAddr",
+			"report"},
+		setup: func() bool {
+			if *RunSource == "" {
+				Logger.Println("Source is mandatory")
+				return false
+			}
+			for _, o := range RunOptions {
+				if !strings.Contains(o, "=") {
+					Logger.Printf("Option %v should be of the form name=value", o)
+					return false
+				}
+			}
+			return true
+		},
+	},
+	{
+		name:        "mock-server",
+		description: "Run a local mock CleverTap server for the upload API and the SDK endpoint",
+		flags: []string{"addr", "id", "p", "tk", "config", "profile", "mockErrorRate", "mockThrottleRate", "mockRejectRate",
+			"mockFilesDir"},
+		setup: func() bool {
+			return true
+		},
+	},
+}
+
+// initSubcommand parses the arguments of a subcommand invocation, e.g. upload csv -csv in.csv -id ... -p ...
+func initSubcommand(args []string) bool {
+	if args[0] == "help" {
+		printUsage()
+		HelpRequested = true
+		return false
+	}
+	for _, sc := range subcommands {
+		words := strings.Fields(sc.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != sc.name {
+			continue
+		}
+		fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+		defineFlags(fs, sc.flags)
+		fs.Usage = func() {
+			if sc.pathFlag != "" {
+				fmt.Fprintf(fs.Output(), "Usage: %v %v [options] [files]\n\n%v\n\nOptions:\n", os.Args[0], sc.name, sc.description)
+			} else {
+				fmt.Fprintf(fs.Output(), "Usage: %v %v [options]\n\n%v\n\nOptions:\n", os.Args[0], sc.name, sc.description)
+			}
+			fs.PrintDefaults()
+		}
+		if err := fs.Parse(args[len(words):]); err != nil {
+			HelpRequested = err == flag.ErrHelp
+			return false
+		}
+		parsedFlags = fs
+		if sc.pathFlag != "" {
+			//several files, e.g. from a glob expanded by the shell
+			for _, path := range fs.Args() {
+				fs.Set(sc.pathFlag, path)
+			}
+		} else if fs.NArg() > 0 {
+			Logger.Printf("Unexpected arguments for %v: %v", sc.name, fs.Args())
+			return false
+		}
+		if !applyConfigProfile(fs) {
+			return false
+		}
+		if !sc.setup() || !validate() {
+			return false
+		}
+		Subcommand = sc.name
+		return true
+	}
+	Logger.Printf("Unknown subcommand: %v", strings.Join(args, " "))
+	printUsage()
+	return false
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %v <subcommand> [options]\n\nSubcommands:\n", os.Args[0])
+	for _, sc := range subcommands {
+		fmt.Fprintf(out, "  %-26v %v\n", sc.name, sc.description)
+	}
+	fmt.Fprintf(out, "\nRun %v <subcommand> -h for the options of a subcommand.\n", os.Args[0])
+	fmt.Fprintf(out, "\nThe options below can also be used without a subcommand, in which case the data source is "+
+		"worked out from them:\n")
+	flag.PrintDefaults()
+}
+
+// Configure sets the options of a subcommand the way they would be parsed from its command line, for programs
+// that run the importers as a library. Options are keyed by option name, repeatable options take one value per
+// line. Options that are valid for other subcommands only are ignored. All other options are reset to their
+// defaults first, so consecutive calls do not leak into each other.
+func Configure(name string, options map[string]string) error {
+	var sc *subcommand
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			sc = &subcommands[i]
+		}
+	}
+	if sc == nil {
+		return fmt.Errorf("unknown subcommand %v", name)
+	}
+	all := make([]string, 0, len(flagDefs))
+	for n := range flagDefs {
+		all = append(all, n)
+	}
+	defineFlags(flag.NewFlagSet("defaults", flag.ContinueOnError), all)
+	//the mock server address has a default but must only be set when running the mock server
+	*MockServerAddr = ""
+	MPEventsFilePaths = nil
+	CSVFilePaths = nil
+	JSONFilePaths = nil
+	RunOptions = nil
+	TargetSpecs = nil
+	FEvents = nil
+	CSVNulls = nil
+	Schema = nil
+	JSONMapping = nil
+	Transforms = nil
+	FilterEventsSet = nil
+	CSVNullSet = nil
+
+	fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	defineFlags(fs, sc.flags)
+	parsedFlags = fs
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if _, known := flagDefs[key]; f == nil && known {
+			continue
+		}
+		if f == nil {
+			return fmt.Errorf("unknown option %v", key)
+		}
+		values := []string{options[key]}
+		if _, repeatable := f.Value.(*arrayFlags); repeatable {
+			values = strings.Split(options[key], "\n")
+		}
+		for _, v := range values {
+			if err := fs.Set(key, v); err != nil {
+				return fmt.Errorf("invalid value for option %v: %v", key, err)
+			}
+		}
+	}
+	if !applyConfigProfile(fs) || !sc.setup() || !validate() || !LoadSchemaAndFilters() {
+		return fmt.Errorf("invalid options for %v, see the log for details", sc.name)
+	}
+	Subcommand = sc.name
+	return nil
+}
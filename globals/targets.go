@@ -0,0 +1,146 @@
+package globals
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Target is a CleverTap account the records of a run are uploaded to. Name is empty for the account given with
+// -id, -p, -tk and -r, which is the only target unless -target is used.
+type Target struct {
+	Name        string
+	ID          string
+	Passcode    string
+	Token       string
+	Region      string
+	APIEndpoint string
+	SDKEndpoint string
+}
+
+// TargetSpecs are the -target options, either name=value pairs separated by commas or the name of a config file
+// profile
+var TargetSpecs arrayFlags
+
+// Targets are the accounts to upload to, set up by validate
+var Targets []Target
+
+// targetKeys are the keys of a target, named after the options they stand in for
+var targetKeys = []string{"name", "id", "p", "tk", "r", "apiEndpoint", "sdkEndpoint"}
+
+//-target "name=staging,id=XXX-XXX-XXXX,p=XXX-XXX-XXXX,r=in"
+//-target production
+
+func parseTarget(spec string) (Target, error) {
+	values := make(map[string]string)
+	if !strings.Contains(spec, "=") {
+		profile, err := targetProfile(spec)
+		if err != nil {
+			return Target{}, err
+		}
+		values = profile
+		values["name"] = spec
+	} else {
+		for _, kv := range strings.Split(spec, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				return Target{}, fmt.Errorf("%q should be of the form name=value", kv)
+			}
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	for key := range values {
+		known := false
+		for _, k := range targetKeys {
+			known = known || k == key
+		}
+		if !known {
+			return Target{}, fmt.Errorf("unknown key %v, keys are %v", key, targetKeys)
+		}
+	}
+	t := Target{
+		Name:        values["name"],
+		ID:          values["id"],
+		Passcode:    values["p"],
+		Token:       values["tk"],
+		Region:      values["r"],
+		APIEndpoint: values["apiEndpoint"],
+		SDKEndpoint: values["sdkEndpoint"],
+	}
+	if t.Name == "" {
+		t.Name = t.ID
+	}
+	return t, nil
+}
+
+// targetProfile returns the account options of a config file profile
+func targetProfile(name string) (map[string]string, error) {
+	if *ConfigFilePath == "" {
+		return nil, fmt.Errorf("profile %v can only be used with a config file", name)
+	}
+	config, ok := readConfigFile()
+	if !ok {
+		return nil, fmt.Errorf("cannot read config file %v", *ConfigFilePath)
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %v not found in config file", name)
+	}
+	values := make(map[string]string)
+	for _, key := range targetKeys {
+		if v, ok := profile[key]; ok && key != "name" {
+			values[key] = configValueString(v)
+		}
+	}
+	return values, nil
+}
+
+// setUpTargets sets Targets from the -target options, or from -id, -p, -tk and -r without them. Targets fall back
+// to -r, -apiEndpoint and -sdkEndpoint for what they leave out.
+func setUpTargets() bool {
+	Targets = nil
+	if len(TargetSpecs) == 0 {
+		Targets = []Target{{ID: *AccountID, Passcode: *AccountPasscode, Token: *AccountToken, Region: *Region,
+			APIEndpoint: *APIEndpoint, SDKEndpoint: *SDKEndpoint}}
+		return true
+	}
+	if *AccountID != "" || *AccountPasscode != "" || *AccountToken != "" {
+		Logger.Println("Account id, passcode and token cannot be combined with targets, give them in each target")
+		return false
+	}
+	names := make(map[string]bool)
+	for _, spec := range TargetSpecs {
+		t, err := parseTarget(spec)
+		if err != nil {
+			Logger.Printf("Invalid target %v: %v", spec, err)
+			return false
+		}
+		if t.Region == "" {
+			t.Region = *Region
+		}
+		if t.APIEndpoint == "" {
+			t.APIEndpoint = *APIEndpoint
+		}
+		if t.SDKEndpoint == "" {
+			t.SDKEndpoint = *SDKEndpoint
+		}
+		if t.Name == "" || (!*ValidateOnly && (t.ID == "" || t.Passcode == "")) {
+			Logger.Printf("Target %v needs an account id and passcode", spec)
+			return false
+		}
+		if *ImportService == "leanplumS3ToCT" && t.Token == "" {
+			Logger.Printf("Account token is missing for target %v", t.Name)
+			return false
+		}
+		if !validRegion(t.Region) {
+			Logger.Printf("Region %v of target %v is unknown. Regions: %v", t.Region, t.Name, regionCodes())
+			return false
+		}
+		if names[t.Name] {
+			Logger.Printf("Target %v is given twice, targets need distinct names", t.Name)
+			return false
+		}
+		names[t.Name] = true
+		Targets = append(Targets, t)
+	}
+	return true
+}
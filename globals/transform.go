@@ -0,0 +1,162 @@
+package globals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// TransformFilePath is the -transform option
+var TransformFilePath = new(string)
+
+// TransformRule is one step of a -transform file. Fields are named as in a CleverTap record: identity, objectId,
+// FBID, GPID, ts, evtName and type for the fields of the record, profileData.<key> and evtData.<key> for properties,
+// and a plain <key> for a property of the record, in evtData for events and profileData for profiles.
+type TransformRule struct {
+	// Op is rename, drop, allow, deny, set, concat, split, replace, lowercase or trim
+	Op string `json:"op"`
+	// Type and Events, if set, limit the rule to records of that type and to those events
+	Type   string   `json:"type,omitempty"`
+	Events []string `json:"events,omitempty"`
+	// From and To are the fields of rename, which moves a field to another part of the record when they are in
+	// different parts
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Field is the field of set and split
+	Field string `json:"field,omitempty"`
+	// Fields are the fields of drop, allow, deny, concat, replace, lowercase and trim
+	Fields []string `json:"fields,omitempty"`
+	// Pattern is the regular expression of replace, and of the property keys of allow and deny
+	Pattern string `json:"pattern,omitempty"`
+	// Value is the constant of set
+	Value interface{} `json:"value,omitempty"`
+	// With replaces the matches of replace, with $1 for the first group
+	With string `json:"with,omitempty"`
+	// Separator joins the values of concat and separates those of split
+	Separator string `json:"separator,omitempty"`
+	// Into are the fields that get the parts of split, in order. Without them the field becomes a list of its parts.
+	Into []string `json:"into,omitempty"`
+
+	Regexp *regexp.Regexp `json:"-"`
+}
+
+// Transforms are the rules of -transform, applied in order to every record uploaded with the upload API
+var Transforms []TransformRule
+
+/*
+{
+	"rules": [
+		{"op": "rename", "from": "$email", "to": "Email"},
+		{"op": "rename", "from": "profileData.Email", "to": "identity"},
+		{"op": "deny", "pattern": "^mp_"},
+		{"op": "set", "field": "Source", "value": "mixpanel"},
+		{"op": "concat", "fields": ["First Name", "Last Name"], "separator": " ", "to": "Name"},
+		{"op": "split", "field": "Tags", "separator": ","},
+		{"op": "replace", "fields": ["Phone"], "pattern": "[^+0-9]", "with": ""},
+		{"op": "lowercase", "fields": ["identity"]},
+		{"op": "trim", "fields": ["Name"]}
+	]
+}
+*/
+
+func checkTransformField(field string) error {
+	if field == "" {
+		return fmt.Errorf("missing field")
+	}
+	if field == "profileData." || field == "evtData." || field == "profileData" || field == "evtData" {
+		return fmt.Errorf("field %v has no property key", field)
+	}
+	return nil
+}
+
+func (r *TransformRule) check() error {
+	if r.Type != "" && r.Type != "profile" && r.Type != "event" {
+		return fmt.Errorf("type %v should be profile or event", r.Type)
+	}
+	var fields []string
+	switch r.Op {
+	case "rename":
+		fields = []string{r.From, r.To}
+	case "drop", "lowercase", "trim":
+		fields = r.Fields
+		if len(fields) == 0 {
+			return fmt.Errorf("%v needs fields", r.Op)
+		}
+	case "allow", "deny":
+		if len(r.Fields) == 0 && r.Pattern == "" {
+			return fmt.Errorf("%v needs fields or a pattern", r.Op)
+		}
+		fields = r.Fields
+	case "set":
+		fields = []string{r.Field}
+		if r.Value == nil {
+			return fmt.Errorf("set needs a value")
+		}
+	case "concat":
+		if len(r.Fields) == 0 {
+			return fmt.Errorf("concat needs fields")
+		}
+		fields = append([]string{r.To}, r.Fields...)
+	case "split":
+		if r.Separator == "" {
+			return fmt.Errorf("split needs a separator")
+		}
+		fields = append([]string{r.Field}, r.Into...)
+	case "replace":
+		if len(r.Fields) == 0 || r.Pattern == "" {
+			return fmt.Errorf("replace needs fields and a pattern")
+		}
+		fields = r.Fields
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	for _, field := range fields {
+		if err := checkTransformField(field); err != nil {
+			return fmt.Errorf("%v: %v", r.Op, err)
+		}
+	}
+	if r.Pattern != "" {
+		var err error
+		if r.Regexp, err = regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("%v: invalid pattern: %v", r.Op, err)
+		}
+	}
+	return nil
+}
+
+// loadTransforms reads the -transform file into Transforms
+func loadTransforms() bool {
+	Transforms = nil
+	if *TransformFilePath == "" {
+		return true
+	}
+	file, err := os.Open(*TransformFilePath)
+	if err != nil {
+		Logger.Println("Error in reading transform file")
+		Logger.Println(err)
+		return false
+	}
+	defer file.Close()
+	var spec struct {
+		Rules []TransformRule `json:"rules"`
+	}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		Logger.Printf("Invalid transform file %v: %v", *TransformFilePath, err)
+		return false
+	}
+	for i := range spec.Rules {
+		if err := spec.Rules[i].check(); err != nil {
+			Logger.Printf("Invalid transform file %v: rule %v: %v", *TransformFilePath, i+1, err)
+			return false
+		}
+	}
+	if len(spec.Rules) == 0 {
+		Logger.Printf("Transform file %v has no rules", *TransformFilePath)
+		return false
+	}
+	Transforms = spec.Rules
+	return true
+}
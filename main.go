@@ -10,24 +10,21 @@ import (
 
 func main() {
 	if !globals.Init() {
-		return
-	}
-	if *globals.SchemaFilePath != "" {
-		//read schema file
-		file, err := os.Open(*globals.SchemaFilePath)
-		if err != nil {
-			log.Println("Error in parsing schema file")
-			log.Println(err)
-			return
-		}
-		if !globals.ParseSchema(file) {
-			file.Close()
+		if globals.HelpRequested {
 			return
 		}
-		file.Close()
+		os.Exit(1)
+	}
+	if !globals.LoadSchemaAndFilters() {
+		os.Exit(1)
+	}
+	command := commands.Get()
+	if command == nil {
+		log.Printf("Unknown subcommand: %v", globals.Subcommand)
+		os.Exit(1)
 	}
-	if globals.FEvents != nil && len(globals.FEvents) > 0 {
-		globals.InitFilterEventsSet()
+	if err := command.Execute(); err != nil {
+		log.Println(err)
+		os.Exit(1)
 	}
-	commands.Get().Execute()
 }